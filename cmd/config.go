@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	ec2 "github.com/justmiles/ec2-runner/lib"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShow)
+}
+
+// process the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the profiles in the config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// process the config show command
+var configShow = &cobra.Command{
+	Use:   "show",
+	Short: "Show the options of a profile, including those it inherits, or list every profile",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if profile == "" {
+			for _, name := range config.ProfileNames() {
+				fmt.Println(name)
+			}
+			return
+		}
+
+		options, err := config.Profile(profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out, err := yaml.Marshal(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("# profile %s\n%s", profile, out)
+	},
+}
+
+// loadConfig reads the config file given by --config
+func loadConfig() (*ec2.Config, error) {
+	if configFile == "" {
+		path, err := ec2.DefaultConfigPath()
+		if err != nil {
+			return nil, err
+		}
+		configFile = path
+	}
+	return ec2.LoadConfig(configFile)
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	ec2 "github.com/justmiles/ec2-runner/lib"
+	"github.com/spf13/cobra"
+)
+
+var followLogs bool
+
+func init() {
+	rootCmd.AddCommand(logs, attach, wait, stop)
+
+	logs.Flags().BoolVarP(&followLogs, "follow", "f", false, "Keep printing output until the command finishes")
+}
+
+// loadDetachedRun returns the state and instance of a detached run
+func loadDetachedRun(runID string) (string, *ec2.RunState, *ec2.Instance) {
+	dir, err := ec2.DefaultStateDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	state, err := ec2.LoadRunState(dir, runID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := ec2.NewClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	instance, err := state.Instance(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return dir, state, instance
+}
+
+// completeDetachedRun downloads files, terminates the instance and forgets the run once its
+// command has finished, then exits with the command's exit code
+func completeDetachedRun(dir string, state *ec2.RunState, instance *ec2.Instance) {
+	exitCode := *instance.ExitCode
+
+	if err := instance.CompleteDetached(); err != nil {
+		ec2.Log.Errorf("%s", err)
+		if exitCode == 0 {
+			exitCode = 1
+		}
+	}
+
+	if err := state.Remove(dir); err != nil {
+		ec2.Log.Errorf("%s", err)
+	}
+
+	summary := ec2.Log.Writer(ec2.LevelInfo)
+	fmt.Fprintln(summary)
+	ec2.Summary(summary, []*ec2.Instance{instance})
+	os.Exit(exitCode)
+}
+
+// process the logs command
+var logs = &cobra.Command{
+	Use:   "logs <run>",
+	Short: "Print the output of a detached run",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, _, instance := loadDetachedRun(args[0])
+
+		if err := instance.FollowLogs(followLogs); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// process the attach command
+var attach = &cobra.Command{
+	Use:   "attach <run>",
+	Short: "Stream the output of a detached run and clean up once it finishes",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, state, instance := loadDetachedRun(args[0])
+
+		if err := instance.FollowLogs(true); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := instance.WaitDetached(); err != nil {
+			log.Fatal(err)
+		}
+
+		completeDetachedRun(dir, state, instance)
+	},
+}
+
+// process the wait command
+var wait = &cobra.Command{
+	Use:   "wait <run>",
+	Short: "Wait for a detached run to finish, clean up and exit with its exit code",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, state, instance := loadDetachedRun(args[0])
+
+		ec2.Log.Infof("Waiting for run %s on %s", state.RunID, state.InstanceID)
+		if err := instance.WaitDetached(); err != nil {
+			log.Fatal(err)
+		}
+
+		completeDetachedRun(dir, state, instance)
+	},
+}
+
+// process the stop command
+var stop = &cobra.Command{
+	Use:   "stop <run>",
+	Short: "Stop a detached run and clean up",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, state, instance := loadDetachedRun(args[0])
+
+		// the instance is terminated and the run forgotten even when the command left no exit code
+		if err := instance.StopDetached(); err != nil {
+			ec2.Log.Errorf("%s", err)
+			if *instance.ExitCode < 0 {
+				*instance.ExitCode = 1
+			}
+		}
+
+		completeDetachedRun(dir, state, instance)
+	},
+}
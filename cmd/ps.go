@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	ec2 "github.com/justmiles/ec2-runner/lib"
+	"github.com/spf13/cobra"
+)
+
+var psAll bool
+var psOutput string
+
+func init() {
+	rootCmd.AddCommand(ps, inspect)
+
+	ps.Flags().BoolVarP(&psAll, "all", "a", false, "Include terminated instances")
+	ps.Flags().StringVarP(&psOutput, "output", "o", "table", "Output format. One of table or json")
+}
+
+// process the ps command
+var ps = &cobra.Command{
+	Use:   "ps",
+	Short: "List the instances of runs in the account and region",
+	Run: func(cmd *cobra.Command, args []string) {
+		if psOutput != "table" && psOutput != "json" {
+			log.Fatalf("unknown output format %s", psOutput)
+		}
+
+		client, err := ec2.NewClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		runs, err := client.Runs(psAll, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if psOutput == "json" {
+			printJSON(runs)
+			return
+		}
+		ec2.RunsTable(os.Stdout, runs)
+	},
+}
+
+// process the inspect command
+var inspect = &cobra.Command{
+	Use:   "inspect <run-or-instance-id>",
+	Short: "Show everything known about the instances of a run, or a single instance",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := ec2.NewClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		runs, err := client.InspectRun(args[0], time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		printJSON(runs)
+	},
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	ec2 "github.com/justmiles/ec2-runner/lib"
+	"github.com/spf13/cobra"
+)
+
+var reapDryRun bool
+
+func init() {
+	rootCmd.AddCommand(reap)
+
+	reap.Flags().BoolVar(&reapDryRun, "dry-run", false, "List the expired resources without deleting them")
+}
+
+// process the reap command
+var reap = &cobra.Command{
+	Use:   "reap",
+	Short: "Delete expired instances, key pairs and launch templates left behind by runs that died",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := ec2.NewClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		resources, err := client.ExpiredResources(time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dir, err := ec2.DefaultStateDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		resources = ec2.WithoutDetachedRuns(resources, dir)
+
+		if len(resources) == 0 {
+			fmt.Println("Nothing to reap")
+			return
+		}
+
+		var failed bool
+		for _, resource := range resources {
+			if reapDryRun {
+				fmt.Printf("Would reap %s, expired %s\n", resource, humanize.Time(resource.Expires))
+				continue
+			}
+
+			if err := client.Reap(resource); err != nil {
+				ec2.Log.Errorf("%s", err)
+				failed = true
+				continue
+			}
+			fmt.Printf("Reaped %s, expired %s\n", resource, humanize.Time(resource.Expires))
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
@@ -2,20 +2,66 @@ package cmd
 
 import (
 	"log"
+	"os"
 
+	ec2 "github.com/justmiles/ec2-runner/lib"
 	"github.com/spf13/cobra"
 )
 
+var profile string
+var configFile string
+var quiet bool
+var verbose bool
+var logFile string
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "Profile from the config file whose options are used as defaults")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file holding profiles. Defaults to ~/.config/ec2-runner/config.yaml")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only log warnings and errors")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Log every attempt and step")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append log messages, with timestamps, to this file instead of stderr")
+}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "ec2",
 	Short: "Quickly interact with EC2 resources",
 	Long:  "Provides a quick and extendable way to interact with EC2",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		setupLogging()
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Help()
 	},
 }
 
+// setupLogging sends log messages at the requested level to stderr or the log file
+func setupLogging() {
+	if quiet && verbose {
+		log.Fatal("--quiet and --verbose can not be used together")
+	}
+
+	level := ec2.LevelInfo
+	switch {
+	case quiet:
+		level = ec2.LevelWarn
+	case verbose:
+		level = ec2.LevelDebug
+	}
+
+	if logFile == "" {
+		ec2.Log = ec2.NewLogger(os.Stderr, level)
+		return
+	}
+
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Unable to open log file: %s", err)
+	}
+	ec2.Log = ec2.NewLogger(f, level)
+	ec2.Log.Timestamps = true
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(version string) {
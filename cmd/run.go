@@ -7,19 +7,27 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/aws/aws-sdk-go/aws"
 	ec2 "github.com/justmiles/ec2-runner/lib"
 	"github.com/spf13/cobra"
 )
 
 var opts ec2.InstanceOptions
 var dryRun bool
+var exitPolicy string
+var jobFile string
+var outputFormat string
+var eventsFile string
 
 func init() {
 	log.SetFlags(0)
 	rootCmd.AddCommand(run)
 	run.Flags().SetInterspersed(false)
 
+	run.PersistentFlags().StringVarP(&jobFile, "file", "f", "", "Job definition file (YAML or JSON) to load options from. Flags override values in the file")
+
 	run.PersistentFlags().StringVar(&opts.AMI, "ami", "", "AMI name. Supports wildcards. Newest image is returned")
 	run.PersistentFlags().StringVar(&opts.AMIID, "ami-id", "", "AMI ID, overriding ami-filter or ami")
 	// TODO: consider default ami filter for amazon linux 2
@@ -36,7 +44,12 @@ func init() {
 	run.PersistentFlags().StringVar(&opts.SSHKey, "ssh-key", "", "(optional) use this AWS SSH key. If omitted, an ephemeral key will be created")
 	run.PersistentFlags().IntVar(&opts.SSHPort, "ssh-port", 22, "SSH port")
 	run.PersistentFlags().StringVar(&opts.User, "user", "ec2-user", "SSH user to connect to your instance with")
-	run.PersistentFlags().StringVarP(&opts.IdentityFile, "identify-file", "i", "", "If using ssh-key, pass in the identitiy file")
+	run.PersistentFlags().StringVar(&opts.SSMLogGroup, "ssm-log-group", "", "CloudWatch Logs group to stream the output of commands run via ssm through. Without it SSM cuts output off after 24,000 characters. The instance profile must allow writing to the group")
+	run.PersistentFlags().StringVar(&opts.ConnectVia, "connect-via", ec2.ConnectViaPrivateIP, "How to reach the instance. One of private-ip, public-ip (associates a public IP address) or ssm (SSM Run Command, requires an instance profile allowing Systems Manager)")
+	run.PersistentFlags().StringArrayVar(&opts.JumpHosts, "jump-host", nil, "Tunnel SSH connections through this bastion. Repeat for a chain of jump hosts. Syntax: 'user@host[:port]'")
+	run.PersistentFlags().StringVar(&opts.JumpIdentityFile, "jump-identity-file", "", "Identity file for jump hosts. Defaults to the identity used for the instance")
+	run.PersistentFlags().BoolVar(&opts.StrictHostKeyChecking, "strict-host-key-checking", false, "Refuse to connect unless the instance's host key matches a fingerprint in its console output, and verify jump hosts against ~/.ssh/known_hosts. Otherwise the first host key seen is trusted when no fingerprints are found")
+	run.PersistentFlags().StringVarP(&opts.IdentityFile, "identify-file", "i", "", "If using ssh-key, pass in the identitiy file. Optional when the key is in the SSH agent. Set EC2_RUNNER_SSH_PASSPHRASE for passphrase protected keys")
 
 	run.PersistentFlags().StringArrayVar(&opts.Tags, "tag", nil, "Key=Value pair")
 	run.PersistentFlags().StringArrayVar(&opts.SecurityGroupFilters, "security-group-filter", nil, "Filters for your Security Groups. Syntax: Name=string,Values=string,string ...")
@@ -44,22 +57,39 @@ func init() {
 
 	run.PersistentFlags().StringArrayVar(&opts.InstanceTypes, "instance-type", []string{"t2.micro", "t2.small"}, "Ec2 instance type. Specify multiple instance types for a spot fleet.")
 
-	// run.PersistentFlags().Float64Var(&opts.BidPrice, "bid-price", 0, "")
+	run.PersistentFlags().Float64Var(&opts.BidPrice, "bid-price", 0, "Most to pay an hour for a spot instance, in US dollars. Defaults to the on-demand price")
+	run.PersistentFlags().StringArrayVar(&opts.BidPrices, "instance-bid-price", nil, "Bid price for one instance type, overriding --bid-price. Syntax: InstanceType=Price")
 
 	run.PersistentFlags().StringArrayVar(&opts.EnvVars, "environment", nil, "Environment variables exported after user-data and before entry-point or command. Syntax: 'Key=Value'")
 
 	run.PersistentFlags().StringVar(&opts.UserDataFile, "user-data", "", "path to user-data script")
 	run.PersistentFlags().StringVar(&opts.EntrypointFile, "entrypoint", "", "path to entrypoint script")
+	run.PersistentFlags().StringArrayVar(&opts.Downloads, "download", nil, "Copy files matching a remote path or glob into a local directory after the command finishes, whatever its exit code. Syntax: 'remote:local'")
+	run.PersistentFlags().StringArrayVar(&opts.EFS, "efs", nil, "Mount an EFS file system, by name or ID, before the entrypoint runs. Its mount target's security groups must allow NFS from the instance. Syntax: 'name-or-id:/mount/path'")
+	run.PersistentFlags().StringArrayVar(&opts.Uploads, "upload", nil, "Copy a local file or directory to the instance before running the command. Directories are copied recursively. Syntax: 'local:remote'")
 
 	run.PersistentFlags().BoolVar(&opts.WaitOnCloudInit, "no-wait-cloud-init", true, "Do not wait for user-data to complete before invoking entrypoint and command")
+	run.PersistentFlags().DurationVar(&opts.Timeout, "timeout", 0, "Kill the command and terminate the instance once the command has run this long, e.g. 90m. The instance also shuts itself down 10 minutes after the timeout in case this process dies. Zero means no timeout")
 	run.PersistentFlags().BoolVar(&opts.NoTermination, "no-terminate", false, "Do not terminate the instance upon completion.")
-	// run.PersistentFlags().BoolVarP(&opts.Attach, "attach", "a", false, "")
+	run.PersistentFlags().BoolVar(&opts.NoColor, "no-color", false, "Do not colorize instance output prefixes when running more than one instance")
+	run.PersistentFlags().BoolVarP(&opts.Attach, "attach", "a", false, "Attach the local terminal to the command. Without a command an interactive shell is opened and the instance terminates on logout")
+	run.PersistentFlags().Float64Var(&opts.MaxCost, "max-cost", 0, "Terminate the instances once the run's projected spend exceeds this many US dollars. Zero means no limit")
+	run.PersistentFlags().BoolVarP(&opts.Detach, "detach", "d", false, "Start the command in the background and exit, leaving the instance running. Use 'ec2 logs', 'ec2 attach', 'ec2 wait' or 'ec2 stop' with the run ID to reconnect")
+
+	run.PersistentFlags().StringVar(&exitPolicy, "exit-policy", ec2.ExitPolicyFirst, "How to derive the exit code from every instance. One of first, any-fail, all-fail or max")
+
+	run.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", "Format of lifecycle events. One of text or json. JSON events are written one per line to stderr, keeping stdout for the command's output. Log messages and the command's stderr are written as log and stderr events there too, unless --log-file is set")
+	run.PersistentFlags().StringVar(&eventsFile, "events-file", "", "Append JSON lifecycle events to this file instead of stderr. Implies --output json")
 
-	run.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Show details about the instance it would start, but don't actually start it")
+	run.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Resolve and print what would be launched and check permissions with EC2 dry runs, without creating anything")
 
 	run.PersistentFlags().Int64Var(&opts.CreateFleetRetries, "max-fleet-retries", 10, "Number of attempts to retry a fleet request.")
 	run.PersistentFlags().StringVar(&opts.LaunchTemplateName, "launch-template-name", "ec2-cli", "Launch template name will be prefixed to a random string.")
 
+	run.PersistentFlags().StringVar(&opts.CapacityStrategy, "capacity-strategy", ec2.CapacityStrategySpotOnly, "Market to launch instances in. One of spot-only, spot-then-on-demand or on-demand-only")
+	run.PersistentFlags().IntVar(&opts.MaxInterruptionRetries, "max-interruption-retries", 0, "Number of times to launch a new instance and run the command again when AWS reclaims a spot instance while it runs the command.")
+	run.PersistentFlags().Int64Var(&opts.MaxSpotRetries, "max-spot-retries", 3, "Number of failed spot fleet requests before switching to on-demand when using the spot-then-on-demand capacity strategy.")
+
 	run.PersistentFlags().Int64Var(&opts.BlockDurationInMinutes, "block-duration-minutes", 0, "The required duration for the Spot Instances (also known as Spot blocks), in minutes. This value must be a multiple of 60 (60, 120, 180, 240, 300, or 360). If set to zero this will launch a spot instance without a block duration.")
 }
 
@@ -69,22 +99,137 @@ var run = &cobra.Command{
 	Short: "Run adhoc workloads using EC2 and destroy them upon completion",
 	Run: func(cmd *cobra.Command, args []string) {
 
+		// Options come from the profile, then the job definition, then flags
+		if profile != "" {
+			config, err := loadConfig()
+			if err != nil {
+				log.Fatal(err)
+			}
+			options, err := config.Profile(profile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			options.Apply(&opts, cmd.Flags().Changed)
+		}
+
+		if jobFile != "" {
+			job, err := ec2.LoadJob(jobFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			job.Options.Apply(&opts, cmd.Flags().Changed)
+		}
+
 		if len(args) > 0 {
 			opts.Command = strings.Join(args, " ")
 		}
 
+		if err := ec2.ValidateExitPolicy(exitPolicy); err != nil {
+			log.Fatal(err)
+		}
+
+		if outputFormat != "text" && outputFormat != "json" {
+			log.Fatalf("unknown output format %s", outputFormat)
+		}
+
+		client, err := ec2.NewClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Client = client
+		opts.DryRun = dryRun
+
+		// Lifecycle events are written apart from the command's output for other tools to read
+		switch {
+		case eventsFile != "":
+			f, err := os.OpenFile(eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatalf("Unable to open events file: %s", err)
+			}
+			defer f.Close()
+			opts.Events = ec2.NewEvents(f)
+		case outputFormat == "json":
+			// Everything else written to stderr is encoded as events too, keeping it parseable
+			opts.Events = ec2.NewEvents(os.Stderr)
+			opts.StderrEvents = true
+			if logFile == "" {
+				ec2.Log.Events = opts.Events
+				log.SetFlags(0)
+				log.SetOutput(ec2.Log.Writer(ec2.LevelError))
+			}
+		}
+
+		// Every resource is registered as it's created and removed however the run ends
+		cleanup := ec2.NewCleanup()
+		opts.Cleanup = cleanup
+
+		// Stopping the run keeps workers from creating anything more. They return once the
+		// cleanup has terminated their instances
+		stop := make(chan struct{})
+		opts.Stop = stop
+		var stopSignal os.Signal
+		exitIfStopped := func(err error) {
+			select {
+			case <-stop:
+				if err != nil {
+					ec2.Log.Errorf("%s", err)
+				}
+				os.Exit(128 + int(stopSignal.(syscall.Signal)))
+			default:
+			}
+		}
+
+		// catch ctrl+c, CI cancellations and closed terminals. A second signal exits right away
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			stopSignal = <-c
+			ec2.Log.Warnf("got %s, cleaning up", stopSignal)
+			close(stop)
+			if err := cleanup.Run(); err != nil {
+				ec2.Log.Errorf("%s", err)
+			}
+
+			sig := <-c
+			ec2.Log.Errorf("got %s, exiting without waiting for instances", sig)
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		}()
+
 		instances, err := opts.Instances()
 		if err != nil {
+			if err := cleanup.Run(); err != nil {
+				ec2.Log.Errorf("%s", err)
+			}
+			exitIfStopped(nil)
 			log.Fatal(err)
 		}
 
+		// Nothing was created so the plan is all a dry run has to show
 		if dryRun {
+			exitCode := 0
 			for _, instance := range instances {
-				fmt.Println(instance)
-				instance.DestroyKeyPair()
-				instance.DeleteLaunchTemplate()
-				os.Exit(0)
+				plan, err := instance.Plan()
+				if err != nil {
+					log.Fatal(err)
+				}
+				plan.Write(os.Stdout)
+				if !plan.Allowed() {
+					ec2.Log.Errorf("Missing permissions to launch instances")
+					exitCode = 1
+				}
+				if !plan.Launchable() {
+					ec2.Log.Errorf("%s", plan.BidPriceErr)
+					exitCode = 1
+				}
 			}
+			os.Exit(exitCode)
+		}
+
+		// the budget is only enforced while the run waits for its instances
+		stopBudget := make(chan struct{})
+		var budgetDone <-chan struct{}
+		if opts.MaxCost > 0 {
+			budgetDone = ec2.WatchBudget(opts.MaxCost, instances, stopBudget)
 		}
 
 		var wg sync.WaitGroup
@@ -93,71 +238,119 @@ var run = &cobra.Command{
 			wg.Add(1)
 			go func(instance *ec2.Instance) {
 				defer wg.Done()
-				err = instance.Start()
-				if err != nil {
-					fmt.Println(err)
-					err = instance.Terminate()
+				// only the worker touches its instance, so it's never terminated mid-relaunch
+				defer func() {
+					if err := instance.TerminateIfOverBudget(); err != nil {
+						ec2.Log.Errorf("%s", err)
+					}
+				}()
+				// whatever was launched is removed by the cleanup
+				err := instance.Start()
+				for {
 					if err != nil {
-						fmt.Println(err)
+						ec2.Log.Errorf("%s", err)
+						return
 					}
-					instance.DestroyKeyPair()
-					instance.DeleteLaunchTemplate()
-					return
-				}
 
-				fmt.Printf(
-					"Instance %s starting with IP %s\n  AMI: %s\n  Spot Price: %s\n  Size: %s\n",
-					*instance.InstanceID,
-					*instance.PrivateIPAddress,
-					*instance.AMIID,
-					*instance.SpotPrice,
-					*instance.SelectedInstanceType,
-				)
-				instance.DestroyKeyPair()
-				err = instance.WaitForSSH()
-				if err != nil {
-					fmt.Printf("error waiting for ssh: %s", err)
-				}
+					ec2.Log.Infof(
+						"Instance %s starting with IP %s\n  AMI: %s\n  Lifecycle: %s\n  Max Price: %s\n  Size: %s",
+						*instance.InstanceID,
+						*instance.PrivateIPAddress,
+						*instance.AMIID,
+						aws.StringValue(instance.Lifecycle),
+						aws.StringValue(instance.SpotPrice),
+						*instance.SelectedInstanceType,
+					)
+					// the key pair is only needed to launch the instance, unless it's relaunched
+					if opts.SSHKey == "" && opts.MaxInterruptionRetries == 0 {
+						if err := instance.DestroyKeyPair(); err != nil {
+							ec2.Log.Errorf("%s", err)
+						}
+					}
+					err = instance.WaitForConnection()
+					if err != nil {
+						ec2.Log.Errorf("error waiting for connection: %s", err)
+					}
 
-				err = instance.InvokeCommand()
-				if err != nil {
-					fmt.Printf("error invoking command: %s", err)
-				}
-			}(instance)
-		}
+					err = instance.InvokeCommand()
+					if err != nil {
+						ec2.Log.Errorf("error invoking command: %s", err)
+					}
 
-		// catch ctrl+c
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			for range c {
-				fmt.Println("got exception")
-				for _, instance := range instances {
-					if !*instance.NoTermination {
-						instance.Terminate()
-						if opts.IdentityFile == "" {
-							instance.DestroyKeyPair()
+					if instance.Detached {
+						// nothing could reconnect to a run without its state
+						if err := saveDetachedRun(instance); err != nil {
+							ec2.Log.Errorf("%s", err)
+							instance.Detached = false
 						}
+						return
 					}
-					instance.DeleteLaunchTemplate()
+
+					if !instance.Interrupted || instance.Interruptions >= opts.MaxInterruptionRetries {
+						return
+					}
+					ec2.Log.Warnf("Relaunching after spot interruption (retry %d of %d)", instance.Interruptions+1, opts.MaxInterruptionRetries)
+					err = instance.Relaunch()
 				}
-				os.Exit(130)
-			}
-		}()
+			}(instance)
+		}
 
 		wg.Wait()
+		close(stopBudget)
+		if budgetDone != nil {
+			<-budgetDone
+		}
 
-		for _, instance := range instances {
-			if !*instance.NoTermination {
-				instance.Terminate()
-				if opts.IdentityFile == "" {
-					instance.DestroyKeyPair()
-				}
+		// instances kept with --no-terminate are left running unless they timed out
+		cleanupErr := cleanup.Run()
+		exitIfStopped(cleanupErr)
+
+		if instances[0].Detached {
+			if cleanupErr != nil {
+				log.Fatal(cleanupErr)
 			}
-			instance.DeleteLaunchTemplate()
+			os.Exit(0)
+		}
+
+		summary := ec2.Log.Writer(ec2.LevelInfo)
+		fmt.Fprintln(summary)
+		ec2.Summary(summary, instances)
+
+		exitCode, err := ec2.ExitCode(exitPolicy, instances)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		os.Exit(*instances[0].ExitCode)
+		if cleanupErr != nil {
+			ec2.Log.Errorf("%s", cleanupErr)
+			if exitCode == 0 {
+				exitCode = 1
+			}
+		}
+		os.Exit(exitCode)
 
 	},
 }
+
+// saveDetachedRun records the state of a detached run so it can be reattached later
+func saveDetachedRun(instance *ec2.Instance) error {
+	dir, err := ec2.DefaultStateDir()
+	if err != nil {
+		return err
+	}
+
+	state, err := instance.RunState()
+	if err != nil {
+		return err
+	}
+
+	if err := state.Save(dir); err != nil {
+		return err
+	}
+
+	ec2.Log.Infof("Run %s is running in the background. Reconnect with:\n  ec2 logs -f %s\n  ec2 wait %s\n  ec2 stop %s", state.RunID, state.RunID, state.RunID, state.RunID)
+
+	// the run ID is the only output, for scripts to reconnect with
+	fmt.Println(state.RunID)
+	return nil
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	ec2 "github.com/justmiles/ec2-runner/lib"
+	"github.com/spf13/cobra"
+)
+
+var validateFile string
+
+func init() {
+	rootCmd.AddCommand(validate)
+
+	validate.Flags().StringVarP(&validateFile, "file", "f", "", "Job definition file (YAML or JSON) to validate")
+	validate.MarkFlagRequired("file")
+}
+
+// process the validate command
+var validate = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a job definition file for schema errors",
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := ec2.LoadJob(validateFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s is valid\n", validateFile)
+	},
+}
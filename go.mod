@@ -17,4 +17,5 @@ require (
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/cobra v0.0.3
 	golang.org/x/crypto v0.0.0-20200422194213-44a606286825
+	gopkg.in/yaml.v3 v3.0.1
 )
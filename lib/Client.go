@@ -0,0 +1,55 @@
+package ec2
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// Client holds the AWS APIs used to launch and manage instances
+type Client struct {
+	EC2 ec2iface.EC2API
+	EFS efsiface.EFSAPI
+	SSM ssmiface.SSMAPI
+	// Logs holds the output of commands run through SSM with a log group
+	Logs cloudwatchlogsiface.CloudWatchLogsAPI
+	// Prices are the on-demand prices in the client's region
+	Prices *Prices
+}
+
+// pricingRegion is where the Price List API is served from
+const pricingRegion = "us-east-1"
+
+// NewClient returns a Client using the shared AWS config and credentials
+func NewClient() (*Client, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create AWS session: %s", err)
+	}
+
+	// prices are still looked up, just not cached, without a cache file
+	cacheFile, err := DefaultPriceCacheFile()
+	if err != nil {
+		Log.Debugf("%s", err)
+	}
+
+	return &Client{
+		EC2:    ec2.New(sess),
+		EFS:    efs.New(sess),
+		SSM:    ssm.New(sess),
+		Logs:   cloudwatchlogs.New(sess),
+		Prices: NewPrices(pricing.New(sess, aws.NewConfig().WithRegion(pricingRegion)), aws.StringValue(sess.Config.Region), cacheFile),
+	}, nil
+}
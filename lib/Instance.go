@@ -5,10 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	// "io/ioutil"
@@ -18,52 +18,122 @@ import (
 	// "time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/efs"
-	"github.com/bramvdbogaerde/go-scp"
 	"github.com/cenkalti/backoff"
 	"github.com/dustin/go-humanize"
 	"golang.org/x/crypto/ssh"
 )
 
-var (
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	ec2Svc = ec2.New(sess)
-	efsSvc = efs.New(sess)
+// fleetBackOff returns the backoff used between fleet requests
+var fleetBackOff = func() backoff.BackOff {
+	return backoff.NewExponentialBackOff()
+}
+
+// Capacity strategies control which market instances are launched in
+const (
+	// CapacityStrategySpotOnly only ever requests spot capacity
+	CapacityStrategySpotOnly = "spot-only"
+	// CapacityStrategySpotThenOnDemand falls back to on-demand capacity when spot capacity
+	// can not be filled
+	CapacityStrategySpotThenOnDemand = "spot-then-on-demand"
+	// CapacityStrategyOnDemandOnly only ever requests on-demand capacity
+	CapacityStrategyOnDemandOnly = "on-demand-only"
+)
+
+// Connection modes determine how the instance is reached to run the command
+const (
+	// ConnectViaPrivateIP connects over SSH to the instance's private IP address
+	ConnectViaPrivateIP = "private-ip"
+	// ConnectViaPublicIP associates a public IP address and connects over SSH to it
+	ConnectViaPublicIP = "public-ip"
+	// ConnectViaSSM runs the command through SSM Run Command without SSH
+	ConnectViaSSM = "ssm"
 )
 
 // Instance represents a runnable instance
 type Instance struct {
+	Client                 *Client
 	AMIID                  *string
 	SubnetID               *string
 	SecurityGroupIDs       []*string
 	IamInstanceProfile     *string
 	sshConfig              *ssh.ClientConfig
+	hostKeys               *hostKeyVerifier
 	SSHPort                *int
+	User                   *string
+	ConnectVia             *string
+	SSMLogGroup            *string
+	JumpHosts              []JumpHost
+	jumpAuth               []ssh.AuthMethod
+	jumpHostKeyCallback    ssh.HostKeyCallback
 	KeyName                *string
 	Tags                   *map[string]string
 	InstanceTypes          *[]string
 	BidPrice               *float64
+	BidPrices              map[string]float64
 	SpotPrice              *string
+	Lifecycle              *string
 	UserData               *string
 	EntrypointFile         *string
 	WaitOnCloudInit        *bool
 	Attach                 *bool
 	NoTermination          *bool
 	TTYColor               *string
+	NoColor                *bool
+	Index                  int
+	Count                  int
 	Reservation            *ec2.Reservation
 	PrivateIPAddress       *string
+	PublicIPAddress        *string
 	InstanceID             *string
 	SelectedInstanceType   *string
+	LaunchTime             *time.Time
+	TerminationTime        *time.Time
 	ExitCode               *int
 	Command                *string
 	EnvVars                *map[string]string
 	CreateFleetRetries     *int64
 	LaunchTemplateName     *string
 	BlockDurationInMinutes *int64
+	Uploads                []FileTransfer
+	Downloads              []FileTransfer
+	EFSMounts              []EFSMount
+	CapacityStrategy       *string
+	MaxSpotRetries         *int64
+	Timeout                *time.Duration
+	TimedOut               bool
+	RunID                  *string
+	Expires                *time.Time
+	Cleanup                *Cleanup
+	MaxInterruptionRetries *int
+	Interrupted            bool
+	Interruptions          int
+	launchTemplateCreated  bool
+	Detach                 *bool
+	Detached               bool
+	privateKey             []byte
+	identityFile           string
+	jumpIdentityFile       string
+	Events                 *Events
+	// OverBudget is set when the instance was terminated for exceeding the run's maximum cost
+	OverBudget bool
+	// hourlyPrice is the price the instance costs an hour, once known
+	hourlyPrice *float64
+	// previousCost is the cost of the instances replaced after spot interruptions
+	previousCost float64
+	// stop is closed to stop the run
+	stop <-chan struct{}
+	// stderrEvents writes the command's stderr as events
+	stderrEvents bool
+	// overBudget is closed once the run exceeds its maximum cost
+	overBudget     chan struct{}
+	overBudgetOnce sync.Once
+	// bidPriceErr is set when the spot price of every instance type exceeded its bid before
+	// the run started
+	bidPriceErr *BidPriceError
+	// mu guards what the budget watcher reads while the instance is launched: its type,
+	// lifecycle, prices and launch and termination times
+	mu sync.Mutex
 }
 
 // Start the command
@@ -74,11 +144,198 @@ func (instance *Instance) Start() error {
 		return fmt.Errorf("error starting instance: %s", err)
 	}
 
+	instance.emit(Event{
+		Type:             EventInstanceRunning,
+		InstanceType:     stringPointerValueOrNil(instance.SelectedInstanceType, ""),
+		Lifecycle:        stringPointerValueOrNil(instance.Lifecycle, ""),
+		SpotPrice:        stringPointerValueOrNil(instance.SpotPrice, ""),
+		PrivateIPAddress: stringPointerValueOrNil(instance.PrivateIPAddress, ""),
+		PublicIPAddress:  stringPointerValueOrNil(instance.PublicIPAddress, ""),
+	})
+
 	return nil
 }
 
 // StartInstance launches a new EC2 instance
 func (instance *Instance) StartInstance() (err error) {
+	capacityType := instance.initialCapacityType()
+
+	// Tell EC2 to create the template. Relaunched instances reuse it
+	if !instance.launchTemplateCreated {
+		if err := instance.stopped(); err != nil {
+			return err
+		}
+		_, err = instance.Client.EC2.CreateLaunchTemplate(instance.createLaunchTemplateInput(capacityType))
+		if err != nil {
+			return fmt.Errorf("Error creating launch template for instance: %s", err)
+		}
+		instance.launchTemplateCreated = true
+		instance.Cleanup.Register(launchTemplateResource(*instance.LaunchTemplateName), instance.deleteLaunchTemplate)
+	}
+
+	createFleetInput := instance.createFleetInput(capacityType, "1")
+
+	// Send the fleet creation request with backoff
+	var retryCount int64
+	var createOutput *ec2.CreateFleetOutput
+	backoffWithRetries := backoff.WithMaxRetries(fleetBackOff(), uint64(*instance.CreateFleetRetries))
+
+	operation := func() error {
+		// switch to on-demand after n failed spot attempts
+		if capacityType == "spot" && *instance.CapacityStrategy == CapacityStrategySpotThenOnDemand && retryCount >= *instance.MaxSpotRetries {
+			Log.Warnf("Unable to fill spot capacity after %d attempts. Switching to on-demand", retryCount)
+			version, err := instance.createOnDemandLaunchTemplateVersion()
+			if err != nil {
+				return backoff.Permanent(err)
+			}
+			capacityType = "on-demand"
+			createFleetInput = instance.createFleetInput(capacityType, version)
+		}
+
+		if err := instance.stopped(); err != nil {
+			return backoff.Permanent(err)
+		}
+		instance.emit(Event{Type: EventFleetRequested, CapacityType: capacityType, Attempt: int(retryCount) + 1})
+		createOutput, err = instance.Client.EC2.CreateFleet(createFleetInput)
+		if err == nil && len(createOutput.Instances) > 0 {
+			// Instant fleets leave no request behind, only the instances they launched
+			instance.InstanceID = createOutput.Instances[0].InstanceIds[0]
+			instance.Cleanup.Register(instanceResource(*instance.InstanceID), instance.cleanupInstance)
+			return nil
+		}
+
+		if err == nil && len(createOutput.Errors) > 0 {
+			err = fmt.Errorf("%s", *createOutput.Errors[0].ErrorMessage)
+		}
+
+		if err == nil {
+			err = errors.New("no instances were launched")
+		}
+
+		retryCount++
+		return err
+	}
+
+	// report the scheduled retry
+	notify := func(err error, next time.Duration) {
+		Log.Warnf("error creating %s fleet (attempt %d of %d). Will retry %s: %s", capacityType, retryCount, *instance.CreateFleetRetries, humanize.Time(time.Now().Add(next)), err)
+	}
+
+	backoffErr := backoff.RetryNotify(operation, backoffWithRetries, notify)
+	if backoffErr != nil {
+		if createOutput != nil && createOutput.FleetId != nil {
+			return fmt.Errorf("Error waiting for fleet request (%s): %s", *createOutput.FleetId, backoffErr)
+		}
+		return fmt.Errorf("Error waiting for fleet request: %s", backoffErr)
+	}
+	instanceInput := ec2.DescribeInstancesInput{
+		InstanceIds: createOutput.Instances[0].InstanceIds,
+	}
+	instance.mu.Lock()
+	instance.Lifecycle = createOutput.Instances[0].Lifecycle
+	instance.mu.Unlock()
+	Log.Infof("Launching %s %s instance: %s", *createOutput.Instances[0].InstanceType, *createOutput.Instances[0].Lifecycle, *createOutput.Instances[0].InstanceIds[0])
+	err = instance.Client.EC2.WaitUntilInstanceRunning(&instanceInput)
+	if err != nil {
+		return fmt.Errorf("error waiting for instance to start running")
+	}
+
+	describeInstancesOutput, err := instance.Client.EC2.DescribeInstances(&instanceInput)
+	if err != nil {
+		return fmt.Errorf("error describing instance")
+	}
+
+	instance.Reservation = describeInstancesOutput.Reservations[0]
+
+	instance.mu.Lock()
+	for _, ri := range instance.Reservation.Instances {
+		instance.PrivateIPAddress = ri.PrivateIpAddress
+		instance.PublicIPAddress = ri.PublicIpAddress
+		instance.InstanceID = ri.InstanceId
+		instance.SelectedInstanceType = ri.InstanceType
+		instance.LaunchTime = ri.LaunchTime
+	}
+	instance.mu.Unlock()
+
+	if instance.PrivateIPAddress == nil {
+		return errors.New("looks like it didn't get created")
+	}
+
+	if *instance.ConnectVia == ConnectViaPublicIP && instance.PublicIPAddress == nil {
+		return fmt.Errorf("instance %s was not assigned a public IP address", *instance.InstanceID)
+	}
+
+	// on-demand instances have no spot request to describe
+	if capacityType != "spot" {
+		instance.resolveOnDemandPrice()
+		return nil
+	}
+
+	descSpot, err := instance.Client.EC2.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("instance-id"),
+				Values: []*string{instance.InstanceID},
+			}},
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe spot instance request: %s", err)
+	}
+
+	// The request only has the most the instance may cost. It's charged the market price
+	marketPrice, err := instance.marketPrice()
+	if err != nil {
+		Log.Debugf("Unable to look up the spot price of %s, estimating its cost at the max price: %s", *instance.InstanceID, err)
+	}
+
+	instance.mu.Lock()
+	for _, sp := range descSpot.SpotInstanceRequests {
+		if sp.ActualBlockHourlyPrice != nil {
+			instance.SpotPrice = sp.ActualBlockHourlyPrice
+		} else {
+			instance.SpotPrice = sp.SpotPrice
+			instance.hourlyPrice = marketPrice
+		}
+	}
+	instance.mu.Unlock()
+
+	// without a spot request the instance is estimated at the on-demand price
+	instance.resolveOnDemandPrice()
+
+	return nil
+}
+
+// initialCapacityType is the market the first fleet request launches in
+func (instance *Instance) initialCapacityType() string {
+	if *instance.CapacityStrategy == CapacityStrategyOnDemandOnly {
+		return "on-demand"
+	}
+	// spot capacity priced above every bid is not waited on
+	if instance.bidPriceErr != nil && *instance.CapacityStrategy == CapacityStrategySpotThenOnDemand {
+		return "on-demand"
+	}
+	return "spot"
+}
+
+// createLaunchTemplateInput returns the request creating the launch template for the given
+// capacity type
+func (instance *Instance) createLaunchTemplateInput(capacityType string) *ec2.CreateLaunchTemplateInput {
+	launchTemplate := &ec2.CreateLaunchTemplateInput{
+		LaunchTemplateData: instance.launchTemplateData(capacityType),
+		LaunchTemplateName: instance.LaunchTemplateName,
+		VersionDescription: aws.String("template generated by pentaho-cli for launching instances"),
+	}
+	if tags := instance.runTags(true); len(tags) > 0 {
+		launchTemplate.TagSpecifications = []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeLaunchTemplate), Tags: tags},
+		}
+	}
+	return launchTemplate
+}
+
+// launchTemplateData builds the launch template for the given capacity type. Spot market
+// options are only included for spot capacity.
+func (instance *Instance) launchTemplateData(capacityType string) *ec2.RequestLaunchTemplateData {
 	launchTemplateData := ec2.RequestLaunchTemplateData{
 		ImageId:  instance.AMIID,
 		KeyName:  instance.KeyName,
@@ -87,34 +344,43 @@ func (instance *Instance) StartInstance() (err error) {
 		NetworkInterfaces: []*ec2.LaunchTemplateInstanceNetworkInterfaceSpecificationRequest{
 			&ec2.LaunchTemplateInstanceNetworkInterfaceSpecificationRequest{
 				DeviceIndex:              aws.Int64(0),
-				AssociatePublicIpAddress: aws.Bool(false),
+				AssociatePublicIpAddress: aws.Bool(*instance.ConnectVia == ConnectViaPublicIP),
 				SubnetId:                 instance.SubnetID,
 				Groups:                   instance.SecurityGroupIDs,
 			},
 		},
 
 		InstanceInitiatedShutdownBehavior: aws.String("terminate"),
-		InstanceMarketOptions: &ec2.LaunchTemplateInstanceMarketOptionsRequest{
+	}
+
+	if capacityType == "spot" {
+		launchTemplateData.InstanceMarketOptions = &ec2.LaunchTemplateInstanceMarketOptionsRequest{
 			MarketType: aws.String("spot"),
 			SpotOptions: &ec2.LaunchTemplateSpotMarketOptionsRequest{
 				InstanceInterruptionBehavior: aws.String("terminate"),
 			},
-		},
-	}
+		}
 
-	if *instance.BlockDurationInMinutes > 0 {
-		launchTemplateData.InstanceMarketOptions.SpotOptions.BlockDurationMinutes = instance.BlockDurationInMinutes
-	}
+		if *instance.BlockDurationInMinutes > 0 {
+			launchTemplateData.InstanceMarketOptions.SpotOptions.BlockDurationMinutes = instance.BlockDurationInMinutes
+		}
 
-	if len(*instance.Tags) > 0 {
-		var ec2Tags []*ec2.Tag
-		for key, value := range *instance.Tags {
-			ec2Tags = append(ec2Tags, &ec2.Tag{
-				Key:   aws.String(key),
-				Value: aws.String(value),
-			})
+		if instance.BidPrice != nil && *instance.BidPrice > 0 {
+			launchTemplateData.InstanceMarketOptions.SpotOptions.MaxPrice = formatBidPrice(*instance.BidPrice)
 		}
+	}
+
+	// Instances kept after the command finishes, or running a detached command for as long as
+	// it takes, must not be reaped
+	ec2Tags := append(instance.runTags(!*instance.NoTermination && !*instance.Detach), instance.ownerTags()...)
+	for key, value := range *instance.Tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
 
+	if len(ec2Tags) > 0 {
 		launchTemplateData.TagSpecifications = []*ec2.LaunchTemplateTagSpecificationRequest{
 			&ec2.LaunchTemplateTagSpecificationRequest{
 				ResourceType: aws.String("instance"),
@@ -131,28 +397,61 @@ func (instance *Instance) StartInstance() (err error) {
 		launchTemplateData.IamInstanceProfile = &ec2.LaunchTemplateIamInstanceProfileSpecificationRequest{Name: instance.IamInstanceProfile}
 	}
 
-	launchTemplate := &ec2.CreateLaunchTemplateInput{
-		LaunchTemplateData: &launchTemplateData,
+	return &launchTemplateData
+}
+
+// runTags returns the tags identifying the run, with its expiry when the resource expires
+func (instance *Instance) runTags(expires bool) []*ec2.Tag {
+	if instance.RunID == nil {
+		return nil
+	}
+	if !expires {
+		return runTags(*instance.RunID, nil)
+	}
+	return runTags(*instance.RunID, instance.Expires)
+}
+
+// createOnDemandLaunchTemplateVersion adds a version of the launch template without spot
+// market options and returns its version number
+func (instance *Instance) createOnDemandLaunchTemplateVersion() (string, error) {
+	if err := instance.stopped(); err != nil {
+		return "", err
+	}
+	result, err := instance.Client.EC2.CreateLaunchTemplateVersion(&ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateData: instance.launchTemplateData("on-demand"),
 		LaunchTemplateName: instance.LaunchTemplateName,
-		VersionDescription: aws.String("template generated by pentaho-cli for launching instances"),
+		VersionDescription: aws.String("on-demand template generated by pentaho-cli for launching instances"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error creating on-demand launch template version: %s", err)
 	}
 
+	return fmt.Sprintf("%d", *result.LaunchTemplateVersion.VersionNumber), nil
+}
+
+// createFleetInput builds an instant fleet request for a single instance of the given
+// capacity type using the given launch template version
+func (instance *Instance) createFleetInput(capacityType, version string) *ec2.CreateFleetInput {
+
 	// Add overrides for each instance type
 	var overrides []*ec2.FleetLaunchTemplateOverridesRequest
 	for _, instanceType := range *instance.InstanceTypes {
 		override := ec2.FleetLaunchTemplateOverridesRequest{
 			InstanceType: aws.String(instanceType),
 		}
+		// Overrides take precedence over the launch template's max price
+		if bid := instance.bidPrice(instanceType); capacityType == "spot" && bid > 0 {
+			override.MaxPrice = formatBidPrice(bid)
+		}
 		overrides = append(overrides, &override)
 	}
 
-	// Create the fleet
-	createFleetInput := &ec2.CreateFleetInput{
+	return &ec2.CreateFleetInput{
 		LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest{
 			{
 				LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
 					LaunchTemplateName: instance.LaunchTemplateName,
-					Version:            aws.String("1"),
+					Version:            aws.String(version),
 				},
 				Overrides: overrides,
 			},
@@ -160,165 +459,225 @@ func (instance *Instance) StartInstance() (err error) {
 		ReplaceUnhealthyInstances: aws.Bool(false),
 		TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest{
 			TotalTargetCapacity:       aws.Int64(1),
-			DefaultTargetCapacityType: aws.String("spot"),
+			DefaultTargetCapacityType: aws.String(capacityType),
 		},
 		Type: aws.String("instant"),
 	}
+}
 
-	// Tell EC2 to create the template
-	_, err = ec2Svc.CreateLaunchTemplate(launchTemplate)
-	if err != nil {
-		return fmt.Errorf("Error creating launch template for instance: %s", err)
-	}
-
-	// Create the request for the instance.
-	req, createOutput := ec2Svc.CreateFleetRequest(createFleetInput)
-
-	// Send the fleet creation request with backoff
-	var retryCount int
-	backoffWithRetries := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), uint64(*instance.CreateFleetRetries))
-
-	// var createOutput *ec2.CreateFleetOutput
-	operation := func() error {
-		err := req.Send()
-		if err == nil && createOutput.Instances != nil {
-			return err
-		}
-
-		if err == nil && len(createOutput.Errors) > 0 {
-			err = fmt.Errorf("%s", *createOutput.Errors[0].ErrorMessage)
-		}
-		// schedule next retry if errornous
-		if err != nil {
-			t := time.Now()
-			t = t.Add(backoffWithRetries.NextBackOff())
-			fmt.Printf("error creating fleet (attempt %d of %d). Will retry %s: %s\n", retryCount, *instance.CreateFleetRetries, humanize.Time(t), err)
-		}
-
-		// TODO: Alter launch request to create a OnDemand Instance instead.
-		// TODO: Launch on-demand if unable to fill capacity requirements - The below logic doesn't work because at least 1 spot instance request is required in a spot fleet request
-		// // switch to on-demand after n attempts
-		// if retryCount > *instance.MaxSpotRetries {
-		// 	fmt.Println("switching to on-demand")
-		// 	createFleetInput.TargetCapacitySpecification.DefaultTargetCapacityType = aws.String("on-demand")
-		// }
-
-		retryCount++
+// WaitForConnection waits until the instance can be reached using its connection mode. SSH
+// connections wait for the host keys to verify the instance with too.
+func (instance *Instance) WaitForConnection() error {
+	if err := instance.stopped(); err != nil {
 		return err
 	}
-
-	backoffErr := backoff.Retry(operation, backoffWithRetries)
-	if backoffErr != nil {
-		if createOutput.FleetId != nil {
-			return fmt.Errorf("Error waiting for fleet request (%s): %s", *createOutput.FleetId, backoffErr)
+	if *instance.ConnectVia == ConnectViaSSM {
+		if err := instance.WaitForSSM(); err != nil {
+			return err
 		}
-		return fmt.Errorf("Error waiting for fleet request: %s", backoffErr)
-	}
-	instanceInput := ec2.DescribeInstancesInput{
-		InstanceIds: createOutput.Instances[0].InstanceIds,
-	}
-	fmt.Printf("Launching %s %s instance: %s\n", *createOutput.Instances[0].InstanceType, *createOutput.Instances[0].Lifecycle, *createOutput.Instances[0].InstanceIds[0])
-	err = ec2Svc.WaitUntilInstanceRunning(&instanceInput)
-	if err != nil {
-		return fmt.Errorf("error waiting for instance to start running")
+		instance.emit(Event{Type: EventSSMReady})
+		return nil
 	}
-
-	describeInstancesOutput, err := ec2Svc.DescribeInstances(&instanceInput)
-	if err != nil {
-		return fmt.Errorf("error describing instance")
-	}
-
-	instance.Reservation = describeInstancesOutput.Reservations[0]
-
-	for _, ri := range instance.Reservation.Instances {
-		instance.PrivateIPAddress = ri.PrivateIpAddress
-		instance.InstanceID = ri.InstanceId
-		instance.SelectedInstanceType = ri.InstanceType
-	}
-
-	if instance.PrivateIPAddress == nil {
-		return errors.New("looks like it didn't get created")
-	}
-
-	descSpot, err := ec2Svc.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("instance-id"),
-				Values: []*string{instance.InstanceID},
-			}},
-	})
-	if err != nil {
-		return fmt.Errorf("Unable to describe spot instance request: %s", err)
+	if err := instance.WaitForSSH(); err != nil {
+		return err
 	}
-
-	for _, sp := range descSpot.SpotInstanceRequests {
-		if sp.ActualBlockHourlyPrice != nil {
-			instance.SpotPrice = sp.ActualBlockHourlyPrice
-		} else {
-			instance.SpotPrice = sp.SpotPrice
-		}
+	if err := instance.FetchHostKeys(); err != nil {
+		return err
 	}
-
+	instance.emit(Event{Type: EventSSHReady})
 	return nil
 }
 
 // WaitForSSH connection and continue
-func (instance Instance) WaitForSSH() (err error) {
+func (instance *Instance) WaitForSSH() (err error) {
 	const retries = 10
 	var attempts = 0
 	for {
+		if err := instance.stopped(); err != nil {
+			return err
+		}
 		if attempts < retries {
 			attempts++
-			fmt.Printf("Waiting for SSH %s:%d ... ", *instance.PrivateIPAddress, *instance.SSHPort)
+			Log.Debugf("Waiting for SSH %s:%d (attempt %d/%d)", instance.host(), *instance.SSHPort, attempts, retries)
 
-			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", *instance.PrivateIPAddress, *instance.SSHPort), 15*time.Second)
+			conn, err := instance.dialTCP(fmt.Sprintf("%s:%d", instance.host(), *instance.SSHPort), 15*time.Second)
 			if err != nil {
-				fmt.Printf("instance not yet available (attempt %d/%d)\n", attempts, retries)
+				Log.Debugf("SSH %s:%d not yet available: %s", instance.host(), *instance.SSHPort, err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
 			if conn != nil {
-				fmt.Print("Ready!\n")
+				Log.Infof("SSH %s:%d is ready", instance.host(), *instance.SSHPort)
 				return conn.Close()
 			}
 
 		}
-		return fmt.Errorf("\nunable to connect to %s:%d", *instance.PrivateIPAddress, *instance.SSHPort)
+		return fmt.Errorf("unable to connect to %s:%d", instance.host(), *instance.SSHPort)
 	}
 }
 
-// InvokeCommand over ssh connection
+// InvokeCommand over ssh connection, or through SSM when connecting via SSM
 func (instance *Instance) InvokeCommand() (err error) {
+	if err := instance.stopped(); err != nil {
+		return err
+	}
+	if *instance.ConnectVia == ConnectViaSSM {
+		err = instance.invokeSSMCommand()
+	} else {
+		err = instance.invokeSSHCommand()
+	}
+
+	// detached commands are still running
+	if !instance.Detached {
+		instance.emitCommandExited(err)
+	}
+	return err
+}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", *instance.PrivateIPAddress, *instance.SSHPort), instance.sshConfig)
+// invokeSSHCommand runs the command over an SSH connection
+func (instance *Instance) invokeSSHCommand() (err error) {
+	client, err := instance.dial()
 	if err != nil {
-		return fmt.Errorf("unable to connect to SSH: %s", err)
+		return err
+	}
+	defer client.Close()
+
+	// Mount file systems first so uploads can be written to them
+	if len(instance.EFSMounts) > 0 {
+		err = instance.MountEFS(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(instance.Uploads) > 0 {
+		err = instance.Upload(client, instance.Uploads)
+		if err != nil {
+			return err
+		}
 	}
 
 	session, err := client.NewSession()
 	if err != nil {
-		client.Close()
 		return fmt.Errorf("unable to launch SSH session: %s", err)
 	}
 
-	stdin, err := session.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("Unable to setup stdin for session: %v", err)
+	var entrypointPath *string
+	if instance.EntrypointFile != nil {
+		uploadedFilePath, err := uploadFile(client, *instance.EntrypointFile)
+		if err != nil {
+			return err
+		}
+		entrypointPath = &uploadedFilePath
 	}
-	go io.Copy(stdin, os.Stdin)
 
-	stdout, err := session.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("Unable to setup stdout for session: %v", err)
+	command := instance.buildCommand(entrypointPath)
+	Log.Infof("Executing command: \n%s", command)
+
+	instance.emit(Event{Type: EventCommandStarted, Command: command, Detached: *instance.Detach})
+
+	// Detached commands keep running on the instance, which is left for 'ec2 wait' to clean up
+	if *instance.Detach {
+		defer session.Close()
+		return instance.startDetached(session, command)
+	}
+
+	// Attached sessions use the local terminal as is, otherwise output is prefixed per instance
+	if *instance.Attach {
+		restore, err := attachTerminal(session)
+		if err != nil {
+			return fmt.Errorf("Unable to attach to the instance: %s", err)
+		}
+		defer restore()
+	} else {
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("Unable to setup stdin for session: %v", err)
+		}
+		go io.Copy(stdin, os.Stdin)
+
+		stdout, stderr := instance.outputWriters()
+		session.Stdout = stdout
+		session.Stderr = stderr
+		defer stdout.Flush()
+		defer stderr.Flush()
+	}
+
+	// Kill the command once it runs past the timeout. The connection stays open for downloads
+	var timer *time.Timer
+	if *instance.Timeout > 0 {
+		timer = time.AfterFunc(*instance.Timeout, func() {
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		})
+	}
+
+	// End the session when the run is stopped or over budget, the instance is terminated after
+	sessionDone := make(chan struct{})
+	defer close(sessionDone)
+	go func() {
+		select {
+		case <-instance.stop:
+			session.Close()
+		case <-instance.overBudget:
+			session.Close()
+		case <-sessionDone:
+		}
+	}()
+
+	// Watch for AWS reclaiming spot instances
+	var notices <-chan *spotInstanceAction
+	stopWatching := make(chan struct{})
+	if instance.isSpot() {
+		notices = instance.watchSpotInterruption(client, stopWatching)
+	}
+
+	*instance.ExitCode, err = instance.RunCommand(session, command)
+
+	close(stopWatching)
+	if timer != nil && !timer.Stop() {
+		instance.TimedOut = true
+		*instance.ExitCode = TimeoutExitCode
+		err = fmt.Errorf("timed out after %s", *instance.Timeout)
+	}
+
+	// The connection drops when the instance is reclaimed, leaving nothing to download
+	if err != nil && !instance.TimedOut {
+		var notice *spotInstanceAction
+		if notices != nil {
+			notice = <-notices
+		}
+		if notice != nil {
+			*instance.ExitCode = -1
+			return instance.interrupted(&InterruptedError{InstanceID: *instance.InstanceID, Reason: "notice to " + notice.String()})
+		}
+		if interruption := instance.spotInterruption(); interruption != nil {
+			*instance.ExitCode = -1
+			return instance.interrupted(interruption)
+		}
+	}
+
+	// Retrieve artifacts whether or not the command succeeded
+	if len(instance.Downloads) > 0 {
+		downloadErr := instance.Download(client, instance.Downloads)
+		if downloadErr != nil && err == nil {
+			return downloadErr
+		}
+		if downloadErr != nil {
+			Log.Errorf("%s", downloadErr)
+		}
 	}
-	go io.Copy(os.Stdout, stdout)
 
-	stderr, err := session.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("Unable to setup stderr for session: %v", err)
+		return fmt.Errorf("command exited with code %d: %s", *instance.ExitCode, err)
 	}
-	go io.Copy(os.Stderr, stderr)
 
+	return nil
+}
+
+// buildCommand returns the shell command exporting the environment and running the
+// entrypoint, found at entrypointPath on the instance, followed by the command
+func (instance *Instance) buildCommand(entrypointPath *string) string {
 	var commands []string
 
 	if len(*instance.EnvVars) > 0 {
@@ -328,36 +687,103 @@ func (instance *Instance) InvokeCommand() (err error) {
 		}
 	}
 
-	if instance.EntrypointFile != nil {
-		uploadedFilePath, err := instance.UploadFile(*instance.EntrypointFile)
-		if err != nil {
-			return err
-		}
-
+	if entrypointPath != nil {
 		if *instance.WaitOnCloudInit {
 			commands = append(commands, "while [ ! -f /var/lib/cloud/instance/boot-finished ]; do echo 'Waiting for cloud-init...'; sleep 1; done")
 		}
 
-		commands = append(commands, uploadedFilePath)
+		commands = append(commands, *entrypointPath)
 
 	}
 
 	if instance.Command != nil {
 		commands = append(commands, *instance.Command)
 
+	} else if instance.Attach != nil && *instance.Attach {
+		// open an interactive shell, the instance terminates on logout
+		commands = append(commands, `exec "${SHELL:-/bin/bash}" -l`)
 	}
-	command := strings.Join(commands, " \\\n && ")
-	fmt.Printf("Executing command: \n%s\n", command)
-	*instance.ExitCode, err = instance.RunCommand(session, command)
+
+	return strings.Join(commands, " \\\n && ")
+}
+
+// outputWriters returns the writers for the command's stdout and stderr. Stderr is written as
+// events when it carries lifecycle events too.
+func (instance *Instance) outputWriters() (stdout, stderr *prefixWriter) {
+	stdout, stderr = instance.terminalWriters()
+	if instance.stderrEvents && instance.Events != nil {
+		stderr = newPrefixWriter(&eventWriter{events: instance.Events, event: Event{
+			Type:       EventStderr,
+			RunID:      stringPointerValueOrNil(instance.RunID, ""),
+			Index:      instance.Index,
+			InstanceID: stringPointerValueOrNil(instance.InstanceID, ""),
+		}}, "", nil)
+	}
+	return stdout, stderr
+}
+
+// terminalWriters returns writers to stdout and stderr. When several instances run at once,
+// each line is prefixed with the instance index and ID and colored with the instance's
+// TTYColor.
+func (instance *Instance) terminalWriters() (stdout, stderr *prefixWriter) {
+	if instance.Count <= 1 {
+		return newPrefixWriter(os.Stdout, "", nil), newPrefixWriter(os.Stderr, "", nil)
+	}
+
+	prefix := fmt.Sprintf("[%d %s] ", instance.Index, stringPointerValueOrNil(instance.InstanceID, ""))
+
+	stdoutColor, stderrColor := instance.TTYColor, instance.TTYColor
+	if *instance.NoColor || !isTerminal(os.Stdout) {
+		stdoutColor = nil
+	}
+	if *instance.NoColor || !isTerminal(os.Stderr) {
+		stderrColor = nil
+	}
+
+	return newPrefixWriter(os.Stdout, prefix, stdoutColor), newPrefixWriter(os.Stderr, prefix, stderrColor)
+}
+
+// host returns the IP address used to connect to the instance
+func (instance *Instance) host() string {
+	if *instance.ConnectVia == ConnectViaPublicIP {
+		return stringPointerValueOrNil(instance.PublicIPAddress, "")
+	}
+	return stringPointerValueOrNil(instance.PrivateIPAddress, "")
+}
+
+// dial opens an SSH connection to the instance, through any jump hosts
+func (instance *Instance) dial() (*ssh.Client, error) {
+	addr := fmt.Sprintf("%s:%d", instance.host(), *instance.SSHPort)
+
+	conn, err := instance.dialTCP(addr, 15*time.Second)
 	if err != nil {
-		return fmt.Errorf("command exited with code %d: %s", instance.ExitCode, err)
+		return nil, fmt.Errorf("unable to connect to SSH: %s", err)
 	}
 
-	return nil
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, instance.sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to SSH: %s", err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-// UploadFile to instance, dropping in user home
-func (instance Instance) UploadFile(filename string) (string, error) {
+// UploadFile to instance, dropping in /tmp
+func (instance *Instance) UploadFile(filename string) (string, error) {
+	client, err := instance.dial()
+	if err != nil {
+		return "", fmt.Errorf("Couldn't establish an SCP connection to %s:%d: %s", instance.host(), *instance.SSHPort, err)
+	}
+
+	// Close client connection after the file has been copied
+	defer client.Close()
+
+	return uploadFile(client, filename)
+}
+
+// uploadFile copies a single file to /tmp on the instance over an existing connection
+func uploadFile(client *ssh.Client, filename string) (string, error) {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
 		return "", fmt.Errorf("File does not exist: %s", filename)
@@ -370,66 +796,67 @@ func (instance Instance) UploadFile(filename string) (string, error) {
 		return "", fmt.Errorf("Unable to upload %s. It's a directory", filename)
 	}
 
-	// Open file
-	f, err := os.Open(filename)
+	remoteFilePath := "/tmp/" + filepath.Base(filename)
+	err = copyFile(client, filename, remoteFilePath, 0755)
 	if err != nil {
-		return "", fmt.Errorf("Could not open local file %s", err.Error())
+		return "", err
 	}
 
-	// Close the file after it has been copied
-	defer f.Close()
-
-	client := scp.NewClient(fmt.Sprintf("%s:%d", *instance.PrivateIPAddress, *instance.SSHPort), instance.sshConfig)
-
-	// Close client connection after the file has been copied
-	defer client.Close()
+	return remoteFilePath, nil
+}
 
-	// Connect to the remote server
-	err = client.Connect()
-	if err != nil {
-		return "", fmt.Errorf("Couldn't establish an SCP connection to %s:%d: %s", *instance.PrivateIPAddress, *instance.SSHPort, err)
+// Terminate this instance
+func (instance *Instance) Terminate() error {
+	if instance.InstanceID == nil {
+		return errors.New("instance was not launched")
 	}
+	return instance.Cleanup.Remove(instanceResource(*instance.InstanceID), instance.terminate)
+}
 
-	// Finaly, copy the file over
-	remote_file_path := "/tmp/" + filepath.Base(f.Name())
-	err = client.CopyFile(f, remote_file_path, "0755")
-	if err != nil {
-		return "", fmt.Errorf("Error while copying file: %s", err.Error())
+// cleanupInstance terminates the instance unless it is kept after the command finishes or
+// is running a detached command. Instances that timed out are terminated regardless.
+func (instance *Instance) cleanupInstance() error {
+	if (*instance.NoTermination && !instance.TimedOut) || instance.Detached {
+		return nil
 	}
-
-	return remote_file_path, nil
+	return instance.terminate()
 }
 
-// Terminate this instance
-func (instance Instance) Terminate() error {
-	res, err := ec2Svc.TerminateInstances(&ec2.TerminateInstancesInput{
+func (instance *Instance) terminate() error {
+	res, err := instance.Client.EC2.TerminateInstances(&ec2.TerminateInstancesInput{
 		InstanceIds: []*string{instance.InstanceID},
 	})
 	if err != nil {
 		return err
 	}
 
+	instance.terminated()
+	instance.emit(Event{Type: EventTerminated})
+
 	for _, terminatingInstance := range res.TerminatingInstances {
-		fmt.Printf("\nInstance %s %s\n", *terminatingInstance.InstanceId, *terminatingInstance.CurrentState.Name)
+		Log.Infof("Instance %s %s", *terminatingInstance.InstanceId, *terminatingInstance.CurrentState.Name)
 	}
 	return nil
 }
 
-// Delete the launch template used to create the spot fleet
-func (instance Instance) DeleteLaunchTemplate() {
+// DeleteLaunchTemplate deletes the launch template used to create the spot fleet
+func (instance *Instance) DeleteLaunchTemplate() error {
+	return instance.Cleanup.Remove(launchTemplateResource(*instance.LaunchTemplateName), instance.deleteLaunchTemplate)
+}
+
+func (instance *Instance) deleteLaunchTemplate() error {
 	deleteInput := &ec2.DeleteLaunchTemplateInput{
 		LaunchTemplateName: instance.LaunchTemplateName,
 	}
-	if _, err := ec2Svc.DeleteLaunchTemplate(deleteInput); err != nil {
-		fmt.Printf("Error deleting launch template: %s", err.Error())
-		fmt.Println(err)
-	} else {
-		fmt.Printf("Deleted launch template %s\n", *instance.LaunchTemplateName)
+	if _, err := instance.Client.EC2.DeleteLaunchTemplate(deleteInput); err != nil {
+		return err
 	}
+	Log.Infof("Deleted launch template %s", *instance.LaunchTemplateName)
+	return nil
 }
 
 // RunCommand against remote instance using SSH
-func (instance Instance) RunCommand(session *ssh.Session, command string) (int, error) {
+func (instance *Instance) RunCommand(session *ssh.Session, command string) (int, error) {
 
 	err := session.Run(command)
 	if err != nil {
@@ -445,18 +872,24 @@ func (instance Instance) RunCommand(session *ssh.Session, command string) (int,
 }
 
 // DestroyKeyPair after instance termination
-func (instance Instance) DestroyKeyPair() {
-	_, err := ec2Svc.DeleteKeyPair(&ec2.DeleteKeyPairInput{
-		KeyName: instance.KeyName,
+func (instance *Instance) DestroyKeyPair() error {
+	return instance.Cleanup.Remove(keyPairResource(*instance.KeyName), func() error {
+		return destroyKeyPair(instance.Client, *instance.KeyName)
 	})
+}
 
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Printf("Destroyed key pair %s\n", *instance.KeyName)
+func destroyKeyPair(client *Client, name string) error {
+	if _, err := client.EC2.DeleteKeyPair(&ec2.DeleteKeyPairInput{KeyName: &name}); err != nil {
+		return err
 	}
-
+	Log.Infof("Destroyed key pair %s", name)
+	return nil
 }
+
+func instanceResource(id string) string         { return "instance " + id }
+func launchTemplateResource(name string) string { return "launch template " + name }
+func keyPairResource(name string) string        { return "key pair " + name }
+
 func (instance *Instance) String() string {
 	var s string
 
@@ -488,6 +921,10 @@ func (instance *Instance) String() string {
 		s = s + fmt.Sprintf("KeyName: %s\n", *instance.KeyName)
 	}
 
+	if instance.RunID != nil {
+		s = s + fmt.Sprintf("RunID: %s\n", *instance.RunID)
+	}
+
 	if instance.Tags != nil {
 		s = s + "Tags:\n"
 		for key, value := range *instance.Tags {
@@ -509,6 +946,10 @@ func (instance *Instance) String() string {
 
 	s = s + fmt.Sprintf("SpotPrice: %s\n", stringPointerValueOrNil(instance.SpotPrice, ""))
 
+	if instance.CapacityStrategy != nil {
+		s = s + fmt.Sprintf("CapacityStrategy: %s\n", *instance.CapacityStrategy)
+	}
+
 	if instance.UserData != nil {
 		s = s + fmt.Sprintf("UserData: %s\n", *instance.UserData)
 	}
@@ -533,6 +974,28 @@ func (instance *Instance) String() string {
 
 	s = s + fmt.Sprintf("PrivateIPAddress: %s\n", stringPointerValueOrNil(instance.PrivateIPAddress, ""))
 
+	s = s + fmt.Sprintf("PublicIPAddress: %s\n", stringPointerValueOrNil(instance.PublicIPAddress, ""))
+
+	if instance.ConnectVia != nil {
+		s = s + fmt.Sprintf("ConnectVia: %s\n", *instance.ConnectVia)
+	}
+
+	if len(instance.JumpHosts) > 0 {
+		var ss []string
+		for _, jump := range instance.JumpHosts {
+			ss = append(ss, jump.String())
+		}
+		s = s + fmt.Sprintf("JumpHosts: %s\n", strings.Join(ss, ","))
+	}
+
+	if len(instance.EFSMounts) > 0 {
+		var ss []string
+		for _, mount := range instance.EFSMounts {
+			ss = append(ss, mount.String())
+		}
+		s = s + fmt.Sprintf("EFSMounts: %s\n", strings.Join(ss, ","))
+	}
+
 	if instance.InstanceID != nil {
 		s = s + fmt.Sprintf("InstanceID: %s\n", *instance.InstanceID)
 	}
@@ -545,5 +1008,9 @@ func (instance *Instance) String() string {
 		s = s + fmt.Sprintf("Command: %s\n", *instance.Command)
 	}
 
+	if instance.Timeout != nil && *instance.Timeout > 0 {
+		s = s + fmt.Sprintf("Timeout: %s\n", *instance.Timeout)
+	}
+
 	return s
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
 	"time"
@@ -17,6 +18,7 @@ import (
 
 // InstanceOptions asdf
 type InstanceOptions struct {
+	Client                 *Client
 	AMI                    string
 	AMIID                  string
 	AMIFilter              []string
@@ -35,6 +37,7 @@ type InstanceOptions struct {
 	Tags                   []string
 	InstanceTypes          []string
 	BidPrice               float64
+	BidPrices              []string
 	UserDataFile           string
 	EntrypointFile         string
 	WaitOnCloudInit        bool
@@ -45,6 +48,31 @@ type InstanceOptions struct {
 	CreateFleetRetries     int64
 	LaunchTemplateName     string
 	BlockDurationInMinutes int64
+	CapacityStrategy       string
+	MaxSpotRetries         int64
+	NoColor                bool
+	Uploads                []string
+	Downloads              []string
+	ConnectVia             string
+	SSMLogGroup            string
+	JumpHosts              []string
+	JumpIdentityFile       string
+	StrictHostKeyChecking  bool
+	EFS                    []string
+	Timeout                time.Duration
+	RunID                  string
+	Cleanup                *Cleanup
+	MaxInterruptionRetries int
+	Detach                 bool
+	Events                 *Events
+	MaxCost                float64
+	// Stop is closed to stop the run. Nothing more is created once it is.
+	Stop <-chan struct{}
+	// StderrEvents writes the command's stderr to Events, for events sharing stderr
+	StderrEvents bool
+	// DryRun plans the run without creating key pairs, launch templates or instances
+	DryRun     bool
+	privateKey []byte
 }
 
 // ttyColors generated with the following
@@ -95,75 +123,247 @@ var ttyColors = [...]string{
 // Instances returns a slice of Instances
 func (opts *InstanceOptions) Instances() (instances []*Instance, err error) {
 
-	amiID, err := opts.DetermineAMIID()
+	// Options are validated before anything is looked up or created, so invalid options never
+	// leave resources behind
+	tags, err := opts.ParseTags()
+	if err != nil {
+		return nil, err
+	}
+	envVars, err := opts.ParseEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := parseTransfers(opts.Uploads, true)
 	if err != nil {
 		return nil, err
 	}
 
-	subnetID, err := opts.DetermineSubnetID()
+	downloads, err := parseTransfers(opts.Downloads, false)
+	if err != nil {
+		return nil, err
+	}
+
+	efsMounts, err := parseEFSMounts(opts.EFS)
+	if err != nil {
+		return nil, err
+	}
+
+	jumpHosts, err := parseJumpHosts(opts.JumpHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidateConnectVia(opts.ConnectVia); err != nil {
+		return nil, err
+	}
+	if opts.SSMLogGroup != "" && opts.ConnectVia != ConnectViaSSM {
+		return nil, errors.New("an SSM log group can only be used when connecting via ssm")
+	}
+	if opts.ConnectVia == ConnectViaSSM {
+		if len(uploads) > 0 || len(downloads) > 0 {
+			return nil, errors.New("uploads and downloads require SSH and can not be used when connecting via ssm")
+		}
+		if len(jumpHosts) > 0 {
+			return nil, errors.New("jump hosts can not be used when connecting via ssm")
+		}
+	}
+
+	if opts.Attach {
+		if opts.ConnectVia == ConnectViaSSM {
+			return nil, errors.New("attaching requires SSH and can not be used when connecting via ssm")
+		}
+		if opts.Count > 1 {
+			return nil, errors.New("attaching can only be used with a single instance")
+		}
+	}
+
+	if opts.MaxCost < 0 {
+		return nil, errors.New("the maximum cost can not be negative")
+	}
+
+	if opts.Detach {
+		if opts.MaxCost > 0 {
+			return nil, errors.New("the maximum cost can not be enforced once detached")
+		}
+		if opts.ConnectVia == ConnectViaSSM {
+			return nil, errors.New("detaching requires SSH and can not be used when connecting via ssm")
+		}
+		if opts.Count > 1 {
+			return nil, errors.New("detaching can only be used with a single instance")
+		}
+		if opts.Attach {
+			return nil, errors.New("attach and detach can not be used together")
+		}
+	}
+
+	if err := ValidateCapacityStrategy(opts.CapacityStrategy); err != nil {
+		return nil, err
+	}
+	// the fleet request would run out of retries before ever switching to on-demand
+	if opts.CapacityStrategy == CapacityStrategySpotThenOnDemand && opts.MaxSpotRetries >= opts.CreateFleetRetries {
+		return nil, fmt.Errorf("the maximum spot retries (%d) must be less than the maximum fleet retries (%d) to switch to on-demand", opts.MaxSpotRetries, opts.CreateFleetRetries)
+	}
+
+	bidPrices, err := opts.ParseBidPrices()
+	if err != nil {
+		return nil, err
+	}
+
+	amiID, err := opts.DetermineAMIID()
 	if err != nil {
 		return nil, err
 	}
 
-	sshKeyName, sshConfig, err := opts.DetermineSSHConfigs()
+	subnetID, err := opts.DetermineSubnetID()
 	if err != nil {
 		return nil, err
 	}
 
+	// Spot prices are checked against the bids once for every instance, before anything is
+	// created. Dry runs report bids that are too low in their plan.
+	var bidPriceErr *BidPriceError
+	switch err := opts.checkBidPrices(subnetID, bidPrices).(type) {
+	case nil:
+	case *BidPriceError:
+		if opts.CapacityStrategy != CapacityStrategySpotThenOnDemand && !opts.DryRun {
+			return nil, err
+		}
+		if !opts.DryRun {
+			Log.Warnf("%s. Launching on-demand instances", err)
+		}
+		bidPriceErr = err
+	default:
+		Log.Warnf("Unable to check spot prices against the bid: %s", err)
+	}
+
+	// Tag everything this run creates so it can be reaped should the run die
+	if opts.RunID == "" {
+		opts.RunID = newRunID()
+	}
+	expires := runExpiry(time.Now(), opts.Timeout)
+
 	securityGroupIDs, err := opts.DetermineSecurityGroupIDs()
 	if err != nil {
 		return nil, err
 	}
-	tags, err := opts.ParseTags()
+	efsMounts, err = opts.DetermineEFSMounts(efsMounts, subnetID, securityGroupIDs)
 	if err != nil {
 		return nil, err
 	}
-	envVars, err := opts.ParseEnvVars()
+
+	// Jump hosts share the instance's auth unless they have an identity file of their own
+	jumpAuth, err := jumpAuth(opts.JumpIdentityFile, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// Generate a random launch template name for spot fleet to avoid conflicting with other
-	// fleets running in this AWS account
-	launchTemplateName := fmt.Sprintf(
-		"%s-%s", opts.LaunchTemplateName,
-		random.AlphaNum(7))
+	var jumpHostKeys ssh.HostKeyCallback
+	if len(jumpHosts) > 0 {
+		jumpHostKeys, err = jumpHostKeyCallback(opts.StrictHostKeyChecking)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The ephemeral key pair is the first thing created
+	sshKeyName, sshConfig, err := opts.determineSSHConfigs(expires)
+	if err != nil {
+		return nil, err
+	}
+	if jumpAuth == nil {
+		jumpAuth = sshConfig.Auth
+	}
 
 	// Build each Instance's configs
 	for i := 1; i <= opts.Count; i++ {
 		var instance Instance
+		instance.Client = opts.Client
+
+		// Generate a random launch template name for each fleet to avoid conflicting with other
+		// fleets running in this AWS account
+		launchTemplateName := fmt.Sprintf(
+			"%s-%s", opts.LaunchTemplateName,
+			random.AlphaNum(7))
+
 		instance.AMIID = amiID
 		instance.SubnetID = subnetID
 		instance.SecurityGroupIDs = securityGroupIDs
-		instance.sshConfig = sshConfig
+		// Every instance has its own host keys
+		instance.hostKeys = &hostKeyVerifier{strict: opts.StrictHostKeyChecking}
+		instanceSSHConfig := *sshConfig
+		instanceSSHConfig.HostKeyCallback = instance.hostKeys.callback
+		instance.sshConfig = &instanceSSHConfig
 		instance.KeyName = sshKeyName
 		instance.Tags = tags
 		instance.BidPrice = &opts.BidPrice
+		instance.BidPrices = bidPrices
+		instance.bidPriceErr = bidPriceErr
 		instance.WaitOnCloudInit = &opts.WaitOnCloudInit
 		instance.Attach = &opts.Attach
 		instance.InstanceTypes = &opts.InstanceTypes
 		instance.NoTermination = &opts.NoTermination
 		instance.SSHPort = &opts.SSHPort
+		instance.User = &opts.User
+		instance.ConnectVia = &opts.ConnectVia
+		instance.JumpHosts = jumpHosts
+		instance.jumpAuth = jumpAuth
+		instance.jumpHostKeyCallback = jumpHostKeys
 		instance.ExitCode = aws.Int(-1)
 		instance.EnvVars = envVars
 		instance.LaunchTemplateName = &launchTemplateName
 		instance.CreateFleetRetries = &opts.CreateFleetRetries
 		instance.BlockDurationInMinutes = &opts.BlockDurationInMinutes
-
-		if i > 1 {
-			instance.TTYColor = &ttyColors[i]
+		instance.CapacityStrategy = &opts.CapacityStrategy
+		instance.MaxSpotRetries = &opts.MaxSpotRetries
+
+		instance.Index = i
+		instance.Count = opts.Count
+		instance.SSMLogGroup = &opts.SSMLogGroup
+		instance.NoColor = &opts.NoColor
+		instance.Uploads = uploads
+		instance.Downloads = downloads
+		instance.EFSMounts = efsMounts
+		instance.Timeout = &opts.Timeout
+		instance.RunID = &opts.RunID
+		instance.Expires = &expires
+		instance.Cleanup = opts.Cleanup
+		instance.MaxInterruptionRetries = &opts.MaxInterruptionRetries
+		instance.Detach = &opts.Detach
+		instance.Events = opts.Events
+		instance.stop = opts.Stop
+		instance.stderrEvents = opts.StderrEvents
+		instance.overBudget = make(chan struct{})
+		instance.privateKey = opts.privateKey
+		instance.identityFile = opts.IdentityFile
+		instance.jumpIdentityFile = opts.JumpIdentityFile
+
+		// Colorize each instance's output when running several at once
+		if opts.Count > 1 {
+			instance.TTYColor = &ttyColors[(i-1)%len(ttyColors)]
 		}
 
 		if opts.IamInstanceProfile != "" {
 			instance.IamInstanceProfile = &opts.IamInstanceProfile
 		}
 
+		var userData []byte
 		if opts.UserDataFile != "" {
-			data, err := ioutil.ReadFile(opts.UserDataFile)
+			userData, err = ioutil.ReadFile(opts.UserDataFile)
 			if err != nil {
 				return nil, fmt.Errorf("Unable to read user-data file %s: %s", opts.UserDataFile, err)
 			}
-			encodedData := base64.StdEncoding.EncodeToString(data)
+		}
+
+		// Have the instance shut itself down, and so terminate, in case this process dies
+		if opts.Timeout > 0 {
+			userData, err = safeguardUserData(userData, opts.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to add timeout to user-data: %s", err)
+			}
+		}
+
+		if len(userData) > 0 {
+			encodedData := base64.StdEncoding.EncodeToString(userData)
 			instance.UserData = &encodedData
 		}
 
@@ -182,6 +382,24 @@ func (opts *InstanceOptions) Instances() (instances []*Instance, err error) {
 	return instances, nil
 }
 
+// ValidateConnectVia returns an error for unknown connection modes
+func ValidateConnectVia(connectVia string) error {
+	switch connectVia {
+	case ConnectViaPrivateIP, ConnectViaPublicIP, ConnectViaSSM:
+		return nil
+	}
+	return fmt.Errorf("unknown connection mode %s", connectVia)
+}
+
+// ValidateCapacityStrategy returns an error for unknown capacity strategies
+func ValidateCapacityStrategy(strategy string) error {
+	switch strategy {
+	case CapacityStrategySpotOnly, CapacityStrategySpotThenOnDemand, CapacityStrategyOnDemandOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown capacity strategy %s", strategy)
+}
+
 // ParseTags and return a tag map for Instance
 func (opts *InstanceOptions) ParseTags() (*map[string]string, error) {
 	tags := make(map[string]string)
@@ -242,7 +460,7 @@ func (opts *InstanceOptions) DetermineAMIID() (*string, error) {
 		})
 	}
 
-	result, err := ec2Svc.DescribeImages(&ec2.DescribeImagesInput{
+	result, err := opts.Client.EC2.DescribeImages(&ec2.DescribeImagesInput{
 		Filters: filters,
 	})
 	if err != nil {
@@ -268,8 +486,8 @@ func (opts *InstanceOptions) DetermineSecurityGroupIDs() ([]*string, error) {
 	var securityGroupIds []*string
 
 	// if we already have an IDs, their pointer
-	for _, id := range opts.SecurityGroupIDs {
-		securityGroupIds = append(securityGroupIds, &id)
+	for i := range opts.SecurityGroupIDs {
+		securityGroupIds = append(securityGroupIds, &opts.SecurityGroupIDs[i])
 	}
 
 	if len(opts.SecurityGroupFilters) < 1 && len(opts.SecurityGroups) < 1 {
@@ -298,7 +516,7 @@ func (opts *InstanceOptions) DetermineSecurityGroupIDs() ([]*string, error) {
 		})
 	}
 
-	result, err := ec2Svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+	result, err := opts.Client.EC2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
 		Filters: filters,
 	})
 
@@ -346,7 +564,7 @@ func (opts *InstanceOptions) DetermineSubnetID() (*string, error) {
 		})
 	}
 
-	result, err := ec2Svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+	result, err := opts.Client.EC2.DescribeSubnets(&ec2.DescribeSubnetsInput{
 		Filters: filters,
 	})
 	if err != nil {
@@ -361,45 +579,69 @@ func (opts *InstanceOptions) DetermineSubnetID() (*string, error) {
 	return result.Subnets[0].SubnetId, nil
 }
 
-// DetermineSSHConfigs returns pointers to the key name and identity
+// DetermineSSHConfigs returns pointers to the key name and identity. Keys in the local SSH
+// agent are offered too. Host keys are verified per instance so the config has no
+// HostKeyCallback.
 func (opts *InstanceOptions) DetermineSSHConfigs() (sshKeyName *string, sshConfig *ssh.ClientConfig, err error) {
-	var sshKeyIdentity *string
+	return opts.determineSSHConfigs(runExpiry(time.Now(), opts.Timeout))
+}
+
+// determineSSHConfigs tags an ephemeral key pair with the run ID and the given expiry
+func (opts *InstanceOptions) determineSSHConfigs(expires time.Time) (sshKeyName *string, sshConfig *ssh.ClientConfig, err error) {
+	var signers []ssh.Signer
 
 	// Pull in identiity filef
 	if opts.SSHKey != "" || opts.IdentityFile != "" {
 
-		// Handle missing identity file
-		if opts.IdentityFile == "" {
-			return nil, nil, fmt.Errorf("Unable to use private key '%s' without identity file", opts.SSHKey)
-		}
-
 		// Handle SSHKey
 		if opts.SSHKey == "" {
 			return nil, nil, fmt.Errorf("Unable to use identity file '%s' without an AWS SSH key set", opts.IdentityFile)
 		}
 
-		data, err := ioutil.ReadFile(opts.IdentityFile)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Unable to read identity-file %s: %s", opts.IdentityFile, err)
+		// Handle missing identity file. The key may be in the SSH agent
+		if opts.IdentityFile == "" && os.Getenv("SSH_AUTH_SOCK") == "" {
+			return nil, nil, fmt.Errorf("Unable to use private key '%s' without identity file or SSH agent", opts.SSHKey)
+		}
+
+		if opts.IdentityFile != "" {
+			signer, err := readIdentityFile(opts.IdentityFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			signers = append(signers, signer)
 		}
 
 		sshKeyName = &opts.SSHKey
-		sshKeyIdentity = aws.String(string(data))
+
+		// A dry run only needs a local key, nothing is imported into AWS
+	} else if opts.DryRun {
+		signer, privateKey, err := newED25519Key()
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.privateKey = privateKey
+		signers = append(signers, signer)
 
 		// Generate an ephemeral SSHKey if one is not set
 	} else {
-		sshKeyName, sshKeyIdentity, err = newKeyPair(opts.NoTermination)
+		if err := stopped(opts.Stop); err != nil {
+			return nil, nil, err
+		}
+		var signer ssh.Signer
+		sshKeyName, signer, opts.privateKey, err = newKeyPair(opts.Client, opts.NoTermination, runTags(opts.RunID, &expires))
 		if err != nil {
 			return nil, nil, err
 		}
+		name := *sshKeyName
+		opts.Cleanup.Register(keyPairResource(name), func() error {
+			return destroyKeyPair(opts.Client, name)
+		})
+		signers = append(signers, signer)
 	}
 
-	signer, err := ssh.ParsePrivateKey([]byte(*sshKeyIdentity))
-
 	sshConfig = &ssh.ClientConfig{
-		User:            opts.User,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User: opts.User,
+		Auth: []ssh.AuthMethod{publicKeyAuth(signers)},
 	}
 
 	return sshKeyName, sshConfig, nil
@@ -0,0 +1,270 @@
+package ec2
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+// newTestClient returns a Client backed by a fake EC2 API populated with a few AMIs,
+// subnets and security groups
+func newTestClient() (*Client, *fake.EC2) {
+	f := fake.NewEC2()
+
+	f.Images = []*ec2.Image{
+		{ImageId: aws.String("ami-old"), Name: aws.String("amzn2-ami-hvm-2.0.20190101-x86_64-ebs"), ImageOwnerAlias: aws.String("amazon"), CreationDate: aws.String("2019-01-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-new"), Name: aws.String("amzn2-ami-hvm-2.0.20200101-x86_64-ebs"), ImageOwnerAlias: aws.String("amazon"), CreationDate: aws.String("2020-01-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-mid"), Name: aws.String("amzn2-ami-hvm-2.0.20190601-x86_64-ebs"), ImageOwnerAlias: aws.String("amazon"), CreationDate: aws.String("2019-06-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-custom"), Name: aws.String("custom-image"), OwnerId: aws.String("123456789012"), CreationDate: aws.String("2021-01-01T00:00:00.000Z")},
+	}
+
+	f.Subnets = []*ec2.Subnet{
+		{SubnetId: aws.String("subnet-public"), AvailabilityZone: aws.String("us-east-1a"), CidrBlock: aws.String("10.0.0.0/24"), Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("qa-public")},
+			{Key: aws.String("Environment"), Value: aws.String("qa")},
+			{Key: aws.String("Type"), Value: aws.String("public")},
+		}},
+		{SubnetId: aws.String("subnet-private"), AvailabilityZone: aws.String("us-east-1b"), CidrBlock: aws.String("10.0.1.0/24"), Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("qa-private")},
+			{Key: aws.String("Environment"), Value: aws.String("qa")},
+			{Key: aws.String("Type"), Value: aws.String("private")},
+		}},
+	}
+
+	f.SecurityGroups = []*ec2.SecurityGroup{
+		{GroupId: aws.String("sg-private"), GroupName: aws.String("qa_private"), Tags: []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("qa_private")}}},
+		{GroupId: aws.String("sg-public"), GroupName: aws.String("qa_public"), Tags: []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("qa_public")}}},
+	}
+
+	return &Client{EC2: f, EFS: fake.NewEFS(), SSM: fake.NewSSM()}, f
+}
+
+func TestDetermineAMIID(t *testing.T) {
+	client, _ := newTestClient()
+
+	tests := []struct {
+		name    string
+		opts    InstanceOptions
+		want    string
+		wantErr bool
+	}{
+		{name: "explicit id", opts: InstanceOptions{AMIID: "ami-explicit"}, want: "ami-explicit"},
+		{name: "newest by name", opts: InstanceOptions{AMI: "amzn2-ami-hvm*"}, want: "ami-new"},
+		{name: "newest by filters", opts: InstanceOptions{AMIFilter: []string{"owner-alias=amazon", "name=amzn2-ami-hvm-2.0.2019*"}}, want: "ami-mid"},
+		{name: "filter with multiple values", opts: InstanceOptions{AMIFilter: []string{"image-id=ami-old,ami-mid"}}, want: "ami-mid"},
+		{name: "no match", opts: InstanceOptions{AMI: "ubuntu*"}, wantErr: true},
+		{name: "malformed filter", opts: InstanceOptions{AMIFilter: []string{"owner-alias"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Client = client
+			got, err := tt.opts.DetermineAMIID()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", aws.StringValue(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %s, want %s", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetermineSubnetID(t *testing.T) {
+	client, _ := newTestClient()
+
+	tests := []struct {
+		name    string
+		opts    InstanceOptions
+		want    string
+		wantErr bool
+	}{
+		{name: "explicit id", opts: InstanceOptions{SubnetID: "subnet-explicit"}, want: "subnet-explicit"},
+		{name: "by name", opts: InstanceOptions{Subnet: "qa-private"}, want: "subnet-private"},
+		{name: "by filters", opts: InstanceOptions{SubnetFilter: []string{"tag:Environment=qa", "tag:Type=public"}}, want: "subnet-public"},
+		{name: "no match", opts: InstanceOptions{SubnetFilter: []string{"tag:Environment=prod"}}, wantErr: true},
+		{name: "malformed filter", opts: InstanceOptions{SubnetFilter: []string{"tag:Environment"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Client = client
+			got, err := tt.opts.DetermineSubnetID()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", aws.StringValue(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %s, want %s", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetermineSecurityGroupIDs(t *testing.T) {
+	client, _ := newTestClient()
+
+	tests := []struct {
+		name    string
+		opts    InstanceOptions
+		want    []string
+		wantErr bool
+	}{
+		{name: "explicit ids", opts: InstanceOptions{SecurityGroupIDs: []string{"sg-1", "sg-2"}}, want: []string{"sg-1", "sg-2"}},
+		{name: "by name", opts: InstanceOptions{SecurityGroups: []string{"qa_public"}}, want: []string{"sg-public"}},
+		{name: "by filters", opts: InstanceOptions{SecurityGroupFilters: []string{"tag:Name=qa_*"}}, want: []string{"sg-private", "sg-public"}},
+		{name: "ids and names", opts: InstanceOptions{SecurityGroupIDs: []string{"sg-1"}, SecurityGroups: []string{"qa_private"}}, want: []string{"sg-1", "sg-private"}},
+		{name: "none", opts: InstanceOptions{}, want: nil},
+		{name: "no match", opts: InstanceOptions{SecurityGroups: []string{"prod_private"}}, wantErr: true},
+		{name: "malformed filter", opts: InstanceOptions{SecurityGroupFilters: []string{"group-name"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Client = client
+			got, err := tt.opts.DetermineSecurityGroupIDs()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", aws.StringValueSlice(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(aws.StringValueSlice(got), tt.want) {
+				t.Errorf("got %v, want %v", aws.StringValueSlice(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestInstances(t *testing.T) {
+	client, f := newTestClient()
+
+	opts := testInstanceOptions(client)
+	opts.Count = 3
+
+	instances, err := opts.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 3 {
+		t.Fatalf("got %d instances, want 3", len(instances))
+	}
+
+	if len(f.KeyPairs) != 1 {
+		t.Errorf("got %d key pairs, want a single ephemeral key pair", len(f.KeyPairs))
+	}
+
+	templateNames := make(map[string]bool)
+	for _, instance := range instances {
+		if *instance.AMIID != "ami-new" {
+			t.Errorf("got AMI %s, want ami-new", *instance.AMIID)
+		}
+		if *instance.SubnetID != "subnet-private" {
+			t.Errorf("got subnet %s, want subnet-private", *instance.SubnetID)
+		}
+		if _, ok := f.KeyPairs[*instance.KeyName]; !ok {
+			t.Errorf("instance uses unknown key pair %s", *instance.KeyName)
+		}
+		templateNames[*instance.LaunchTemplateName] = true
+	}
+
+	if len(templateNames) != len(instances) {
+		t.Errorf("instances share launch template names: %v", templateNames)
+	}
+}
+
+func TestInstancesInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(opts *InstanceOptions)
+	}{
+		{"unknown capacity strategy", func(opts *InstanceOptions) { opts.CapacityStrategy = "spot-maybe" }},
+		{"spot retries not below fleet retries", func(opts *InstanceOptions) {
+			opts.CapacityStrategy = CapacityStrategySpotThenOnDemand
+			opts.MaxSpotRetries = opts.CreateFleetRetries
+		}},
+		{"unknown connect via", func(opts *InstanceOptions) { opts.ConnectVia = "carrier-pigeon" }},
+		{"negative max cost", func(opts *InstanceOptions) { opts.MaxCost = -1 }},
+		{"max cost detached", func(opts *InstanceOptions) { opts.MaxCost = 1; opts.Detach = true }},
+		{"attach several", func(opts *InstanceOptions) { opts.Attach = true; opts.Count = 2 }},
+		{"missing jump identity file", func(opts *InstanceOptions) {
+			opts.JumpHosts = []string{"jump@bastion"}
+			opts.JumpIdentityFile = "/nonexistent/id_ed25519"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, f := newTestClient()
+			opts := testInstanceOptions(client)
+			tt.configure(&opts)
+
+			if _, err := opts.Instances(); err == nil {
+				t.Fatal("expected an error")
+			}
+			if len(f.KeyPairs) != 0 {
+				t.Errorf("invalid options left %d key pairs behind", len(f.KeyPairs))
+			}
+		})
+	}
+}
+
+func TestInstancesSSMRejectsTransfers(t *testing.T) {
+	client, _ := newTestClient()
+
+	opts := testInstanceOptions(client)
+	opts.ConnectVia = ConnectViaSSM
+	opts.Uploads = []string{"project:/tmp/project"}
+
+	if _, err := opts.Instances(); err == nil {
+		t.Fatal("expected an error uploading files when connecting via ssm")
+	}
+}
+
+// testInstanceOptions returns options resolving against the fixtures in newTestClient
+func testInstanceOptions(client *Client) InstanceOptions {
+	return InstanceOptions{
+		Client:             client,
+		AMI:                "amzn2-ami-hvm*",
+		Subnet:             "qa-private",
+		SecurityGroups:     []string{"qa_private"},
+		Count:              1,
+		SSHPort:            22,
+		User:               "ec2-user",
+		ConnectVia:         ConnectViaPrivateIP,
+		InstanceTypes:      []string{"t2.micro", "t2.small"},
+		CreateFleetRetries: 3,
+		LaunchTemplateName: "ec2-cli",
+		CapacityStrategy:   CapacityStrategySpotOnly,
+		MaxSpotRetries:     1,
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package ec2
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/cenkalti/backoff"
+)
+
+func TestMain(m *testing.M) {
+	// Don't wait between fleet requests
+	fleetBackOff = func() backoff.BackOff {
+		return &backoff.ZeroBackOff{}
+	}
+	cleanupBackOff = func() backoff.BackOff {
+		return backoff.WithMaxRetries(&backoff.ZeroBackOff{}, 2)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestInstance returns a single instance resolved against the fake EC2 API
+func newTestInstance(t *testing.T, client *Client, configure func(opts *InstanceOptions)) *Instance {
+	opts := testInstanceOptions(client)
+	if configure != nil {
+		configure(&opts)
+	}
+
+	instances, err := opts.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return instances[0]
+}
+
+func TestStartInstanceSpot(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, nil)
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(instance.Lifecycle) != "spot" {
+		t.Errorf("got lifecycle %s, want spot", aws.StringValue(instance.Lifecycle))
+	}
+	if aws.StringValue(instance.SpotPrice) != f.SpotPrice {
+		t.Errorf("got spot price %s, want %s", aws.StringValue(instance.SpotPrice), f.SpotPrice)
+	}
+	if aws.StringValue(instance.SelectedInstanceType) != "t2.micro" {
+		t.Errorf("got instance type %s, want t2.micro", aws.StringValue(instance.SelectedInstanceType))
+	}
+	if instance.InstanceID == nil || instance.PrivateIPAddress == nil {
+		t.Fatal("instance ID and private IP should be set once started")
+	}
+	if len(f.FleetRequests) != 1 {
+		t.Errorf("got %d fleet requests, want 1", len(f.FleetRequests))
+	}
+}
+
+func TestStartInstanceRetriesFleetRequests(t *testing.T) {
+	client, f := newTestClient()
+	f.FleetFailures = 2
+	instance := newTestInstance(t, client, nil)
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.FleetRequests) != 3 {
+		t.Errorf("got %d fleet requests, want 3", len(f.FleetRequests))
+	}
+}
+
+func TestStartInstanceExhaustsFleetRetries(t *testing.T) {
+	client, f := newTestClient()
+	f.SpotCapacity = false
+	instance := newTestInstance(t, client, nil)
+
+	if err := instance.StartInstance(); err == nil {
+		t.Fatal("expected an error when spot capacity is never available")
+	}
+
+	// the initial request plus one for each retry
+	if want := int(*instance.CreateFleetRetries) + 1; len(f.FleetRequests) != want {
+		t.Errorf("got %d fleet requests, want %d", len(f.FleetRequests), want)
+	}
+	for _, request := range f.FleetRequests {
+		if capacityType := aws.StringValue(request.TargetCapacitySpecification.DefaultTargetCapacityType); capacityType != "spot" {
+			t.Errorf("spot-only strategy requested %s capacity", capacityType)
+		}
+	}
+}
+
+func TestStartInstanceFallsBackToOnDemand(t *testing.T) {
+	client, f := newTestClient()
+	f.SpotCapacity = false
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.CapacityStrategy = CapacityStrategySpotThenOnDemand
+		opts.MaxSpotRetries = 2
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(instance.Lifecycle) != "on-demand" {
+		t.Errorf("got lifecycle %s, want on-demand", aws.StringValue(instance.Lifecycle))
+	}
+	if instance.SpotPrice != nil {
+		t.Errorf("on-demand instance should not have a spot price, got %s", *instance.SpotPrice)
+	}
+
+	var capacityTypes []string
+	for _, request := range f.FleetRequests {
+		capacityTypes = append(capacityTypes, aws.StringValue(request.TargetCapacitySpecification.DefaultTargetCapacityType))
+	}
+	if want := []string{"spot", "spot", "on-demand"}; !equalStrings(capacityTypes, want) {
+		t.Errorf("got fleet requests %v, want %v", capacityTypes, want)
+	}
+
+	versions := f.LaunchTemplates[*instance.LaunchTemplateName]
+	if len(versions) != 2 {
+		t.Fatalf("got %d launch template versions, want 2", len(versions))
+	}
+	if versions[1].InstanceMarketOptions != nil {
+		t.Error("on-demand launch template version should not have spot market options")
+	}
+}
+
+func TestStartInstanceOnDemandOnly(t *testing.T) {
+	client, f := newTestClient()
+	f.SpotCapacity = false
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.CapacityStrategy = CapacityStrategyOnDemandOnly
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if aws.StringValue(instance.Lifecycle) != "on-demand" {
+		t.Errorf("got lifecycle %s, want on-demand", aws.StringValue(instance.Lifecycle))
+	}
+	if len(f.FleetRequests) != 1 {
+		t.Errorf("got %d fleet requests, want 1", len(f.FleetRequests))
+	}
+	if f.LaunchTemplates[*instance.LaunchTemplateName][0].InstanceMarketOptions != nil {
+		t.Error("on-demand launch template should not have spot market options")
+	}
+}
+
+func TestStartInstanceTagsInstance(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Tags = []string{"Name=Hello World"}
+		opts.Command = "make test"
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	launched := f.Instances[*instance.InstanceID]
+	tags := make(map[string]string)
+	for _, tag := range launched.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	if tags["Name"] != "Hello World" || tags[TagRunID] != *instance.RunID || tags[TagExpires] == "" {
+		t.Errorf("unexpected instance tags %v", launched.Tags)
+	}
+	if tags[TagCommand] != "make test" || tags[TagUser] != localUser() || tags[TagHost] != localHost() {
+		t.Errorf("unexpected instance tags %v", launched.Tags)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, nil)
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != "shutting-down" {
+		t.Errorf("got instance state %s, want shutting-down", state)
+	}
+
+	instance.DeleteLaunchTemplate()
+	if _, ok := f.LaunchTemplates[*instance.LaunchTemplateName]; ok {
+		t.Error("launch template should have been deleted")
+	}
+
+	instance.DestroyKeyPair()
+	if _, ok := f.KeyPairs[*instance.KeyName]; ok {
+		t.Error("key pair should have been destroyed")
+	}
+}
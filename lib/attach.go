@@ -0,0 +1,54 @@
+package ec2
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// attachTerminal connects the local terminal to the session: it requests a PTY the size of
+// the local terminal, puts the local terminal in raw mode and forwards window size changes.
+// Call restore once the session ends to return the local terminal to its previous state.
+func attachTerminal(session *ssh.Session) (restore func(), err error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("attaching requires stdin to be a terminal")
+	}
+
+	width, height, err := terminal.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm-256color"
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(term, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	stop := forwardWindowChanges(session, fd)
+
+	return func() {
+		stop()
+		terminal.Restore(fd, state)
+	}, nil
+}
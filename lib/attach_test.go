@@ -0,0 +1,50 @@
+package ec2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildCommandAttachOpensShell(t *testing.T) {
+	client, _ := newTestClient()
+
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Attach = true
+		opts.Command = ""
+	})
+	if command := instance.buildCommand(nil); !strings.HasPrefix(command, "exec ") {
+		t.Errorf("attaching without a command should open a shell, got %q", command)
+	}
+
+	instance = newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Attach = true
+		opts.Command = "top"
+	})
+	if command := instance.buildCommand(nil); command != "top" {
+		t.Errorf("got %q, want the command alone", command)
+	}
+}
+
+func TestInstancesAttachRequiresSingleSSHInstance(t *testing.T) {
+	client, _ := newTestClient()
+
+	tests := []struct {
+		name      string
+		configure func(opts *InstanceOptions)
+	}{
+		{"several instances", func(opts *InstanceOptions) { opts.Count = 2 }},
+		{"ssm", func(opts *InstanceOptions) { opts.ConnectVia = ConnectViaSSM }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testInstanceOptions(client)
+			opts.Attach = true
+			tt.configure(&opts)
+
+			if _, err := opts.Instances(); err == nil {
+				t.Fatal("expected an error attaching")
+			}
+		})
+	}
+}
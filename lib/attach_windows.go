@@ -0,0 +1,42 @@
+// +build windows
+
+package ec2
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// windowPollInterval is how often the console size is checked, Windows has no SIGWINCH
+const windowPollInterval = 500 * time.Millisecond
+
+// forwardWindowChanges resizes the session's PTY whenever the console is resized until the
+// returned function is called
+func forwardWindowChanges(session *ssh.Session, fd int) (stop func()) {
+	width, height, _ := terminal.GetSize(fd)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(windowPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				w, h, err := terminal.GetSize(fd)
+				if err != nil || (w == width && h == height) {
+					continue
+				}
+				width, height = w, h
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
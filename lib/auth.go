@@ -0,0 +1,181 @@
+package ec2
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase for protected identity
+// files. When it's not set the passphrase is prompted for.
+const PassphraseEnv = "EC2_RUNNER_SSH_PASSPHRASE"
+
+// publicKeyAuth offers each signer followed by the keys in the local SSH agent, if
+// SSH_AUTH_SOCK is set. Everything is offered from a single method as the SSH client only
+// tries each method once. An unreachable agent is skipped.
+func publicKeyAuth(signers []ssh.Signer) ssh.AuthMethod {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return ssh.PublicKeys(signers...)
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		agentSigners, err := listAgentSigners(socket)
+		if err != nil {
+			Log.Debugf("Not offering keys from the SSH agent: %s", err)
+			return signers, nil
+		}
+		return append(append([]ssh.Signer{}, signers...), agentSigners...), nil
+	})
+}
+
+// agentSigner signs with a key held by the SSH agent. The agent is only connected to for as
+// long as a request takes so no connection outlives the SSH handshake.
+type agentSigner struct {
+	socket string
+	key    ssh.PublicKey
+}
+
+// listAgentSigners returns a signer for each key in the SSH agent listening on socket
+func listAgentSigners(socket string) ([]ssh.Signer, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to SSH agent: %s", err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list SSH agent keys: %s", err)
+	}
+
+	var signers []ssh.Signer
+	for _, key := range keys {
+		signers = append(signers, &agentSigner{socket: socket, key: key})
+	}
+	return signers, nil
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to SSH agent: %s", err)
+	}
+	defer conn.Close()
+
+	// the agent has its own entropy source so rand is not used
+	return agent.NewClient(conn).Sign(s.key, data)
+}
+
+// readIdentityFile parses a private key, decrypting it with the passphrase from
+// EC2_RUNNER_SSH_PASSPHRASE or the terminal when it's protected
+func readIdentityFile(identityFile string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read identity-file %s: %s", identityFile, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		passphrase, err := readPassphrase(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decrypt identity-file %s: %s", identityFile, err)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse identity-file %s: %s", identityFile, err)
+	}
+
+	return signer, nil
+}
+
+// readPassphrase returns the passphrase for an identity file
+func readPassphrase(identityFile string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(passphrase), nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return nil, fmt.Errorf("identity-file %s is protected by a passphrase. Set %s to use it without a terminal", identityFile, PassphraseEnv)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", identityFile)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read passphrase: %s", err)
+	}
+	return passphrase, nil
+}
+
+// newED25519Key generates an ed25519 key and returns its signer and its private key encoded
+// in the OpenSSH format
+func newED25519Key() (ssh.Signer, []byte, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signer, marshalED25519PrivateKey(public, private), nil
+}
+
+// marshalED25519PrivateKey encodes an unencrypted ed25519 key in the OpenSSH private key
+// format read by ssh -i
+func marshalED25519PrivateKey(public ed25519.PublicKey, private ed25519.PrivateKey) []byte {
+	publicKey := ssh.Marshal(struct {
+		KeyType string
+		Public  []byte
+	}{ssh.KeyAlgoED25519, public})
+
+	var check [4]byte
+	rand.Read(check[:])
+
+	block := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Public  []byte
+		Private []byte
+		Comment string
+	}{binary.BigEndian.Uint32(check[:]), binary.BigEndian.Uint32(check[:]), ssh.KeyAlgoED25519, public, private, ""})
+
+	// pad the private block to the cipher block size
+	for i := byte(1); len(block)%8 != 0; i++ {
+		block = append(block, i)
+	}
+
+	key := append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PublicKey    []byte
+		PrivateBlock []byte
+	}{"none", "none", "", 1, publicKey, block})...)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: key})
+}
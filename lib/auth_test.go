@@ -0,0 +1,211 @@
+package ec2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestNewKeyPairImportsPublicKey(t *testing.T) {
+	client, f := newTestClient()
+
+	name, signer, _, err := newKeyPair(client, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("got %s key, want %s", signer.PublicKey().Type(), ssh.KeyAlgoED25519)
+	}
+
+	imported, ok := f.KeyPairs[*name]
+	if !ok {
+		t.Fatalf("key pair %s was not imported", *name)
+	}
+	if *imported.KeyFingerprint != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Errorf("got imported fingerprint %s, want %s", *imported.KeyFingerprint, ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+}
+
+func TestMarshalED25519PrivateKey(t *testing.T) {
+	signer, privateKey, err := newED25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssh.FingerprintSHA256(parsed.PublicKey()) != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Error("parsed private key does not match the generated key")
+	}
+}
+
+func TestReadIdentityFileWithPassphrase(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityFile, err := ioutil.TempFile("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(identityFile.Name())
+	identityFile.Write(pem.EncodeToMemory(block))
+	identityFile.Close()
+
+	defer os.Unsetenv(PassphraseEnv)
+
+	os.Setenv(PassphraseEnv, "wrong")
+	if _, err := readIdentityFile(identityFile.Name()); err == nil {
+		t.Error("expected an error decrypting with the wrong passphrase")
+	}
+
+	os.Setenv(PassphraseEnv, "hunter2")
+	signer, err := readIdentityFile(identityFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		t.Errorf("got %s key, want %s", signer.PublicKey().Type(), ssh.KeyAlgoRSA)
+	}
+}
+
+// handshake authenticates auth against a server accepting only key
+func handshake(t *testing.T, auth ssh.AuthMethod, key ssh.PublicKey) error {
+	hostKey, _, err := newED25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, offered ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(offered.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer server.Close()
+		ssh.NewServerConn(server, config)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, _, _, err := ssh.NewClientConn(client, "instance", &ssh.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+func TestPublicKeyAuthSkipsUnreachableAgent(t *testing.T) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", "/nonexistent/agent.sock")
+
+	signer, _, err := newED25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, publicKeyAuth([]ssh.Signer{signer}), signer.PublicKey()); err != nil {
+		t.Errorf("expected to authenticate with the identity, got %s", err)
+	}
+}
+
+func TestPublicKeyAuthClosesAgentConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var open int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&open, 1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				atomic.AddInt32(&open, -1)
+			}()
+		}
+	}()
+
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", socket)
+
+	if err := handshake(t, publicKeyAuth(nil), signer.PublicKey()); err != nil {
+		t.Fatalf("expected to authenticate with the agent's key, got %s", err)
+	}
+
+	for i := 0; atomic.LoadInt32(&open) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d connections to the agent are still open", atomic.LoadInt32(&open))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package ec2
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// BidPriceError is returned when the current spot price of every instance type exceeds its
+// bid, so no spot instance could be launched
+type BidPriceError struct {
+	// Prices are the current spot prices of the instance types
+	Prices map[string]float64
+	// Bids are the bids of the instance types
+	Bids map[string]float64
+}
+
+func (e *BidPriceError) Error() string {
+	var types []string
+	for instanceType := range e.Bids {
+		types = append(types, instanceType)
+	}
+	sort.Strings(types)
+
+	var exceeded []string
+	for _, instanceType := range types {
+		exceeded = append(exceeded, fmt.Sprintf("%s is $%g/hour, bid $%g", instanceType, e.Prices[instanceType], e.Bids[instanceType]))
+	}
+	return fmt.Sprintf("current spot prices exceed the bid for every instance type: %s", strings.Join(exceeded, ", "))
+}
+
+// ParseBidPrices returns the bid of each instance type given as InstanceType=Price
+func (opts *InstanceOptions) ParseBidPrices() (map[string]float64, error) {
+	if opts.BidPrice < 0 {
+		return nil, errors.New("the bid price can not be negative")
+	}
+
+	bids := make(map[string]float64)
+	for _, bid := range opts.BidPrices {
+		s := strings.SplitN(bid, "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("unable to derive bid price from: %s", bid)
+		}
+		price, err := strconv.ParseFloat(s[1], 64)
+		if err != nil || price <= 0 {
+			return nil, fmt.Errorf("invalid bid price for %s: %s", s[0], s[1])
+		}
+		if !containsInstanceType(opts.InstanceTypes, s[0]) {
+			return nil, fmt.Errorf("bid price given for %s which is not one of the instance types", s[0])
+		}
+		bids[s[0]] = price
+	}
+
+	if (opts.BidPrice > 0 || len(bids) > 0) && opts.CapacityStrategy == CapacityStrategyOnDemandOnly {
+		return nil, errors.New("bid prices only apply to spot instances and can not be used with the on-demand-only capacity strategy")
+	}
+
+	return bids, nil
+}
+
+func containsInstanceType(instanceTypes []string, instanceType string) bool {
+	for _, t := range instanceTypes {
+		if t == instanceType {
+			return true
+		}
+	}
+	return false
+}
+
+// bidPrice returns the most the instance type may cost an hour as a spot instance, or zero
+// for the on-demand price, which is what AWS caps spot prices at
+func (instance *Instance) bidPrice(instanceType string) float64 {
+	if bid, ok := instance.BidPrices[instanceType]; ok {
+		return bid
+	}
+	if instance.BidPrice != nil {
+		return *instance.BidPrice
+	}
+	return 0
+}
+
+// hasBids reports whether any instance type has a bid
+func (instance *Instance) hasBids() bool {
+	for _, instanceType := range *instance.InstanceTypes {
+		if instance.bidPrice(instanceType) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBidPrice formats a bid as EC2 expects a max price
+func formatBidPrice(bid float64) *string {
+	return aws.String(strconv.FormatFloat(bid, 'f', -1, 64))
+}
+
+// availabilityZone returns the zone of the subnet
+func availabilityZone(client *Client, subnetID *string) (string, error) {
+	subnets, err := client.EC2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{subnetID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to describe subnet %s: %s", aws.StringValue(subnetID), err)
+	}
+	if len(subnets.Subnets) == 0 {
+		return "", fmt.Errorf("Subnet %s does not exist", aws.StringValue(subnetID))
+	}
+	return aws.StringValue(subnets.Subnets[0].AvailabilityZone), nil
+}
+
+// spotPrices returns the current Linux spot price of each instance type in the zone
+func spotPrices(client *Client, availabilityZone string, instanceTypes []string) (map[string]float64, error) {
+	history, err := client.EC2.DescribeSpotPriceHistory(&ec2.DescribeSpotPriceHistoryInput{
+		AvailabilityZone:    aws.String(availabilityZone),
+		InstanceTypes:       aws.StringSlice(instanceTypes),
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe spot prices: %s", err)
+	}
+
+	prices := make(map[string]float64)
+	for _, price := range history.SpotPriceHistory {
+		value, err := strconv.ParseFloat(aws.StringValue(price.SpotPrice), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse spot price %s: %s", aws.StringValue(price.SpotPrice), err)
+		}
+		prices[aws.StringValue(price.InstanceType)] = value
+	}
+	return prices, nil
+}
+
+// marketPrice returns the current spot price of the instance's type in its zone
+func (instance *Instance) marketPrice() (*float64, error) {
+	zone, err := availabilityZone(instance.Client, instance.SubnetID)
+	if err != nil {
+		return nil, err
+	}
+	prices, err := spotPrices(instance.Client, zone, []string{*instance.SelectedInstanceType})
+	if err != nil {
+		return nil, err
+	}
+	price, ok := prices[*instance.SelectedInstanceType]
+	if !ok {
+		return nil, fmt.Errorf("no spot price for %s in %s", *instance.SelectedInstanceType, zone)
+	}
+	return &price, nil
+}
+
+// checkBidPrices returns a *BidPriceError when the current spot price of every instance type
+// in the subnet's zone exceeds its bid. Instance types without a bid or a known price could be
+// launched.
+func (opts *InstanceOptions) checkBidPrices(subnetID *string, bids map[string]float64) error {
+	if opts.CapacityStrategy == CapacityStrategyOnDemandOnly || (opts.BidPrice == 0 && len(bids) == 0) {
+		return nil
+	}
+
+	zone, err := availabilityZone(opts.Client, subnetID)
+	if err != nil {
+		return err
+	}
+	prices, err := spotPrices(opts.Client, zone, opts.InstanceTypes)
+	if err != nil {
+		return err
+	}
+
+	exceeded := make(map[string]float64)
+	for _, instanceType := range opts.InstanceTypes {
+		bid, ok := bids[instanceType]
+		if !ok {
+			bid = opts.BidPrice
+		}
+		price, ok := prices[instanceType]
+		if bid == 0 || !ok || price <= bid {
+			return nil
+		}
+		exceeded[instanceType] = bid
+	}
+
+	return &BidPriceError{Prices: prices, Bids: exceeded}
+}
@@ -0,0 +1,121 @@
+package ec2
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestBidPricesSetMaxPrices(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.BidPrice = 0.01
+		opts.BidPrices = []string{"t2.small=0.02"}
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := f.LaunchTemplates[*instance.LaunchTemplateName][0]
+	if got := aws.StringValue(data.InstanceMarketOptions.SpotOptions.MaxPrice); got != "0.01" {
+		t.Errorf("got launch template max price %q, want 0.01", got)
+	}
+
+	overrides := f.FleetRequests[0].LaunchTemplateConfigs[0].Overrides
+	want := map[string]string{"t2.micro": "0.01", "t2.small": "0.02"}
+	for _, override := range overrides {
+		if got := aws.StringValue(override.MaxPrice); got != want[aws.StringValue(override.InstanceType)] {
+			t.Errorf("got max price %q for %s, want %s", got, aws.StringValue(override.InstanceType), want[aws.StringValue(override.InstanceType)])
+		}
+	}
+}
+
+func TestBidPriceExceededFailsFast(t *testing.T) {
+	client, f := newTestClient()
+	opts := testInstanceOptions(client)
+	opts.BidPrice = 0.001
+
+	_, err := opts.Instances()
+	if _, ok := err.(*BidPriceError); !ok {
+		t.Fatalf("got %v, want a BidPriceError", err)
+	}
+	if len(f.KeyPairs) != 0 || len(f.LaunchTemplates) != 0 || len(f.FleetRequests) != 0 {
+		t.Errorf("created %d key pairs, %d launch templates and %d fleet requests, want none", len(f.KeyPairs), len(f.LaunchTemplates), len(f.FleetRequests))
+	}
+}
+
+func TestBidPriceExceededSwitchesToOnDemand(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.BidPrice = 0.001
+		opts.CapacityStrategy = CapacityStrategySpotThenOnDemand
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.FleetRequests) != 1 {
+		t.Fatalf("got %d fleet requests, want 1", len(f.FleetRequests))
+	}
+	if got := aws.StringValue(f.FleetRequests[0].TargetCapacitySpecification.DefaultTargetCapacityType); got != "on-demand" {
+		t.Errorf("got capacity type %s, want on-demand", got)
+	}
+	if data := f.LaunchTemplates[*instance.LaunchTemplateName][0]; data.InstanceMarketOptions != nil {
+		t.Errorf("got launch template market options %v, want none", data.InstanceMarketOptions)
+	}
+}
+
+func TestBidPriceMetByOneInstanceType(t *testing.T) {
+	client, f := newTestClient()
+	f.CurrentSpotPrices["t2.small"] = "0.000500"
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.BidPrice = 0.001
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(instance.Lifecycle) != "spot" {
+		t.Errorf("got lifecycle %s, want spot", aws.StringValue(instance.Lifecycle))
+	}
+}
+
+func TestParseBidPrices(t *testing.T) {
+	tests := []struct {
+		name     string
+		bid      float64
+		bids     []string
+		strategy string
+		wantErr  bool
+	}{
+		{name: "per instance type", bids: []string{"t2.micro=0.01"}},
+		{name: "negative bid", bid: -1, wantErr: true},
+		{name: "malformed", bids: []string{"t2.micro"}, wantErr: true},
+		{name: "not a price", bids: []string{"t2.micro=cheap"}, wantErr: true},
+		{name: "unknown instance type", bids: []string{"m5.large=0.1"}, wantErr: true},
+		{name: "on-demand only", bid: 0.01, strategy: CapacityStrategyOnDemandOnly, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := InstanceOptions{
+				InstanceTypes:    []string{"t2.micro", "t2.small"},
+				BidPrice:         tt.bid,
+				BidPrices:        tt.bids,
+				CapacityStrategy: CapacityStrategySpotOnly,
+			}
+			if tt.strategy != "" {
+				opts.CapacityStrategy = tt.strategy
+			}
+
+			bids, err := opts.ParseBidPrices()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && bids["t2.micro"] != 0.01 {
+				t.Errorf("got bids %v", bids)
+			}
+		})
+	}
+}
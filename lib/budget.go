@@ -0,0 +1,108 @@
+package ec2
+
+import (
+	"errors"
+	"time"
+)
+
+// budgetPollInterval is how often the projected spend of a run is checked against its budget
+var budgetPollInterval = 30 * time.Second
+
+// ErrOverBudget is returned instead of launching or running anything more once the run has
+// exceeded its maximum cost
+var ErrOverBudget = errors.New("the run exceeded its maximum cost")
+
+// ProjectedCost returns what the instances will have cost in USD once those still running
+// have run for ahead longer. Instances whose price is unknown are left out.
+func ProjectedCost(instances []*Instance, ahead time.Duration) float64 {
+	var total float64
+	for _, instance := range instances {
+		cost, err := instance.projectedCost(ahead)
+		if err != nil {
+			Log.Debugf("%s", err)
+			continue
+		}
+		total += cost
+	}
+	return total
+}
+
+// projectedCost returns what the instance will have cost once it has run for ahead longer,
+// if it is still running
+func (instance *Instance) projectedCost(ahead time.Duration) (float64, error) {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+
+	cost, err := instance.cost()
+	if err != nil {
+		return 0, err
+	}
+	if instance.LaunchTime != nil && instance.TerminationTime == nil {
+		price, _ := instance.price()
+		cost += price * ahead.Hours()
+	}
+	return cost, nil
+}
+
+// WatchBudget checks the spend of the instances until stop is closed. Once the spend projected
+// for the next check exceeds max, every instance is told to stop. Each instance's worker
+// terminates it with TerminateIfOverBudget, so nothing is terminated while it's relaunched.
+// The returned channel is closed once watching stops.
+func WatchBudget(max float64, instances []*Instance, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(budgetPollInterval):
+			}
+
+			projected := ProjectedCost(instances, budgetPollInterval)
+			Log.Debugf("Projected spend is %s of %s", formatCost(projected), formatCost(max))
+			if projected <= max {
+				continue
+			}
+
+			Log.Errorf("Projected spend of %s exceeds the maximum cost of %s. Terminating instances", formatCost(projected), formatCost(max))
+			for _, instance := range instances {
+				instance.exceedBudget()
+			}
+			return
+		}
+	}()
+
+	return done
+}
+
+// exceedBudget tells the instance's worker the run is over budget
+func (instance *Instance) exceedBudget() {
+	instance.overBudgetOnce.Do(func() {
+		if instance.overBudget != nil {
+			close(instance.overBudget)
+		}
+	})
+}
+
+// stopped returns ErrOverBudget once the run has exceeded its maximum cost, or ErrStopped
+// once it has been stopped
+func (instance *Instance) stopped() error {
+	select {
+	case <-instance.overBudget:
+		return ErrOverBudget
+	default:
+	}
+	return stopped(instance.stop)
+}
+
+// TerminateIfOverBudget terminates the instance, even one kept with --no-terminate, once the
+// run has exceeded its maximum cost. It's called by the instance's own worker.
+func (instance *Instance) TerminateIfOverBudget() error {
+	if instance.stopped() != ErrOverBudget || instance.InstanceID == nil {
+		return nil
+	}
+	instance.OverBudget = true
+	return instance.Terminate()
+}
@@ -0,0 +1,112 @@
+package ec2
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestProjectedCost(t *testing.T) {
+	now := time.Now()
+	running := &Instance{
+		SelectedInstanceType: aws.String("t2.micro"),
+		Lifecycle:            aws.String("spot"),
+		SpotPrice:            aws.String("1"),
+		LaunchTime:           aws.Time(now.Add(-time.Hour)),
+	}
+	terminated := &Instance{
+		SelectedInstanceType: aws.String("t2.micro"),
+		Lifecycle:            aws.String("spot"),
+		SpotPrice:            aws.String("2"),
+		LaunchTime:           aws.Time(now.Add(-time.Hour)),
+		TerminationTime:      aws.Time(now.Add(-30 * time.Minute)),
+	}
+	pending := &Instance{}
+
+	got := ProjectedCost([]*Instance{running, terminated, pending}, 30*time.Minute)
+	// 1.5 hours of the running instance and half an hour of the terminated one
+	if math.Abs(got-2.5) > 0.001 {
+		t.Errorf("got %f, want 2.5", got)
+	}
+}
+
+// TestWatchBudgetStopsWorker runs the watcher alongside a worker, for go test -race to check
+func TestWatchBudgetStopsWorker(t *testing.T) {
+	defer func(interval time.Duration) { budgetPollInterval = interval }(budgetPollInterval)
+	budgetPollInterval = time.Millisecond
+	ssmPollInterval = 0
+
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "sleep infinity"
+		opts.NoTermination = true
+	})
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances["i-00000000000000001"] = true
+	ssmFake.Status = ssm.CommandInvocationStatusInProgress
+
+	stop := make(chan struct{})
+	defer close(stop)
+	watching := WatchBudget(0.00001, []*Instance{instance}, stop)
+
+	// the budget may be exceeded at any step, each stops the worker as the run's workers do
+	worker := make(chan error)
+	go func() {
+		err := instance.Start()
+		if err == nil {
+			err = instance.WaitForConnection()
+		}
+		if err == nil {
+			err = instance.InvokeCommand()
+		}
+		if terminateErr := instance.TerminateIfOverBudget(); terminateErr != nil {
+			err = terminateErr
+		}
+		worker <- err
+	}()
+
+	select {
+	case err := <-worker:
+		if err != ErrOverBudget && !strings.HasSuffix(fmt.Sprint(err), ErrOverBudget.Error()) {
+			t.Fatalf("got %v, want %v", err, ErrOverBudget)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the budget was not enforced")
+	}
+	<-watching
+
+	if !instance.OverBudget {
+		t.Error("instance should be marked over budget")
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != "shutting-down" {
+		t.Errorf("got state %s, want shutting-down", state)
+	}
+	if err := instance.Relaunch(); err != ErrOverBudget {
+		t.Errorf("relaunching over budget got %v, want %v", err, ErrOverBudget)
+	}
+}
+
+func TestInstancesMaxCostValidation(t *testing.T) {
+	client, _ := newTestClient()
+
+	opts := testInstanceOptions(client)
+	opts.MaxCost = -1
+	if _, err := opts.Instances(); err == nil {
+		t.Error("expected an error for a negative maximum cost")
+	}
+
+	opts = testInstanceOptions(client)
+	opts.MaxCost = 1
+	opts.Detach = true
+	opts.Command = "make test"
+	if _, err := opts.Instances(); err == nil {
+		t.Error("expected an error for a maximum cost when detaching")
+	}
+}
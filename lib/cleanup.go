@@ -0,0 +1,182 @@
+package ec2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/cenkalti/backoff"
+)
+
+// cleanupBackOff returns the backoff used between attempts to remove a resource
+var cleanupBackOff = func() backoff.BackOff {
+	return backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 4)
+}
+
+// ErrStopped is returned instead of creating a resource once the run has been stopped
+var ErrStopped = errors.New("the run was stopped")
+
+// stopped returns ErrStopped once stop is closed. A nil stop never closes.
+func stopped(stop <-chan struct{}) error {
+	select {
+	case <-stop:
+		return ErrStopped
+	default:
+		return nil
+	}
+}
+
+// Cleanup removes the resources created by a run. Each resource is registered as soon as it
+// is created so it is removed however the run ends. Removing a resource is idempotent: once
+// removed it is never removed again, and failed removals are retried. Resources registered
+// once Run has started are removed straight away, as nothing would remove them later.
+//
+// A nil Cleanup registers nothing and removes resources immediately.
+type Cleanup struct {
+	mu        sync.Mutex
+	run       sync.Mutex
+	started   bool
+	resources []*cleanupResource
+}
+
+type cleanupResource struct {
+	name    string
+	remove  func() error
+	removed bool
+}
+
+// CleanupError lists the resources that could not be removed
+type CleanupError struct {
+	Resources []string
+}
+
+func (e *CleanupError) Error() string {
+	return fmt.Sprintf("unable to clean up %s. Run 'ec2 reap' once they expire or remove them manually", strings.Join(e.Resources, ", "))
+}
+
+// NewCleanup returns an empty Cleanup
+func NewCleanup() *Cleanup {
+	return &Cleanup{}
+}
+
+// Register adds a resource to remove with remove. Registering a name again keeps the first.
+func (c *Cleanup) Register(name string, remove func() error) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.find(name) != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.resources = append(c.resources, &cleanupResource{name: name, remove: remove})
+	started := c.started
+	c.mu.Unlock()
+
+	// Failed removals are retried by the next Run
+	if started {
+		Log.Warnf("Removing %s created while cleaning up", name)
+		if err := c.Remove(name, remove); err != nil {
+			Log.Errorf("%s", err)
+		}
+	}
+}
+
+// Remove removes a resource now with remove, unless it has already been removed
+func (c *Cleanup) Remove(name string, remove func() error) error {
+	if c == nil {
+		return retryRemove(name, remove)
+	}
+
+	c.mu.Lock()
+	resource := c.find(name)
+	if resource == nil {
+		resource = &cleanupResource{name: name}
+		c.resources = append(c.resources, resource)
+	}
+	if resource.removed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	if err := retryRemove(name, remove); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	resource.removed = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Run removes every resource not yet removed, newest first. It returns a *CleanupError naming
+// every resource that could not be removed. Running it again only retries those.
+func (c *Cleanup) Run() error {
+	if c == nil {
+		return nil
+	}
+
+	// A signal may arrive while the run is cleaning up after itself
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	c.mu.Lock()
+	c.started = true
+	resources := make([]*cleanupResource, len(c.resources))
+	copy(resources, c.resources)
+	c.mu.Unlock()
+
+	var failed []string
+	for i := len(resources) - 1; i >= 0; i-- {
+		resource := resources[i]
+		if resource.remove == nil {
+			continue
+		}
+		if err := c.Remove(resource.name, resource.remove); err != nil {
+			Log.Errorf("%s", err)
+			failed = append(failed, resource.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &CleanupError{Resources: failed}
+	}
+	return nil
+}
+
+// find returns the registered resource with the given name, or nil. c.mu must be held.
+func (c *Cleanup) find(name string) *cleanupResource {
+	for _, resource := range c.resources {
+		if resource.name == name {
+			return resource
+		}
+	}
+	return nil
+}
+
+// retryRemove calls remove until it succeeds or the backoff gives up. Resources that no
+// longer exist count as removed.
+func retryRemove(name string, remove func() error) error {
+	err := backoff.Retry(func() error {
+		if err := remove(); err != nil && !isNotFound(err) {
+			return err
+		}
+		return nil
+	}, cleanupBackOff())
+	if err != nil {
+		return fmt.Errorf("Unable to remove %s: %s", name, err)
+	}
+	return nil
+}
+
+// isNotFound reports whether an AWS error says the resource does not exist
+func isNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return strings.Contains(awsErr.Code(), "NotFound")
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package ec2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCleanupRunRemovesNewestFirstOnce(t *testing.T) {
+	cleanup := NewCleanup()
+
+	var removed []string
+	for _, name := range []string{"key pair", "launch template", "instance"} {
+		name := name
+		cleanup.Register(name, func() error {
+			removed = append(removed, name)
+			return nil
+		})
+	}
+
+	if err := cleanup.Remove("launch template", func() error {
+		removed = append(removed, "launch template")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := cleanup.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"launch template", "instance", "key pair"}; !equalStrings(removed, want) {
+		t.Errorf("got removals %v, want %v", removed, want)
+	}
+}
+
+func TestCleanupRunRetriesFailures(t *testing.T) {
+	cleanup := NewCleanup()
+
+	var attempts int
+	failures := 5
+	cleanup.Register("instance i-1", func() error {
+		attempts++
+		if failures > 0 {
+			failures--
+			return errors.New("RequestLimitExceeded")
+		}
+		return nil
+	})
+	cleanup.Register("launch template gone", func() error {
+		return awserr.New("InvalidLaunchTemplateName.NotFoundException", "gone", nil)
+	})
+
+	err := cleanup.Run()
+	cleanupErr, ok := err.(*CleanupError)
+	if !ok {
+		t.Fatalf("got %v, want a CleanupError", err)
+	}
+	if want := []string{"instance i-1"}; !equalStrings(cleanupErr.Resources, want) {
+		t.Errorf("got leftovers %v, want %v", cleanupErr.Resources, want)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+
+	if err := cleanup.Run(); err != nil {
+		t.Errorf("retrying the cleanup should remove the instance: %s", err)
+	}
+}
+
+func TestCleanupRemovesRunResources(t *testing.T) {
+	for _, noTermination := range []bool{false, true} {
+		client, f := newTestClient()
+		cleanup := NewCleanup()
+		instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+			opts.Cleanup = cleanup
+			opts.NoTermination = noTermination
+		})
+		if err := instance.StartInstance(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cleanup.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := ec2.InstanceStateNameShuttingDown
+		if noTermination {
+			want = ec2.InstanceStateNameRunning
+		}
+		if state := *f.Instances[*instance.InstanceID].State.Name; state != want {
+			t.Errorf("no-terminate %t: got instance state %s, want %s", noTermination, state, want)
+		}
+		if _, ok := f.LaunchTemplates[*instance.LaunchTemplateName]; ok {
+			t.Errorf("no-terminate %t: launch template should have been deleted", noTermination)
+		}
+		if _, ok := f.KeyPairs[*instance.KeyName]; ok {
+			t.Errorf("no-terminate %t: key pair should have been destroyed", noTermination)
+		}
+	}
+}
+
+func TestCleanupRemovesResourcesRegisteredAfterRun(t *testing.T) {
+	cleanup := NewCleanup()
+	if err := cleanup.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var removed int
+	cleanup.Register("instance i-late", func() error {
+		removed++
+		return nil
+	})
+	if removed != 1 {
+		t.Fatalf("resource registered after Run was removed %d times, want 1", removed)
+	}
+
+	if err := cleanup.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("resource was removed %d times, want 1", removed)
+	}
+}
+
+func TestStoppedRunCreatesNothing(t *testing.T) {
+	client, f := newTestClient()
+	stop := make(chan struct{})
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Stop = stop
+	})
+	close(stop)
+
+	if err := instance.StartInstance(); err != ErrStopped {
+		t.Errorf("got %v, want %v", err, ErrStopped)
+	}
+	if len(f.LaunchTemplates) != 0 || len(f.Instances) != 0 {
+		t.Errorf("stopped run created %d launch templates and %d instances", len(f.LaunchTemplates), len(f.Instances))
+	}
+
+	opts := testInstanceOptions(client)
+	opts.Stop = stop
+	keyPairs := len(f.KeyPairs)
+	if _, err := opts.Instances(); err != ErrStopped {
+		t.Errorf("got %v, want %v", err, ErrStopped)
+	}
+	if len(f.KeyPairs) != keyPairs {
+		t.Error("stopped run created a key pair")
+	}
+}
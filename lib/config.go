@@ -0,0 +1,106 @@
+package ec2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds named profiles of options shared between runs
+type Config struct {
+	Version  int                `yaml:"version"`
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Profile is a named set of options. A profile inherits every option it doesn't define from
+// the profile named by Inherits.
+type Profile struct {
+	Inherits string     `yaml:"inherits,omitempty"`
+	Options  JobOptions `yaml:",inline"`
+}
+
+// DefaultConfigPath returns $XDG_CONFIG_HOME/ec2-runner/config.yaml, or
+// ~/.config/ec2-runner/config.yaml when XDG_CONFIG_HOME is not set
+func DefaultConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("Unable to find the config file: %s", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "ec2-runner", "config.yaml"), nil
+}
+
+// LoadConfig reads the config file. A missing file is an empty config.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &Config{Version: JobVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config %s: %s", filename, err)
+	}
+
+	var config Config
+	mapping, errs := decodeYAML(data, &config)
+	if mapping != nil {
+		errs = append(errs, validateVersion(mapping)...)
+		if profiles := jobValue(mapping, "profiles"); profiles != nil && profiles.Kind == yaml.MappingNode {
+			for i := 1; i < len(profiles.Content); i += 2 {
+				if profiles.Content[i].Kind == yaml.MappingNode {
+					errs = append(errs, validateOptions(profiles.Content[i])...)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &JobError{File: filename, Errors: errs}
+	}
+
+	return &config, nil
+}
+
+// ProfileNames returns the name of every profile in order
+func (config *Config) ProfileNames() []string {
+	var names []string
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile returns the options of a profile merged with those of the profiles it inherits
+func (config *Config) Profile(name string) (JobOptions, error) {
+	var chain []string
+	options := JobOptions{}
+
+	for name != "" {
+		for _, seen := range chain {
+			if seen == name {
+				return JobOptions{}, fmt.Errorf("profile %s inherits itself: %s", chain[0], strings.Join(append(chain, name), " -> "))
+			}
+		}
+		chain = append(chain, name)
+
+		profile, ok := config.Profiles[name]
+		if !ok {
+			if len(chain) == 1 {
+				return JobOptions{}, fmt.Errorf("no profile named %s", name)
+			}
+			return JobOptions{}, fmt.Errorf("profile %s inherits unknown profile %s", chain[len(chain)-2], name)
+		}
+
+		options = options.merge(profile.Options)
+		name = profile.Inherits
+	}
+
+	return options, nil
+}
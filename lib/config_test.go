@@ -0,0 +1,129 @@
+package ec2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a config file to a temporary directory and returns its path. The
+// caller removes the directory.
+func writeTestConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfigProfileInheritance(t *testing.T) {
+	filename := writeTestConfig(t, `version: 1
+profiles:
+  base:
+    instance-profile: runner
+    ami-filters: [owner-alias=amazon]
+    instance-types: [t2.micro]
+  qa:
+    inherits: base
+    subnet-filters: [tag:Environment=qa]
+    security-groups: [qa_private]
+  qa-large:
+    inherits: qa
+    instance-types: [m5.large]
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := config.Profile("qa-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *options.IamInstanceProfile != "runner" {
+		t.Errorf("got instance profile %s, want runner", *options.IamInstanceProfile)
+	}
+	if !equalStrings(options.SubnetFilter, []string{"tag:Environment=qa"}) {
+		t.Errorf("got subnet filters %v", options.SubnetFilter)
+	}
+	if !equalStrings(options.InstanceTypes, []string{"m5.large"}) {
+		t.Errorf("child profile should override inherited options, got instance types %v", options.InstanceTypes)
+	}
+
+	var opts InstanceOptions
+	options.Apply(&opts, func(string) bool { return false })
+	if opts.IamInstanceProfile != "runner" || !equalStrings(opts.SecurityGroups, []string{"qa_private"}) {
+		t.Errorf("profile was not applied, got %+v", opts)
+	}
+
+	if got := config.ProfileNames(); !equalStrings(got, []string{"base", "qa", "qa-large"}) {
+		t.Errorf("got profiles %v", got)
+	}
+}
+
+func TestConfigProfileErrors(t *testing.T) {
+	filename := writeTestConfig(t, `version: 1
+profiles:
+  loop-a:
+    inherits: loop-b
+  loop-b:
+    inherits: loop-a
+  orphan:
+    inherits: missing
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"loop-a":  "inherits itself",
+		"orphan":  "inherits unknown profile missing",
+		"missing": "no profile named missing",
+	} {
+		if _, err := config.Profile(name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v for %s, want it to contain %q", err, name, want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	filename := writeTestConfig(t, `version: 1
+profiles:
+  qa:
+    subnets: [qa]
+    connect-via: telepathy
+`)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	_, err := LoadConfig(filename)
+	jobErr, ok := err.(*JobError)
+	if !ok {
+		t.Fatalf("got %v, want a JobError", err)
+	}
+	if len(jobErr.Errors) != 2 || !strings.HasPrefix(jobErr.Errors[0], "line 4:") || !strings.HasPrefix(jobErr.Errors[1], "line 5:") {
+		t.Errorf("got errors %q", jobErr.Errors)
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	config, err := LoadConfig(filepath.Join(os.TempDir(), "does-not-exist", "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Profiles) != 0 {
+		t.Errorf("got profiles %v, want none", config.Profiles)
+	}
+}
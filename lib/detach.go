@@ -0,0 +1,181 @@
+package ec2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// detachPollInterval is how often a detached command is checked for completion
+var detachPollInterval = 10 * time.Second
+
+// remoteRunDir returns the directory on the instance holding a detached command's output,
+// process ID and exit code
+func remoteRunDir(runID string) string {
+	return "/tmp/ec2-runner-" + runID
+}
+
+// detachedCommand returns a shell command starting command in its own session so it keeps
+// running after the SSH connection closes. Its output goes to output.log in dir, the process ID
+// of the wrapper waiting on it to pid and, once it finishes, its exit code to exit-code. The
+// command leads a session of its own, whose ID goes to job-pid, so it can be stopped without
+// stopping the wrapper that records its exit code.
+func detachedCommand(command, dir string, timeout time.Duration) string {
+	job := "sh -c " + shellQuote(command)
+	if timeout > 0 {
+		job = fmt.Sprintf("timeout %d %s", int(timeout.Seconds()), job)
+	}
+
+	// the exit code is written atomically so it's never read half written
+	wrapper := fmt.Sprintf("setsid %s & echo $! > %s/job-pid; wait $!; echo $? > %s/exit-code.tmp && mv %s/exit-code.tmp %s/exit-code",
+		job, dir, dir, dir, dir)
+
+	return fmt.Sprintf("mkdir -p %s && { setsid nohup sh -c %s > %s/output.log 2>&1 < /dev/null & echo $! > %s/pid; }",
+		dir, shellQuote(wrapper), dir, dir)
+}
+
+// startDetached starts the command in the background and leaves it running on the instance
+func (instance *Instance) startDetached(session *ssh.Session, command string) error {
+	dir := remoteRunDir(*instance.RunID)
+
+	output, err := session.CombinedOutput(detachedCommand(command, dir, *instance.Timeout))
+	if err != nil {
+		return fmt.Errorf("Unable to start detached command: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	instance.Detached = true
+	Log.Infof("Detached command on %s, writing output to %s/output.log", *instance.InstanceID, dir)
+	return nil
+}
+
+// FollowLogs prints the output of a detached command. When follow is set it keeps printing
+// output until the command finishes.
+func (instance *Instance) FollowLogs(follow bool) error {
+	client, err := instance.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("unable to launch SSH session: %s", err)
+	}
+	defer session.Close()
+
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	dir := remoteRunDir(*instance.RunID)
+	command := fmt.Sprintf("cat %s/output.log", dir)
+	if follow {
+		command = fmt.Sprintf("tail -n +1 -F --pid=$(cat %s/pid) %s/output.log 2>/dev/null", dir, dir)
+	}
+
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("Unable to read output of run %s: %s", *instance.RunID, err)
+	}
+	return nil
+}
+
+// detachedStatus returns the exit code of a detached command, or -1 while it's still running
+func (instance *Instance) detachedStatus(client *ssh.Client) (int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, fmt.Errorf("unable to launch SSH session: %s", err)
+	}
+	defer session.Close()
+
+	dir := remoteRunDir(*instance.RunID)
+	output, _ := session.Output(fmt.Sprintf("cat %s/exit-code 2>/dev/null || { kill -0 $(cat %s/pid) 2>/dev/null && echo running; }", dir, dir))
+
+	status := strings.TrimSpace(string(output))
+	switch status {
+	case "running":
+		return -1, nil
+	case "":
+		return -1, errors.New("detached command is no longer running and left no exit code")
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return -1, fmt.Errorf("unable to parse exit code %q: %s", status, err)
+	}
+	return code, nil
+}
+
+// WaitDetached waits for a detached command to finish and records its exit code
+func (instance *Instance) WaitDetached() error {
+	client, err := instance.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		code, err := instance.detachedStatus(client)
+		if err != nil {
+			return err
+		}
+		if code >= 0 {
+			*instance.ExitCode = code
+			if *instance.Timeout > 0 && code == TimeoutExitCode {
+				instance.TimedOut = true
+			}
+			return nil
+		}
+		time.Sleep(detachPollInterval)
+	}
+}
+
+// StopDetached stops a detached command and every process it started, then waits for its exit
+// code to be recorded
+func (instance *Instance) StopDetached() error {
+	client, err := instance.dial()
+	if err != nil {
+		return err
+	}
+
+	// the command leads its own session, which includes processes in other process groups but
+	// not the wrapper recording its exit code
+	dir := remoteRunDir(*instance.RunID)
+	err = runRemote(client, fmt.Sprintf("[ -f %s/exit-code ] || pkill -TERM -s $(cat %s/job-pid)", dir, dir))
+	client.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to stop run %s: %s", *instance.RunID, err)
+	}
+
+	return instance.WaitDetached()
+}
+
+// CompleteDetached downloads the files of a finished detached command and terminates the
+// instance, unless it's kept with --no-terminate
+func (instance *Instance) CompleteDetached() error {
+	// the run's summary reports its cost
+	instance.resolveOnDemandPrice()
+
+	var downloadErr error
+	if len(instance.Downloads) > 0 {
+		client, err := instance.dial()
+		if err != nil {
+			return err
+		}
+		downloadErr = instance.Download(client, instance.Downloads)
+		client.Close()
+	}
+
+	// the run that detached skipped the instance when cleaning up, so it's removed here
+	instance.Detached = false
+	if err := retryRemove(instanceResource(*instance.InstanceID), instance.cleanupInstance); err != nil {
+		if downloadErr != nil {
+			Log.Errorf("%s", downloadErr)
+		}
+		return err
+	}
+	return downloadErr
+}
@@ -0,0 +1,337 @@
+package ec2
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunStateRoundTrip(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Detach = true
+		opts.Downloads = []string{"/tmp/results:results"}
+		opts.Timeout = time.Hour
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	hostKey := newTestHostKey(t)
+	instance.hostKeys.pinned = hostKey
+
+	state, err := instance.RunState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(state.Downloads[0].Local) {
+		t.Errorf("download path %s should be absolute", state.Downloads[0].Local)
+	}
+
+	dir, err := ioutil.TempDir("", "ec2-runner-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "runs")
+
+	if err := state.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(runStatePath(dir, state.RunID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got state file mode %s, want 0600", info.Mode().Perm())
+	}
+
+	loaded, err := LoadRunState(dir, state.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reattached, err := loaded.Instance(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *reattached.InstanceID != *instance.InstanceID || reattached.host() != instance.host() {
+		t.Errorf("got instance %s at %s, want %s at %s", *reattached.InstanceID, reattached.host(), *instance.InstanceID, instance.host())
+	}
+	if *reattached.Timeout != time.Hour {
+		t.Errorf("got timeout %s, want 1h", *reattached.Timeout)
+	}
+	if err := reattached.sshConfig.HostKeyCallback("instance", nil, hostKey); err != nil {
+		t.Errorf("recorded host key should be trusted: %s", err)
+	}
+	if err := reattached.sshConfig.HostKeyCallback("instance", nil, newTestHostKey(t)); err == nil {
+		t.Error("a different host key should be refused")
+	}
+
+	if err := loaded.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRunState(dir, state.RunID); err == nil {
+		t.Error("expected an error loading a removed run")
+	}
+}
+
+func TestDetachedCommand(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "ec2-runner-detach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "run")
+
+	command := detachedCommand("echo 'hello world' && exit 3", dir, 0)
+	if err := exec.Command("sh", "-c", command).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var code []byte
+	for i := 0; i < 100; i++ {
+		if code, err = ioutil.ReadFile(filepath.Join(dir, "exit-code")); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if strings.TrimSpace(string(code)) != "3" {
+		t.Errorf("got exit code %q, want 3", code)
+	}
+
+	output, err := ioutil.ReadFile(filepath.Join(dir, "output.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "hello world\n" {
+		t.Errorf("got output %q", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pid")); err != nil {
+		t.Errorf("pid should have been recorded: %s", err)
+	}
+
+	if command := detachedCommand("sleep 60", dir, 90*time.Second); !strings.Contains(command, "timeout 90 sh -c") {
+		t.Errorf("timeout should wrap the command, got %q", command)
+	}
+}
+
+func TestStopDetachedTerminatesInstance(t *testing.T) {
+	for _, name := range []string{"setsid", "pkill"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not available", name)
+		}
+	}
+	defer func(interval time.Duration) { detachPollInterval = interval }(detachPollInterval)
+	detachPollInterval = 50 * time.Millisecond
+
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Detach = true
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteRunDir(*instance.RunID))
+
+	port := startExecHost(t)
+	instance.PrivateIPAddress = aws.String("127.0.0.1")
+	instance.SSHPort = aws.Int(port)
+	instance.sshConfig = &ssh.ClientConfig{
+		User:            "ec2-user",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	sshClient, err := instance.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := sshClient.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.startDetached(session, "sleep 60")
+	sshClient.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the job records its process ID once it has started
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join(remoteRunDir(*instance.RunID), "job-pid")); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := instance.StopDetached(); err != nil {
+		t.Fatal(err)
+	}
+	if *instance.ExitCode <= 0 {
+		t.Errorf("got exit code %d, want the code of a stopped command", *instance.ExitCode)
+	}
+
+	if err := instance.CompleteDetached(); err != nil {
+		t.Fatal(err)
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != ec2.InstanceStateNameShuttingDown {
+		t.Errorf("got instance state %s, stopped runs should be terminated", state)
+	}
+}
+
+// startExecHost starts an SSH server on localhost that runs commands with the local shell and
+// returns its port
+func startExecHost(t *testing.T) int {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveExecConn(conn, config)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func serveExecConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+
+				cmd := exec.Command("sh", "-c", payload.Command)
+				cmd.Stdout = channel
+				cmd.Stderr = channel.Stderr()
+				status := struct{ Status uint32 }{}
+				if err := cmd.Run(); err != nil {
+					status.Status = 1
+					if exitErr, ok := err.(*exec.ExitError); ok {
+						status.Status = uint32(exitErr.ExitCode())
+					}
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(&status))
+				return
+			}
+		}()
+	}
+}
+
+func TestCleanupKeepsDetachedInstances(t *testing.T) {
+	client, f := newTestClient()
+	cleanup := NewCleanup()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Cleanup = cleanup
+		opts.Detach = true
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	instance.Detached = true
+
+	if err := cleanup.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != ec2.InstanceStateNameRunning {
+		t.Errorf("got instance state %s, detached instances should be left running", state)
+	}
+
+	if err := instance.CompleteDetached(); err != nil {
+		t.Fatal(err)
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != ec2.InstanceStateNameShuttingDown {
+		t.Errorf("got instance state %s, completed runs should be terminated", state)
+	}
+}
+
+func TestInstancesDetachValidation(t *testing.T) {
+	client, _ := newTestClient()
+
+	tests := []struct {
+		name      string
+		configure func(opts *InstanceOptions)
+	}{
+		{"several instances", func(opts *InstanceOptions) { opts.Count = 2 }},
+		{"ssm", func(opts *InstanceOptions) { opts.ConnectVia = ConnectViaSSM }},
+		{"attach", func(opts *InstanceOptions) { opts.Attach = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testInstanceOptions(client)
+			opts.Detach = true
+			tt.configure(&opts)
+
+			if _, err := opts.Instances(); err == nil {
+				t.Fatal("expected an error detaching")
+			}
+		})
+	}
+}
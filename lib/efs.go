@@ -0,0 +1,220 @@
+package ec2
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"golang.org/x/crypto/ssh"
+)
+
+// nfsPort is the port EFS mount targets serve NFS on
+const nfsPort = 2049
+
+// EFSMount is an EFS file system and where it is mounted on the instance
+type EFSMount struct {
+	FileSystem    string
+	Path          string
+	FileSystemID  string
+	MountTargetIP string
+}
+
+func (mount EFSMount) String() string {
+	if mount.FileSystemID == "" {
+		return fmt.Sprintf("%s:%s", mount.FileSystem, mount.Path)
+	}
+	return fmt.Sprintf("%s:%s", mount.FileSystemID, mount.Path)
+}
+
+// parseEFSMounts parses 'name-or-id:/mount/path' pairs
+func parseEFSMounts(specs []string) ([]EFSMount, error) {
+	var mounts []EFSMount
+	for _, spec := range specs {
+		s := strings.SplitN(spec, ":", 2)
+		if len(s) != 2 || s[0] == "" || !path.IsAbs(s[1]) {
+			return nil, fmt.Errorf("unable to derive EFS file system and absolute mount path from: %s", spec)
+		}
+		mounts = append(mounts, EFSMount{FileSystem: s[0], Path: path.Clean(s[1])})
+	}
+	return mounts, nil
+}
+
+// DetermineEFSMounts resolves each file system by name or ID and the mount target in the
+// subnet's availability zone, and checks the mount target's security groups allow NFS from
+// the instance
+func (opts *InstanceOptions) DetermineEFSMounts(mounts []EFSMount, subnetID *string, securityGroupIDs []*string) ([]EFSMount, error) {
+	if len(mounts) == 0 {
+		return nil, nil
+	}
+
+	subnets, err := opts.Client.EC2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{subnetID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe subnet %s: %s", aws.StringValue(subnetID), err)
+	}
+	if len(subnets.Subnets) == 0 {
+		return nil, fmt.Errorf("subnet %s not found", aws.StringValue(subnetID))
+	}
+	subnet := subnets.Subnets[0]
+
+	var resolved []EFSMount
+	for _, mount := range mounts {
+		fileSystemID, err := opts.determineFileSystemID(mount.FileSystem)
+		if err != nil {
+			return nil, err
+		}
+		mount.FileSystemID = fileSystemID
+
+		targets, err := opts.Client.EFS.DescribeMountTargets(&efs.DescribeMountTargetsInput{
+			FileSystemId: aws.String(fileSystemID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to describe mount targets of %s: %s", fileSystemID, err)
+		}
+
+		var target *efs.MountTargetDescription
+		for _, t := range targets.MountTargets {
+			if aws.StringValue(t.LifeCycleState) != efs.LifeCycleStateAvailable {
+				continue
+			}
+			if aws.StringValue(t.AvailabilityZoneName) == aws.StringValue(subnet.AvailabilityZone) || aws.StringValue(t.SubnetId) == aws.StringValue(subnet.SubnetId) {
+				target = t
+				break
+			}
+		}
+		if target == nil {
+			return nil, fmt.Errorf("EFS file system %s has no available mount target in %s", fileSystemID, aws.StringValue(subnet.AvailabilityZone))
+		}
+		mount.MountTargetIP = aws.StringValue(target.IpAddress)
+
+		if err := opts.checkMountTargetReachable(target, subnet, securityGroupIDs); err != nil {
+			return nil, err
+		}
+
+		resolved = append(resolved, mount)
+	}
+
+	return resolved, nil
+}
+
+// determineFileSystemID returns the ID of a file system given its ID or Name tag
+func (opts *InstanceOptions) determineFileSystemID(fileSystem string) (string, error) {
+	if strings.HasPrefix(fileSystem, "fs-") {
+		result, err := opts.Client.EFS.DescribeFileSystems(&efs.DescribeFileSystemsInput{
+			FileSystemId: aws.String(fileSystem),
+		})
+		if err != nil {
+			return "", fmt.Errorf("Unable to find EFS file system %s: %s", fileSystem, err)
+		}
+		if len(result.FileSystems) == 0 {
+			return "", fmt.Errorf("EFS file system %s not found", fileSystem)
+		}
+		return aws.StringValue(result.FileSystems[0].FileSystemId), nil
+	}
+
+	input := &efs.DescribeFileSystemsInput{}
+	for {
+		result, err := opts.Client.EFS.DescribeFileSystems(input)
+		if err != nil {
+			return "", fmt.Errorf("Unable to find EFS file system %s: %s", fileSystem, err)
+		}
+
+		for _, fs := range result.FileSystems {
+			if aws.StringValue(fs.Name) == fileSystem {
+				return aws.StringValue(fs.FileSystemId), nil
+			}
+		}
+
+		if result.NextMarker == nil {
+			break
+		}
+		input.Marker = result.NextMarker
+	}
+
+	return "", fmt.Errorf("no EFS file system named %s", fileSystem)
+}
+
+// checkMountTargetReachable returns an error unless a security group of the mount target
+// allows NFS from one of the instance's security groups or from the instance's subnet
+func (opts *InstanceOptions) checkMountTargetReachable(target *efs.MountTargetDescription, subnet *ec2.Subnet, securityGroupIDs []*string) error {
+	targetGroups, err := opts.Client.EFS.DescribeMountTargetSecurityGroups(&efs.DescribeMountTargetSecurityGroupsInput{
+		MountTargetId: target.MountTargetId,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe security groups of mount target %s: %s", aws.StringValue(target.MountTargetId), err)
+	}
+
+	groups, err := opts.Client.EC2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: targetGroups.SecurityGroups,
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to describe security groups of mount target %s: %s", aws.StringValue(target.MountTargetId), err)
+	}
+
+	_, subnetCIDR, _ := net.ParseCIDR(aws.StringValue(subnet.CidrBlock))
+
+	for _, group := range groups.SecurityGroups {
+		for _, permission := range group.IpPermissions {
+			if !allowsNFS(permission) {
+				continue
+			}
+			for _, pair := range permission.UserIdGroupPairs {
+				for _, id := range securityGroupIDs {
+					if aws.StringValue(pair.GroupId) == aws.StringValue(id) {
+						return nil
+					}
+				}
+			}
+			for _, ipRange := range permission.IpRanges {
+				_, cidr, err := net.ParseCIDR(aws.StringValue(ipRange.CidrIp))
+				if err != nil || subnetCIDR == nil {
+					continue
+				}
+				ones, _ := cidr.Mask.Size()
+				subnetOnes, _ := subnetCIDR.Mask.Size()
+				if cidr.Contains(subnetCIDR.IP) && ones <= subnetOnes {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fmt.Errorf("security groups of EFS mount target %s do not allow NFS (port %d) from the instance's security groups or subnet", aws.StringValue(target.MountTargetId), nfsPort)
+}
+
+// allowsNFS reports whether an ingress rule covers TCP port 2049
+func allowsNFS(permission *ec2.IpPermission) bool {
+	switch aws.StringValue(permission.IpProtocol) {
+	case "-1":
+		return true
+	case "tcp", "6":
+		return aws.Int64Value(permission.FromPort) <= nfsPort && aws.Int64Value(permission.ToPort) >= nfsPort
+	}
+	return false
+}
+
+// mountCommand returns the shell command mounting the file system as root. The EFS mount
+// helper is used when amazon-efs-utils is installed, otherwise NFS to the mount target IP.
+func (mount EFSMount) mountCommand() string {
+	mountPath := shellQuote(mount.Path)
+	return fmt.Sprintf(
+		"mkdir -p %s && if command -v mount.efs >/dev/null 2>&1; then mount -t efs -o tls %s:/ %s; else mount -t nfs4 -o nfsvers=4.1,rsize=1048576,wsize=1048576,hard,timeo=600,retrans=2,noresvport %s:/ %s; fi",
+		mountPath, shellQuote(mount.FileSystemID), mountPath, shellQuote(mount.MountTargetIP), mountPath,
+	)
+}
+
+// MountEFS mounts every EFS file system on the instance
+func (instance *Instance) MountEFS(client *ssh.Client) error {
+	for _, mount := range instance.EFSMounts {
+		Log.Infof("Mounting EFS %s at %s", mount.FileSystemID, mount.Path)
+		if err := runRemote(client, "sudo sh -c "+shellQuote(mount.mountCommand())); err != nil {
+			return fmt.Errorf("Unable to mount EFS %s at %s: %s", mount.FileSystemID, mount.Path, err)
+		}
+	}
+	return nil
+}
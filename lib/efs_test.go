@@ -0,0 +1,143 @@
+package ec2
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+// newTestEFSClient returns a test client with a file system named shared that has a mount
+// target in each subnet's availability zone. Its security group allows NFS from qa_private.
+func newTestEFSClient() (*Client, *fake.EC2, *fake.EFS) {
+	client, f := newTestClient()
+	efsFake := client.EFS.(*fake.EFS)
+
+	efsFake.FileSystems = []*efs.FileSystemDescription{
+		{FileSystemId: aws.String("fs-12345678"), Name: aws.String("shared")},
+	}
+	efsFake.MountTargets = []*efs.MountTargetDescription{
+		{MountTargetId: aws.String("fsmt-a"), FileSystemId: aws.String("fs-12345678"), AvailabilityZoneName: aws.String("us-east-1a"), IpAddress: aws.String("10.0.0.200"), LifeCycleState: aws.String(efs.LifeCycleStateAvailable)},
+		{MountTargetId: aws.String("fsmt-b"), FileSystemId: aws.String("fs-12345678"), AvailabilityZoneName: aws.String("us-east-1b"), IpAddress: aws.String("10.0.1.200"), LifeCycleState: aws.String(efs.LifeCycleStateAvailable)},
+	}
+	efsFake.MountTargetSecurityGroups["fsmt-a"] = []string{"sg-efs"}
+	efsFake.MountTargetSecurityGroups["fsmt-b"] = []string{"sg-efs"}
+
+	f.SecurityGroups = append(f.SecurityGroups, &ec2.SecurityGroup{
+		GroupId:   aws.String("sg-efs"),
+		GroupName: aws.String("efs"),
+		IpPermissions: []*ec2.IpPermission{
+			{
+				IpProtocol:       aws.String("tcp"),
+				FromPort:         aws.Int64(2049),
+				ToPort:           aws.Int64(2049),
+				UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String("sg-private")}},
+			},
+		},
+	})
+
+	return client, f, efsFake
+}
+
+func TestParseEFSMounts(t *testing.T) {
+	mounts, err := parseEFSMounts([]string{"shared:/mnt/shared/", "fs-12345678:/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounts[0].FileSystem != "shared" || mounts[0].Path != "/mnt/shared" {
+		t.Errorf("got %+v", mounts[0])
+	}
+	if mounts[1].FileSystem != "fs-12345678" || mounts[1].Path != "/data" {
+		t.Errorf("got %+v", mounts[1])
+	}
+
+	for _, spec := range []string{"shared", ":/mnt", "shared:mnt"} {
+		if _, err := parseEFSMounts([]string{spec}); err == nil {
+			t.Errorf("expected an error parsing %s", spec)
+		}
+	}
+}
+
+func TestDetermineEFSMounts(t *testing.T) {
+	client, _, _ := newTestEFSClient()
+
+	for _, fileSystem := range []string{"shared", "fs-12345678"} {
+		t.Run(fileSystem, func(t *testing.T) {
+			instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+				opts.EFS = []string{fileSystem + ":/mnt/shared"}
+			})
+
+			if len(instance.EFSMounts) != 1 {
+				t.Fatalf("got %d mounts, want 1", len(instance.EFSMounts))
+			}
+			mount := instance.EFSMounts[0]
+			if mount.FileSystemID != "fs-12345678" {
+				t.Errorf("got file system %s, want fs-12345678", mount.FileSystemID)
+			}
+			// qa-private is in us-east-1b
+			if mount.MountTargetIP != "10.0.1.200" {
+				t.Errorf("got mount target %s, want 10.0.1.200", mount.MountTargetIP)
+			}
+			if command := mount.mountCommand(); !strings.Contains(command, "'10.0.1.200':/ '/mnt/shared'") {
+				t.Errorf("unexpected mount command %s", command)
+			}
+		})
+	}
+}
+
+func TestDetermineEFSMountsErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(f *fake.EC2, efsFake *fake.EFS)
+		efs       string
+	}{
+		{name: "unknown name", efs: "missing:/mnt"},
+		{name: "unknown id", efs: "fs-00000000:/mnt"},
+		{
+			name: "no mount target in availability zone",
+			efs:  "shared:/mnt",
+			configure: func(f *fake.EC2, efsFake *fake.EFS) {
+				efsFake.MountTargets = efsFake.MountTargets[:1]
+			},
+		},
+		{
+			name: "nfs not allowed",
+			efs:  "shared:/mnt",
+			configure: func(f *fake.EC2, efsFake *fake.EFS) {
+				f.SecurityGroups[len(f.SecurityGroups)-1].IpPermissions[0].FromPort = aws.Int64(22)
+				f.SecurityGroups[len(f.SecurityGroups)-1].IpPermissions[0].ToPort = aws.Int64(22)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, f, efsFake := newTestEFSClient()
+			if tt.configure != nil {
+				tt.configure(f, efsFake)
+			}
+
+			opts := testInstanceOptions(client)
+			opts.EFS = []string{tt.efs}
+			if _, err := opts.Instances(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCheckMountTargetReachableFromSubnet(t *testing.T) {
+	client, f, _ := newTestEFSClient()
+	f.SecurityGroups[len(f.SecurityGroups)-1].IpPermissions[0].UserIdGroupPairs = nil
+	f.SecurityGroups[len(f.SecurityGroups)-1].IpPermissions[0].IpRanges = []*ec2.IpRange{{CidrIp: aws.String("10.0.0.0/16")}}
+
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.EFS = []string{"shared:/mnt/shared"}
+	})
+	if len(instance.EFSMounts) != 1 {
+		t.Fatalf("got %d mounts, want 1", len(instance.EFSMounts))
+	}
+}
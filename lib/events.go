@@ -0,0 +1,137 @@
+package ec2
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lifecycle events emitted for each instance
+const (
+	// EventFleetRequested is emitted before each fleet request
+	EventFleetRequested = "fleet-requested"
+	// EventInstanceRunning is emitted once the instance is running
+	EventInstanceRunning = "instance-running"
+	// EventSSHReady is emitted once the instance accepts SSH connections
+	EventSSHReady = "ssh-ready"
+	// EventSSMReady is emitted once the instance's SSM agent is online
+	EventSSMReady = "ssm-ready"
+	// EventCommandStarted is emitted when the command starts
+	EventCommandStarted = "command-started"
+	// EventCommandExited is emitted when the command finishes, is killed or the instance is
+	// interrupted
+	EventCommandExited = "command-exited"
+	// EventTerminated is emitted once the instance is terminated
+	EventTerminated = "terminated"
+	// EventLog carries a log message when log messages share the stream with events
+	EventLog = "log"
+	// EventStderr carries a line the command wrote to stderr when it shares the stream with
+	// events
+	EventStderr = "stderr"
+)
+
+// Event describes a step in the lifecycle of an instance
+type Event struct {
+	Time             time.Time `json:"time"`
+	Type             string    `json:"event"`
+	RunID            string    `json:"run-id,omitempty"`
+	Index            int       `json:"index"`
+	InstanceID       string    `json:"instance-id,omitempty"`
+	CapacityType     string    `json:"capacity-type,omitempty"`
+	Attempt          int       `json:"attempt,omitempty"`
+	InstanceType     string    `json:"instance-type,omitempty"`
+	Lifecycle        string    `json:"lifecycle,omitempty"`
+	SpotPrice        string    `json:"spot-price,omitempty"`
+	PrivateIPAddress string    `json:"private-ip,omitempty"`
+	PublicIPAddress  string    `json:"public-ip,omitempty"`
+	Command          string    `json:"command,omitempty"`
+	Detached         bool      `json:"detached,omitempty"`
+	ExitCode         *int      `json:"exit-code,omitempty"`
+	TimedOut         bool      `json:"timed-out,omitempty"`
+	Interrupted      bool      `json:"interrupted,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	Level            string    `json:"level,omitempty"`
+	Message          string    `json:"message,omitempty"`
+}
+
+// Events writes lifecycle events as JSON lines. Events from every instance are written to the
+// same stream, one complete line at a time.
+//
+// A nil Events discards every event.
+type Events struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewEvents returns Events writing to w
+func NewEvents(w io.Writer) *Events {
+	return &Events{enc: json.NewEncoder(w)}
+}
+
+// Emit writes the event, stamped with the current time unless it has one
+func (e *Events) Emit(event Event) error {
+	if e == nil {
+		return nil
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(event)
+}
+
+// eventWriter emits each line written to it as the message of an event
+type eventWriter struct {
+	events *Events
+	event  Event
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		event := w.event
+		event.Message = line
+		if err := w.events.Emit(event); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// emit writes an event about the instance
+func (instance *Instance) emit(event Event) {
+	if instance.Events == nil {
+		return
+	}
+
+	event.RunID = stringPointerValueOrNil(instance.RunID, "")
+	event.Index = instance.Index
+	if event.InstanceID == "" {
+		event.InstanceID = stringPointerValueOrNil(instance.InstanceID, "")
+	}
+	instance.Events.Emit(event)
+}
+
+// emitCommandExited writes how the command ended
+func (instance *Instance) emitCommandExited(err error) {
+	event := Event{
+		Type:        EventCommandExited,
+		TimedOut:    instance.TimedOut,
+		Interrupted: instance.Interrupted,
+	}
+	if instance.ExitCode != nil && *instance.ExitCode >= 0 {
+		exitCode := *instance.ExitCode
+		event.ExitCode = &exitCode
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	instance.emit(event)
+}
@@ -0,0 +1,139 @@
+package ec2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestEventsLifecycle(t *testing.T) {
+	ssmPollInterval = 0
+
+	var buf bytes.Buffer
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "echo hello"
+		opts.Events = NewEvents(&buf)
+	})
+
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	ssmFake.ResponseCode = 3
+
+	if err := instance.WaitForConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.InvokeCommand(); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event %q: %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+		if event.RunID != *instance.RunID || event.Time.IsZero() {
+			t.Errorf("event %s is missing its run ID or time: %+v", event.Type, event)
+		}
+	}
+	want := []string{EventFleetRequested, EventInstanceRunning, EventSSMReady, EventCommandStarted, EventCommandExited, EventTerminated}
+	if !equalStrings(types, want) {
+		t.Fatalf("got events %v, want %v", types, want)
+	}
+
+	if running := events[1]; running.InstanceID != *instance.InstanceID || running.Lifecycle != "spot" || running.InstanceType == "" {
+		t.Errorf("unexpected instance-running event %+v", running)
+	}
+	if started := events[3]; started.Command != "echo hello" {
+		t.Errorf("got command %q, want echo hello", started.Command)
+	}
+	if exited := events[4]; exited.ExitCode == nil || *exited.ExitCode != 3 {
+		t.Errorf("unexpected command-exited event %+v", exited)
+	}
+}
+
+func TestNilEventsDiscards(t *testing.T) {
+	var events *Events
+	if err := events.Emit(Event{Type: EventTerminated}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventsShareStderrWithLogsAndCommand(t *testing.T) {
+	ssmPollInterval = 0
+
+	var buf bytes.Buffer
+	events := NewEvents(&buf)
+	defer func(l *Logger) { Log = l }(Log)
+	Log = NewLogger(&buf, LevelInfo)
+	Log.Events = events
+
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "make test"
+		opts.Events = events
+		opts.StderrEvents = true
+	})
+	if err := instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	ssmFake.Stderr = "warning: deprecated\nno tests to run"
+
+	if err := instance.WaitForConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.InvokeCommand(); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(Log.Writer(LevelInfo), "Instance  Exit code\n1         0")
+
+	var logs, stderr []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line is not an event: %q", scanner.Text())
+		}
+		switch event.Type {
+		case EventLog:
+			if event.Level != "info" {
+				t.Errorf("got log level %s, want info", event.Level)
+			}
+			logs = append(logs, event.Message)
+		case EventStderr:
+			if event.InstanceID != *instance.InstanceID || event.Index != 1 {
+				t.Errorf("stderr event is missing the instance: %+v", event)
+			}
+			stderr = append(stderr, event.Message)
+		}
+	}
+
+	if len(logs) < 3 || logs[len(logs)-1] != "1         0" {
+		t.Errorf("got log messages %q", logs)
+	}
+	if want := []string{"warning: deprecated", "no tests to run"}; !equalStrings(stderr, want) {
+		t.Errorf("got stderr %q, want %q", stderr, want)
+	}
+}
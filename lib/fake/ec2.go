@@ -0,0 +1,646 @@
+// Package fake provides in-memory implementations of the AWS APIs used by ec2-runner so the
+// lib package can be exercised without credentials or network access.
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"golang.org/x/crypto/ssh"
+)
+
+// EC2 is an in-memory EC2 API. Only the operations used by ec2-runner are implemented;
+// calling anything else panics on the embedded nil interface.
+type EC2 struct {
+	ec2iface.EC2API
+
+	mu sync.Mutex
+
+	Images          []*ec2.Image
+	Subnets         []*ec2.Subnet
+	SecurityGroups  []*ec2.SecurityGroup
+	KeyPairs        map[string]*ec2.KeyPairInfo
+	LaunchTemplates map[string][]*ec2.RequestLaunchTemplateData
+	// LaunchTemplateTags are the tags of each launch template by name
+	LaunchTemplateTags map[string][]*ec2.Tag
+	Instances          map[string]*ec2.Instance
+	SpotRequests       []*ec2.SpotInstanceRequest
+
+	// SpotCapacity controls whether fleet requests for spot capacity are fulfilled
+	SpotCapacity bool
+	// FleetFailures is the number of fleet requests that fail before capacity is available
+	FleetFailures int
+	// SpotPrice is reported for every spot instance launched
+	SpotPrice string
+	// CurrentSpotPrices are the spot prices reported by DescribeSpotPriceHistory by instance
+	// type. Types without one are priced at SpotPrice.
+	CurrentSpotPrices map[string]string
+
+	// ConsoleOutput is the console output of each instance by instance ID
+	ConsoleOutput map[string]string
+
+	// FleetRequests records every fleet request received
+	FleetRequests []*ec2.CreateFleetInput
+
+	// Unauthorized lists the operations, such as CreateFleet, dry runs are denied
+	Unauthorized []string
+
+	instanceCount int
+}
+
+// NewEC2 returns an empty EC2 with spot capacity available
+func NewEC2() *EC2 {
+	return &EC2{
+		KeyPairs:           make(map[string]*ec2.KeyPairInfo),
+		LaunchTemplates:    make(map[string][]*ec2.RequestLaunchTemplateData),
+		LaunchTemplateTags: make(map[string][]*ec2.Tag),
+		Instances:          make(map[string]*ec2.Instance),
+		ConsoleOutput:      make(map[string]string),
+		SpotCapacity:       true,
+		SpotPrice:          "0.003500",
+		CurrentSpotPrices:  make(map[string]string),
+	}
+}
+
+// DescribeImages returns images matching the given filters
+func (f *EC2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var images []*ec2.Image
+	for _, image := range f.Images {
+		attributes := map[string][]*string{
+			"image-id":    {image.ImageId},
+			"name":        {image.Name},
+			"owner-alias": {image.ImageOwnerAlias},
+			"owner-id":    {image.OwnerId},
+		}
+		if matchFilters(input.Filters, attributes, image.Tags) {
+			images = append(images, image)
+		}
+	}
+
+	return &ec2.DescribeImagesOutput{Images: images}, nil
+}
+
+// DescribeSubnets returns subnets matching the given filters
+func (f *EC2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var subnets []*ec2.Subnet
+	for _, subnet := range f.Subnets {
+		if len(input.SubnetIds) > 0 && !containsString(input.SubnetIds, subnet.SubnetId) {
+			continue
+		}
+		attributes := map[string][]*string{
+			"subnet-id":         {subnet.SubnetId},
+			"vpc-id":            {subnet.VpcId},
+			"availability-zone": {subnet.AvailabilityZone},
+			"cidr-block":        {subnet.CidrBlock},
+		}
+		if matchFilters(input.Filters, attributes, subnet.Tags) {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	return &ec2.DescribeSubnetsOutput{Subnets: subnets}, nil
+}
+
+// DescribeSecurityGroups returns security groups matching the given filters
+func (f *EC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var groups []*ec2.SecurityGroup
+	for _, group := range f.SecurityGroups {
+		if len(input.GroupIds) > 0 && !containsString(input.GroupIds, group.GroupId) {
+			continue
+		}
+		attributes := map[string][]*string{
+			"group-id":   {group.GroupId},
+			"group-name": {group.GroupName},
+			"vpc-id":     {group.VpcId},
+		}
+		if matchFilters(input.Filters, attributes, group.Tags) {
+			groups = append(groups, group)
+		}
+	}
+
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: groups}, nil
+}
+
+// CreateKeyPair generates an RSA key pair and stores its name
+func (f *EC2) CreateKeyPair(input *ec2.CreateKeyPairInput) (*ec2.CreateKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.KeyPairs[*input.KeyName]; ok {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", fmt.Sprintf("The keypair '%s' already exists.", *input.KeyName), nil)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	material := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	f.KeyPairs[*input.KeyName] = &ec2.KeyPairInfo{KeyName: input.KeyName}
+
+	return &ec2.CreateKeyPairOutput{
+		KeyName:     input.KeyName,
+		KeyMaterial: aws.String(string(material)),
+	}, nil
+}
+
+// ImportKeyPair stores the name and fingerprint of an imported public key
+func (f *EC2) ImportKeyPair(input *ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.KeyPairs[*input.KeyName]; ok {
+		return nil, awserr.New("InvalidKeyPair.Duplicate", fmt.Sprintf("The keypair '%s' already exists.", *input.KeyName), nil)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(input.PublicKeyMaterial)
+	if err != nil {
+		return nil, awserr.New("InvalidKey.Format", fmt.Sprintf("Key is not in valid OpenSSH public key format: %s", err), nil)
+	}
+
+	f.KeyPairs[*input.KeyName] = &ec2.KeyPairInfo{
+		KeyName:        input.KeyName,
+		KeyFingerprint: aws.String(ssh.FingerprintSHA256(key)),
+		Tags:           specifiedTags(input.TagSpecifications, ec2.ResourceTypeKeyPair),
+	}
+
+	return &ec2.ImportKeyPairOutput{
+		KeyName:        input.KeyName,
+		KeyFingerprint: aws.String(ssh.FingerprintSHA256(key)),
+	}, nil
+}
+
+// DescribeKeyPairs returns key pairs matching the given filters
+func (f *EC2) DescribeKeyPairs(input *ec2.DescribeKeyPairsInput) (*ec2.DescribeKeyPairsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keyPairs []*ec2.KeyPairInfo
+	for _, keyPair := range f.KeyPairs {
+		attributes := map[string][]*string{
+			"key-name": {keyPair.KeyName},
+		}
+		if matchFilters(input.Filters, attributes, keyPair.Tags) {
+			keyPairs = append(keyPairs, keyPair)
+		}
+	}
+
+	return &ec2.DescribeKeyPairsOutput{KeyPairs: keyPairs}, nil
+}
+
+// DeleteKeyPair removes a key pair
+func (f *EC2) DeleteKeyPair(input *ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.KeyPairs, aws.StringValue(input.KeyName))
+	return &ec2.DeleteKeyPairOutput{}, nil
+}
+
+// CreateLaunchTemplate stores the first version of a launch template
+func (f *EC2) CreateLaunchTemplate(input *ec2.CreateLaunchTemplateInput) (*ec2.CreateLaunchTemplateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if aws.BoolValue(input.DryRun) {
+		return nil, f.dryRun("CreateLaunchTemplate")
+	}
+
+	name := *input.LaunchTemplateName
+	if _, ok := f.LaunchTemplates[name]; ok {
+		return nil, awserr.New("InvalidLaunchTemplateName.AlreadyExistsException", fmt.Sprintf("Launch template name already in use: %s", name), nil)
+	}
+	f.LaunchTemplates[name] = []*ec2.RequestLaunchTemplateData{input.LaunchTemplateData}
+	f.LaunchTemplateTags[name] = specifiedTags(input.TagSpecifications, ec2.ResourceTypeLaunchTemplate)
+
+	return &ec2.CreateLaunchTemplateOutput{
+		LaunchTemplate: &ec2.LaunchTemplate{
+			LaunchTemplateName:  input.LaunchTemplateName,
+			LatestVersionNumber: aws.Int64(1),
+		},
+	}, nil
+}
+
+// CreateLaunchTemplateVersion appends a version to an existing launch template
+func (f *EC2) CreateLaunchTemplateVersion(input *ec2.CreateLaunchTemplateVersionInput) (*ec2.CreateLaunchTemplateVersionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.StringValue(input.LaunchTemplateName)
+	versions, ok := f.LaunchTemplates[name]
+	if !ok {
+		return nil, launchTemplateNotFound(name)
+	}
+	f.LaunchTemplates[name] = append(versions, input.LaunchTemplateData)
+
+	return &ec2.CreateLaunchTemplateVersionOutput{
+		LaunchTemplateVersion: &ec2.LaunchTemplateVersion{
+			LaunchTemplateName: input.LaunchTemplateName,
+			VersionNumber:      aws.Int64(int64(len(versions) + 1)),
+		},
+	}, nil
+}
+
+// DeleteLaunchTemplate removes a launch template and all its versions
+func (f *EC2) DeleteLaunchTemplate(input *ec2.DeleteLaunchTemplateInput) (*ec2.DeleteLaunchTemplateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := aws.StringValue(input.LaunchTemplateName)
+	if _, ok := f.LaunchTemplates[name]; !ok {
+		return nil, launchTemplateNotFound(name)
+	}
+	delete(f.LaunchTemplates, name)
+	delete(f.LaunchTemplateTags, name)
+
+	return &ec2.DeleteLaunchTemplateOutput{}, nil
+}
+
+// DescribeLaunchTemplatesPages calls fn with a single page of launch templates matching the
+// given filters
+func (f *EC2) DescribeLaunchTemplatesPages(input *ec2.DescribeLaunchTemplatesInput, fn func(*ec2.DescribeLaunchTemplatesOutput, bool) bool) error {
+	f.mu.Lock()
+	var templates []*ec2.LaunchTemplate
+	for name := range f.LaunchTemplates {
+		attributes := map[string][]*string{
+			"launch-template-name": {aws.String(name)},
+		}
+		if matchFilters(input.Filters, attributes, f.LaunchTemplateTags[name]) {
+			templates = append(templates, &ec2.LaunchTemplate{
+				LaunchTemplateName:  aws.String(name),
+				LatestVersionNumber: aws.Int64(int64(len(f.LaunchTemplates[name]))),
+				Tags:                f.LaunchTemplateTags[name],
+			})
+		}
+	}
+	f.mu.Unlock()
+
+	fn(&ec2.DescribeLaunchTemplatesOutput{LaunchTemplates: templates}, true)
+	return nil
+}
+
+// CreateFleet launches a single instance from the requested launch template version using
+// the first instance type override
+func (f *EC2) CreateFleet(input *ec2.CreateFleetInput) (*ec2.CreateFleetOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// EC2 checks the launch template exists once the caller is authorized
+	if aws.BoolValue(input.DryRun) {
+		err := f.dryRun("CreateFleet")
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "DryRunOperation" {
+			name := aws.StringValue(input.LaunchTemplateConfigs[0].LaunchTemplateSpecification.LaunchTemplateName)
+			if _, ok := f.LaunchTemplates[name]; !ok {
+				return nil, launchTemplateNotFound(name)
+			}
+		}
+		return nil, err
+	}
+
+	f.FleetRequests = append(f.FleetRequests, input)
+	fleetID := aws.String(fmt.Sprintf("fleet-%08d", len(f.FleetRequests)))
+
+	config := input.LaunchTemplateConfigs[0]
+	name := aws.StringValue(config.LaunchTemplateSpecification.LaunchTemplateName)
+	versions, ok := f.LaunchTemplates[name]
+	if !ok {
+		return nil, launchTemplateNotFound(name)
+	}
+
+	var version int
+	fmt.Sscanf(aws.StringValue(config.LaunchTemplateSpecification.Version), "%d", &version)
+	if version < 1 || version > len(versions) {
+		return nil, awserr.New("InvalidLaunchTemplateVersion.NotFound", fmt.Sprintf("Launch template version %d does not exist", version), nil)
+	}
+	data := versions[version-1]
+
+	capacityType := aws.StringValue(input.TargetCapacitySpecification.DefaultTargetCapacityType)
+	if capacityType == "on-demand" && data.InstanceMarketOptions != nil {
+		return nil, awserr.New("InvalidFleetConfig", "at least 1 spot instance request is required when the launch template specifies spot market options", nil)
+	}
+
+	if f.FleetFailures > 0 || (capacityType == "spot" && !f.SpotCapacity) {
+		if f.FleetFailures > 0 {
+			f.FleetFailures--
+		}
+		return &ec2.CreateFleetOutput{
+			FleetId: fleetID,
+			Errors: []*ec2.CreateFleetError{
+				{
+					ErrorCode:    aws.String("InsufficientInstanceCapacity"),
+					ErrorMessage: aws.String("There is no Spot capacity available that matches your request."),
+					Lifecycle:    aws.String(capacityType),
+				},
+			},
+		}, nil
+	}
+
+	instanceType := aws.StringValue(config.Overrides[0].InstanceType)
+	instance := f.launch(data, instanceType, capacityType)
+
+	return &ec2.CreateFleetOutput{
+		FleetId: fleetID,
+		Instances: []*ec2.CreateFleetInstance{
+			{
+				InstanceIds:  []*string{instance.InstanceId},
+				InstanceType: instance.InstanceType,
+				Lifecycle:    aws.String(capacityType),
+			},
+		},
+	}, nil
+}
+
+// launch records a running instance for the given launch template data
+func (f *EC2) launch(data *ec2.RequestLaunchTemplateData, instanceType, capacityType string) *ec2.Instance {
+	f.instanceCount++
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(fmt.Sprintf("i-%017x", f.instanceCount)),
+		InstanceType:     aws.String(instanceType),
+		ImageId:          data.ImageId,
+		KeyName:          data.KeyName,
+		PrivateIpAddress: aws.String(fmt.Sprintf("10.0.0.%d", f.instanceCount)),
+		LaunchTime:       aws.Time(time.Now()),
+		State: &ec2.InstanceState{
+			Code: aws.Int64(16),
+			Name: aws.String(ec2.InstanceStateNameRunning),
+		},
+	}
+	if len(data.NetworkInterfaces) > 0 {
+		instance.SubnetId = data.NetworkInterfaces[0].SubnetId
+		if aws.BoolValue(data.NetworkInterfaces[0].AssociatePublicIpAddress) {
+			instance.PublicIpAddress = aws.String(fmt.Sprintf("203.0.113.%d", f.instanceCount))
+		}
+	}
+	for _, spec := range data.TagSpecifications {
+		if aws.StringValue(spec.ResourceType) == ec2.ResourceTypeInstance {
+			instance.Tags = spec.Tags
+		}
+	}
+	if capacityType == "spot" {
+		instance.InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+		f.SpotRequests = append(f.SpotRequests, &ec2.SpotInstanceRequest{
+			SpotInstanceRequestId: aws.String(fmt.Sprintf("sir-%08d", f.instanceCount)),
+			InstanceId:            instance.InstanceId,
+			SpotPrice:             aws.String(f.SpotPrice),
+		})
+	}
+	f.Instances[*instance.InstanceId] = instance
+
+	return instance
+}
+
+// RunInstances only supports dry runs, instances are launched through CreateFleet
+func (f *EC2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !aws.BoolValue(input.DryRun) {
+		panic("fake: RunInstances is only implemented for dry runs")
+	}
+	return nil, f.dryRun("RunInstances")
+}
+
+// DescribeSpotPriceHistory reports the current spot price of every requested instance type
+func (f *EC2) DescribeSpotPriceHistory(input *ec2.DescribeSpotPriceHistoryInput) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &ec2.DescribeSpotPriceHistoryOutput{}
+	for _, instanceType := range input.InstanceTypes {
+		price, ok := f.CurrentSpotPrices[aws.StringValue(instanceType)]
+		if !ok {
+			price = f.SpotPrice
+		}
+		output.SpotPriceHistory = append(output.SpotPriceHistory, &ec2.SpotPrice{
+			AvailabilityZone:   input.AvailabilityZone,
+			InstanceType:       instanceType,
+			ProductDescription: aws.String("Linux/UNIX"),
+			SpotPrice:          aws.String(price),
+			Timestamp:          aws.Time(time.Now()),
+		})
+	}
+	return output, nil
+}
+
+// WaitUntilInstanceRunning returns immediately; instances are running as soon as they launch
+func (f *EC2) WaitUntilInstanceRunning(input *ec2.DescribeInstancesInput) error {
+	return nil
+}
+
+// DescribeInstances returns the requested instances, or every instance matching the given
+// filters, in a single reservation
+func (f *EC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		instance, ok := f.Instances[aws.StringValue(id)]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		reservation.Instances = append(reservation.Instances, instance)
+	}
+
+	if len(input.InstanceIds) == 0 {
+		for _, instance := range f.Instances {
+			attributes := map[string][]*string{
+				"instance-id":         {instance.InstanceId},
+				"instance-state-name": {instance.State.Name},
+			}
+			if matchFilters(input.Filters, attributes, instance.Tags) {
+				reservation.Instances = append(reservation.Instances, instance)
+			}
+		}
+	}
+
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+// DescribeInstancesPages calls fn with a single page of instances
+func (f *EC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	output, err := f.DescribeInstances(input)
+	if err != nil {
+		return err
+	}
+	fn(output, true)
+	return nil
+}
+
+// DescribeSpotInstanceRequests returns spot requests matching the given filters
+func (f *EC2) DescribeSpotInstanceRequests(input *ec2.DescribeSpotInstanceRequestsInput) (*ec2.DescribeSpotInstanceRequestsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var requests []*ec2.SpotInstanceRequest
+	for _, request := range f.SpotRequests {
+		attributes := map[string][]*string{
+			"instance-id":              {request.InstanceId},
+			"spot-instance-request-id": {request.SpotInstanceRequestId},
+		}
+		if matchFilters(input.Filters, attributes, request.Tags) {
+			requests = append(requests, request)
+		}
+	}
+
+	return &ec2.DescribeSpotInstanceRequestsOutput{SpotInstanceRequests: requests}, nil
+}
+
+// TerminateInstances moves the given instances to the terminated state
+func (f *EC2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var changes []*ec2.InstanceStateChange
+	for _, id := range input.InstanceIds {
+		instance, ok := f.Instances[aws.StringValue(id)]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(id)), nil)
+		}
+		previous := instance.State
+		instance.State = &ec2.InstanceState{
+			Code: aws.Int64(32),
+			Name: aws.String(ec2.InstanceStateNameShuttingDown),
+		}
+		changes = append(changes, &ec2.InstanceStateChange{
+			InstanceId:    instance.InstanceId,
+			PreviousState: previous,
+			CurrentState:  instance.State,
+		})
+	}
+
+	return &ec2.TerminateInstancesOutput{TerminatingInstances: changes}, nil
+}
+
+// Interrupt terminates a spot instance the way AWS does when reclaiming capacity
+func (f *EC2) Interrupt(instanceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	instance := f.Instances[instanceID]
+	instance.State = &ec2.InstanceState{
+		Code: aws.Int64(48),
+		Name: aws.String(ec2.InstanceStateNameTerminated),
+	}
+	instance.StateReason = &ec2.StateReason{
+		Code:    aws.String("Server.SpotInstanceTermination"),
+		Message: aws.String("Server.SpotInstanceTermination: Spot instance termination"),
+	}
+}
+
+// GetConsoleOutput returns the base64 encoded console output of an instance
+func (f *EC2) GetConsoleOutput(input *ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.Instances[aws.StringValue(input.InstanceId)]; !ok {
+		return nil, awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", aws.StringValue(input.InstanceId)), nil)
+	}
+
+	return &ec2.GetConsoleOutputOutput{
+		InstanceId: input.InstanceId,
+		Output:     aws.String(base64.StdEncoding.EncodeToString([]byte(f.ConsoleOutput[aws.StringValue(input.InstanceId)]))),
+	}, nil
+}
+
+// matchFilters reports whether a resource with the given attributes and tags matches every
+// filter. Filter values support the same * and ? wildcards as EC2.
+func matchFilters(filters []*ec2.Filter, attributes map[string][]*string, tags []*ec2.Tag) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+
+		var values []*string
+		switch {
+		case strings.HasPrefix(name, "tag:"):
+			for _, tag := range tags {
+				if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") {
+					values = append(values, tag.Value)
+				}
+			}
+		case name == "tag-key":
+			for _, tag := range tags {
+				values = append(values, tag.Key)
+			}
+		default:
+			values = attributes[name]
+		}
+
+		if !matchAny(filter.Values, values) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny(patterns, values []*string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if value == nil {
+				continue
+			}
+			if ok, _ := path.Match(*pattern, *value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// specifiedTags returns the tags specified for a resource type
+func specifiedTags(specifications []*ec2.TagSpecification, resourceType string) []*ec2.Tag {
+	var tags []*ec2.Tag
+	for _, spec := range specifications {
+		if aws.StringValue(spec.ResourceType) == resourceType {
+			tags = append(tags, spec.Tags...)
+		}
+	}
+	return tags
+}
+
+func containsString(list []*string, s *string) bool {
+	for _, item := range list {
+		if aws.StringValue(item) == aws.StringValue(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRun returns the error EC2 answers a dry run of operation with
+func (f *EC2) dryRun(operation string) error {
+	for _, denied := range f.Unauthorized {
+		if denied == operation {
+			return awserr.New("UnauthorizedOperation", fmt.Sprintf("You are not authorized to perform %s.", operation), nil)
+		}
+	}
+	return awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+}
+
+func launchTemplateNotFound(name string) error {
+	return awserr.New("InvalidLaunchTemplateName.NotFoundException", fmt.Sprintf("Launch template %s does not exist", name), nil)
+}
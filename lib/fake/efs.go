@@ -0,0 +1,74 @@
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/efs/efsiface"
+)
+
+// EFS is an in-memory Elastic File System API
+type EFS struct {
+	efsiface.EFSAPI
+
+	mu sync.Mutex
+
+	FileSystems  []*efs.FileSystemDescription
+	MountTargets []*efs.MountTargetDescription
+	// MountTargetSecurityGroups are the security group IDs of each mount target by ID
+	MountTargetSecurityGroups map[string][]string
+}
+
+// NewEFS returns an EFS with no file systems
+func NewEFS() *EFS {
+	return &EFS{MountTargetSecurityGroups: make(map[string][]string)}
+}
+
+// DescribeFileSystems returns every file system, or the one with the given ID
+func (f *EFS) DescribeFileSystems(input *efs.DescribeFileSystemsInput) (*efs.DescribeFileSystemsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if input.FileSystemId == nil {
+		return &efs.DescribeFileSystemsOutput{FileSystems: f.FileSystems}, nil
+	}
+
+	for _, fs := range f.FileSystems {
+		if aws.StringValue(fs.FileSystemId) == aws.StringValue(input.FileSystemId) {
+			return &efs.DescribeFileSystemsOutput{FileSystems: []*efs.FileSystemDescription{fs}}, nil
+		}
+	}
+
+	return nil, awserr.New(efs.ErrCodeFileSystemNotFound, fmt.Sprintf("File system '%s' does not exist.", aws.StringValue(input.FileSystemId)), nil)
+}
+
+// DescribeMountTargets returns the mount targets of a file system
+func (f *EFS) DescribeMountTargets(input *efs.DescribeMountTargetsInput) (*efs.DescribeMountTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var targets []*efs.MountTargetDescription
+	for _, target := range f.MountTargets {
+		if aws.StringValue(target.FileSystemId) == aws.StringValue(input.FileSystemId) {
+			targets = append(targets, target)
+		}
+	}
+
+	return &efs.DescribeMountTargetsOutput{MountTargets: targets}, nil
+}
+
+// DescribeMountTargetSecurityGroups returns the security groups of a mount target
+func (f *EFS) DescribeMountTargetSecurityGroups(input *efs.DescribeMountTargetSecurityGroupsInput) (*efs.DescribeMountTargetSecurityGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	groups, ok := f.MountTargetSecurityGroups[aws.StringValue(input.MountTargetId)]
+	if !ok {
+		return nil, awserr.New(efs.ErrCodeMountTargetNotFound, fmt.Sprintf("Mount target '%s' does not exist.", aws.StringValue(input.MountTargetId)), nil)
+	}
+
+	return &efs.DescribeMountTargetSecurityGroupsOutput{SecurityGroups: aws.StringSlice(groups)}, nil
+}
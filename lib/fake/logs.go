@@ -0,0 +1,67 @@
+package fake
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// Logs is an in-memory CloudWatch Logs API holding the events of log streams
+type Logs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+
+	mu sync.Mutex
+
+	// Streams are the messages of each log stream by group and stream name, joined by a colon
+	Streams map[string][]string
+	// Delayed messages are added to their stream once it has been read to its end, as CloudWatch
+	// Logs delivers events with a delay
+	Delayed map[string][]string
+}
+
+// NewLogs returns Logs without any streams
+func NewLogs() *Logs {
+	return &Logs{Streams: make(map[string][]string), Delayed: make(map[string][]string)}
+}
+
+// Append adds messages to a log stream, creating it when needed
+func (f *Logs) Append(group, stream string, messages ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := group + ":" + stream
+	f.Streams[key] = append(f.Streams[key], messages...)
+}
+
+// GetLogEvents returns up to two events from the position in the forward token onwards
+func (f *Logs) GetLogEvents(input *cloudwatchlogs.GetLogEventsInput) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := aws.StringValue(input.LogGroupName) + ":" + aws.StringValue(input.LogStreamName)
+	messages, ok := f.Streams[key]
+	if !ok {
+		return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, fmt.Sprintf("The specified log stream does not exist: %s", aws.StringValue(input.LogStreamName)), nil)
+	}
+
+	start, _ := strconv.Atoi(aws.StringValue(input.NextToken))
+	end := start + 2
+	if end > len(messages) {
+		end = len(messages)
+	}
+
+	output := &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: aws.String(strconv.Itoa(end))}
+	for _, message := range messages[start:end] {
+		output.Events = append(output.Events, &cloudwatchlogs.OutputLogEvent{Message: aws.String(message)})
+	}
+	if start == len(messages) {
+		f.Streams[key] = append(f.Streams[key], f.Delayed[key]...)
+		delete(f.Delayed, key)
+	}
+	return output, nil
+}
@@ -0,0 +1,70 @@
+package fake
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/pricing/pricingiface"
+)
+
+// Pricing is an in-memory AWS Price List API serving EC2 on-demand prices
+type Pricing struct {
+	pricingiface.PricingAPI
+
+	mu sync.Mutex
+
+	// Prices are the hourly on-demand prices in USD by instance type
+	Prices map[string]string
+	// Offline makes every request fail as if the API could not be reached
+	Offline bool
+	// Requests counts the requests received
+	Requests int
+}
+
+// NewPricing returns a Pricing with no prices
+func NewPricing() *Pricing {
+	return &Pricing{Prices: make(map[string]string)}
+}
+
+// GetProducts returns the on-demand price of the instance type given by the instanceType
+// filter. Other filters are ignored.
+func (f *Pricing) GetProducts(input *pricing.GetProductsInput) (*pricing.GetProductsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Requests++
+	if f.Offline {
+		return nil, awserr.New("RequestError", "send request failed", nil)
+	}
+
+	output := &pricing.GetProductsOutput{}
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Field) != "instanceType" {
+			continue
+		}
+		price, ok := f.Prices[aws.StringValue(filter.Value)]
+		if !ok {
+			continue
+		}
+		output.PriceList = append(output.PriceList, aws.JSONValue{
+			"product": map[string]interface{}{
+				"attributes": map[string]interface{}{"instanceType": aws.StringValue(filter.Value)},
+			},
+			"terms": map[string]interface{}{
+				"OnDemand": map[string]interface{}{
+					"OFFER.TERM": map[string]interface{}{
+						"priceDimensions": map[string]interface{}{
+							"OFFER.TERM.RATE": map[string]interface{}{
+								"unit":         "Hrs",
+								"pricePerUnit": map[string]interface{}{"USD": price},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+	return output, nil
+}
@@ -0,0 +1,112 @@
+package fake
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSM is an in-memory Systems Manager API that completes every command immediately
+type SSM struct {
+	ssmiface.SSMAPI
+
+	mu sync.Mutex
+
+	// OnlineInstances are the instance IDs whose agent is registered
+	OnlineInstances map[string]bool
+
+	// Stdout, Stderr and ResponseCode are reported for every command
+	Stdout       string
+	Stderr       string
+	ResponseCode int64
+	// Status overrides the status reported for every command when set
+	Status string
+	// Missing is how many calls report the invocation does not exist, as SSM does right after
+	// a command is sent
+	Missing int
+
+	// Commands records every command sent
+	Commands []*ssm.SendCommandInput
+}
+
+// NewSSM returns an SSM with no registered instances
+func NewSSM() *SSM {
+	return &SSM{OnlineInstances: make(map[string]bool)}
+}
+
+// DescribeInstanceInformation returns the registered instances matching an InstanceIds filter
+func (f *SSM) DescribeInstanceInformation(input *ssm.DescribeInstanceInformationInput) (*ssm.DescribeInstanceInformationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var list []*ssm.InstanceInformation
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Key) != "InstanceIds" {
+			continue
+		}
+		for _, id := range filter.Values {
+			if f.OnlineInstances[aws.StringValue(id)] {
+				list = append(list, &ssm.InstanceInformation{
+					InstanceId: id,
+					PingStatus: aws.String(ssm.PingStatusOnline),
+				})
+			}
+		}
+	}
+
+	return &ssm.DescribeInstanceInformationOutput{InstanceInformationList: list}, nil
+}
+
+// SendCommand records the command
+func (f *SSM) SendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, id := range input.InstanceIds {
+		if !f.OnlineInstances[aws.StringValue(id)] {
+			return nil, awserr.New(ssm.ErrCodeInvalidInstanceId, fmt.Sprintf("Instance %s is not registered", aws.StringValue(id)), nil)
+		}
+	}
+
+	f.Commands = append(f.Commands, input)
+
+	return &ssm.SendCommandOutput{
+		Command: &ssm.Command{
+			CommandId:    aws.String(fmt.Sprintf("%036d", len(f.Commands))),
+			DocumentName: input.DocumentName,
+			InstanceIds:  input.InstanceIds,
+		},
+	}, nil
+}
+
+// GetCommandInvocation reports every command as complete once it exists
+func (f *SSM) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Missing > 0 {
+		f.Missing--
+		return nil, awserr.New(ssm.ErrCodeInvocationDoesNotExist, "Invocation does not exist", nil)
+	}
+
+	status := ssm.CommandInvocationStatusSuccess
+	if f.ResponseCode != 0 {
+		status = ssm.CommandInvocationStatusFailed
+	}
+	if f.Status != "" {
+		status = f.Status
+	}
+
+	return &ssm.GetCommandInvocationOutput{
+		CommandId:             input.CommandId,
+		InstanceId:            input.InstanceId,
+		Status:                aws.String(status),
+		ResponseCode:          aws.Int64(f.ResponseCode),
+		StandardOutputContent: aws.String(f.Stdout),
+		StandardErrorContent:  aws.String(f.Stderr),
+	}, nil
+}
@@ -0,0 +1,159 @@
+package ec2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// consoleOutputPollInterval is how often the console output is checked for host keys
+var consoleOutputPollInterval = 10 * time.Second
+
+// hostKeyVerifier checks the instance's SSH host key against the fingerprints cloud-init
+// printed to the console. Without fingerprints the first key seen is trusted and pinned,
+// unless strict checking is enabled.
+type hostKeyVerifier struct {
+	mu           sync.Mutex
+	strict       bool
+	fingerprints []string
+	pinned       ssh.PublicKey
+}
+
+// callback implements ssh.HostKeyCallback
+func (v *hostKeyVerifier) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.pinned != nil {
+		if !bytes.Equal(v.pinned.Marshal(), key.Marshal()) {
+			return fmt.Errorf("host key for %s changed to %s since it was first trusted", hostname, ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}
+
+	if len(v.fingerprints) > 0 {
+		for _, fingerprint := range v.fingerprints {
+			if fingerprint == ssh.FingerprintSHA256(key) || fingerprint == ssh.FingerprintLegacyMD5(key) {
+				v.pinned = key
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %s for %s does not match the fingerprints in the instance console output", ssh.FingerprintSHA256(key), hostname)
+	}
+
+	if v.strict {
+		return fmt.Errorf("refusing to connect to %s: no host key fingerprints are available to verify %s", hostname, ssh.FingerprintSHA256(key))
+	}
+
+	Log.Warnf("Trusting host key %s for %s on first use", ssh.FingerprintSHA256(key), hostname)
+	v.pinned = key
+	return nil
+}
+
+// FetchHostKeys reads the host key fingerprints from the instance's console output and pins
+// them for every SSH connection. In strict mode this fails if none can be found; otherwise
+// the first key seen is trusted.
+func (instance *Instance) FetchHostKeys() error {
+	retries := 3
+	if instance.hostKeys.strict {
+		retries = 30
+	}
+
+	for attempts := 1; attempts <= retries; attempts++ {
+		Log.Debugf("Reading host key fingerprints for %s (attempt %d/%d)", *instance.InstanceID, attempts, retries)
+
+		result, err := instance.Client.EC2.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+			InstanceId: instance.InstanceID,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to get console output: %s", err)
+		}
+
+		output, err := base64.StdEncoding.DecodeString(aws.StringValue(result.Output))
+		if err != nil {
+			return fmt.Errorf("Unable to decode console output: %s", err)
+		}
+
+		if fingerprints := parseHostKeyFingerprints(string(output)); len(fingerprints) > 0 {
+			Log.Infof("Found %d host key fingerprints for %s", len(fingerprints), *instance.InstanceID)
+			instance.hostKeys.mu.Lock()
+			instance.hostKeys.fingerprints = fingerprints
+			instance.hostKeys.mu.Unlock()
+			return nil
+		}
+
+		Log.Debugf("Host key fingerprints for %s not yet available", *instance.InstanceID)
+		if attempts < retries {
+			time.Sleep(consoleOutputPollInterval)
+		}
+	}
+
+	if instance.hostKeys.strict {
+		return fmt.Errorf("no host key fingerprints found in the console output of %s", *instance.InstanceID)
+	}
+	return nil
+}
+
+// parseHostKeyFingerprints returns the fingerprints from cloud-init's SSH HOST KEY
+// FINGERPRINTS block. Lines look like '256 SHA256:abc... root@host (ECDSA)', optionally
+// prefixed with 'ec2: '.
+func parseHostKeyFingerprints(output string) []string {
+	var fingerprints []string
+	var inBlock bool
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), "ec2:"))
+
+		switch {
+		case strings.Contains(line, "-----BEGIN SSH HOST KEY FINGERPRINTS-----"):
+			inBlock = true
+			fingerprints = nil
+		case strings.Contains(line, "-----END SSH HOST KEY FINGERPRINTS-----"):
+			inBlock = false
+		case inBlock:
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			fingerprint := fields[1]
+			if strings.HasPrefix(fingerprint, "SHA256:") {
+				fingerprints = append(fingerprints, fingerprint)
+			} else if strings.Count(strings.TrimPrefix(fingerprint, "MD5:"), ":") == 15 {
+				fingerprints = append(fingerprints, strings.TrimPrefix(fingerprint, "MD5:"))
+			}
+		}
+	}
+
+	return fingerprints
+}
+
+// jumpHostKeyCallback verifies jump hosts against ~/.ssh/known_hosts in strict mode
+func jumpHostKeyCallback(strict bool) (ssh.HostKeyCallback, error) {
+	if !strict {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find known_hosts for jump hosts: %s", err)
+	}
+
+	callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read known_hosts for jump hosts: %s", err)
+	}
+	return callback, nil
+}
@@ -0,0 +1,116 @@
+package ec2
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseHostKeyFingerprints(t *testing.T) {
+	output := `[   12.345678] cloud-init[2345]: Cloud-init v. 19.3 running 'modules:final'
+ec2:
+ec2: #############################################################
+ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----
+ec2: 256 SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU no comment (ECDSA)
+ec2: 256 SHA256:ZAuXlz2yC4rfmlhCzYBjN0NA4gNHD8DFzH5eB7XbFxo no comment (ED25519)
+ec2: 2048 a1:b2:c3:d4:e5:f6:a7:b8:c9:d0:e1:f2:a3:b4:c5:d6 no comment (RSA)
+ec2: -----END SSH HOST KEY FINGERPRINTS-----
+ec2: #############################################################
+`
+
+	got := parseHostKeyFingerprints(output)
+	want := []string{
+		"SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU",
+		"SHA256:ZAuXlz2yC4rfmlhCzYBjN0NA4gNHD8DFzH5eB7XbFxo",
+		"a1:b2:c3:d4:e5:f6:a7:b8:c9:d0:e1:f2:a3:b4:c5:d6",
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := parseHostKeyFingerprints("no fingerprints here"); len(got) != 0 {
+		t.Errorf("got %v, want no fingerprints", got)
+	}
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	key := newTestHostKey(t)
+	other := newTestHostKey(t)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+	tests := []struct {
+		name     string
+		verifier *hostKeyVerifier
+		keys     []ssh.PublicKey
+		wantErr  bool
+	}{
+		{name: "matching fingerprint", verifier: &hostKeyVerifier{fingerprints: []string{ssh.FingerprintSHA256(key)}}, keys: []ssh.PublicKey{key}},
+		{name: "matching md5 fingerprint", verifier: &hostKeyVerifier{strict: true, fingerprints: []string{ssh.FingerprintLegacyMD5(key)}}, keys: []ssh.PublicKey{key}},
+		{name: "mismatched fingerprint", verifier: &hostKeyVerifier{fingerprints: []string{ssh.FingerprintSHA256(other)}}, keys: []ssh.PublicKey{key}, wantErr: true},
+		{name: "trust on first use", verifier: &hostKeyVerifier{}, keys: []ssh.PublicKey{key, key}},
+		{name: "changed after first use", verifier: &hostKeyVerifier{}, keys: []ssh.PublicKey{key, other}, wantErr: true},
+		{name: "strict without fingerprints", verifier: &hostKeyVerifier{strict: true}, keys: []ssh.PublicKey{key}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			for _, k := range tt.keys {
+				if err = tt.verifier.callback("10.0.0.1:22", addr, k); err != nil {
+					break
+				}
+			}
+			if tt.wantErr && err == nil {
+				t.Fatal("expected the host key to be rejected")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFetchHostKeys(t *testing.T) {
+	consoleOutputPollInterval = 0
+
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.StrictHostKeyChecking = true
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.FetchHostKeys(); err == nil {
+		t.Fatal("strict host key checking should fail without fingerprints")
+	}
+
+	key := newTestHostKey(t)
+	f.ConsoleOutput[*instance.InstanceID] = fmt.Sprintf("-----BEGIN SSH HOST KEY FINGERPRINTS-----\n256 %s no comment (ED25519)\n-----END SSH HOST KEY FINGERPRINTS-----\n", ssh.FingerprintSHA256(key))
+
+	if err := instance.FetchHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.sshConfig.HostKeyCallback("10.0.0.1:22", nil, key); err != nil {
+		t.Errorf("host key from the console output should be trusted: %s", err)
+	}
+	if err := instance.sshConfig.HostKeyCallback("10.0.0.1:22", nil, newTestHostKey(t)); err == nil {
+		t.Error("host key not in the console output should be rejected")
+	}
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,195 @@
+package ec2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+)
+
+// interruptionPollInterval is how often a spot instance is checked for an interruption notice
+var interruptionPollInterval = 5 * time.Second
+
+// spotInstanceActionCommand prints the pending spot instance action from the instance metadata,
+// using IMDSv2 when available. It prints nothing when no interruption is scheduled.
+const spotInstanceActionCommand = `TOKEN=$(curl -s -m 2 -X PUT -H 'X-aws-ec2-metadata-token-ttl-seconds: 60' http://169.254.169.254/latest/api/token); curl -sf -m 2 ${TOKEN:+-H "X-aws-ec2-metadata-token: $TOKEN"} http://169.254.169.254/latest/meta-data/spot/instance-action`
+
+// spotInterruptionReasons are the state reason codes of spot instances reclaimed by AWS
+var spotInterruptionReasons = []string{
+	"Server.SpotInstanceTermination",
+	"Server.SpotInstanceShutdown",
+}
+
+// InterruptedError is returned when AWS reclaims a spot instance while it runs the command
+type InterruptedError struct {
+	InstanceID string
+	Reason     string
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("spot instance %s was interrupted: %s", e.InstanceID, e.Reason)
+}
+
+// spotInstanceAction is the interruption notice served by the instance metadata
+type spotInstanceAction struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// parseSpotInstanceAction returns the notice in the metadata output, or nil when there is none
+func parseSpotInstanceAction(output []byte) (*spotInstanceAction, error) {
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return nil, nil
+	}
+
+	var action spotInstanceAction
+	if err := json.Unmarshal(output, &action); err != nil {
+		return nil, fmt.Errorf("unable to parse spot instance action %q: %s", output, err)
+	}
+	if action.Action == "" {
+		return nil, nil
+	}
+	return &action, nil
+}
+
+func (action *spotInstanceAction) String() string {
+	return fmt.Sprintf("%s at %s", action.Action, action.Time.Format(time.RFC3339))
+}
+
+// isSpot reports whether the instance was launched as a spot instance
+func (instance *Instance) isSpot() bool {
+	return aws.StringValue(instance.Lifecycle) == "spot"
+}
+
+// watchSpotInterruption polls the instance metadata over the connection until stop is closed.
+// The returned channel receives the interruption notice, if any, and is closed once polling
+// stops.
+func (instance *Instance) watchSpotInterruption(client *ssh.Client, stop <-chan struct{}) <-chan *spotInstanceAction {
+	notices := make(chan *spotInstanceAction, 1)
+
+	go func() {
+		defer close(notices)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interruptionPollInterval):
+			}
+
+			session, err := client.NewSession()
+			if err != nil {
+				// the connection is gone
+				return
+			}
+			output, _ := session.Output(spotInstanceActionCommand)
+			session.Close()
+
+			action, err := parseSpotInstanceAction(output)
+			if err != nil {
+				Log.Warnf("%s", err)
+				continue
+			}
+			if action != nil {
+				Log.Warnf("Spot interruption notice for %s: %s", *instance.InstanceID, action)
+				notices <- action
+				return
+			}
+		}
+	}()
+
+	return notices
+}
+
+// spotInterruption returns an *InterruptedError when AWS has reclaimed the spot instance
+func (instance *Instance) spotInterruption() error {
+	if !instance.isSpot() {
+		return nil
+	}
+
+	result, err := instance.Client.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{instance.InstanceID},
+	})
+	if err != nil {
+		return nil
+	}
+
+	for _, reservation := range result.Reservations {
+		for _, described := range reservation.Instances {
+			if described.StateReason == nil {
+				continue
+			}
+			for _, reason := range spotInterruptionReasons {
+				if aws.StringValue(described.StateReason.Code) == reason {
+					return &InterruptedError{
+						InstanceID: *instance.InstanceID,
+						Reason:     aws.StringValue(described.StateReason.Message),
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// interrupted records that the instance was interrupted
+func (instance *Instance) interrupted(err error) error {
+	instance.Interrupted = true
+	instance.terminated()
+	return err
+}
+
+// Relaunch launches a new instance from the same launch template to run the command again
+// after the previous one was interrupted
+func (instance *Instance) Relaunch() error {
+	if err := instance.stopped(); err != nil {
+		return err
+	}
+
+	// AWS terminates interrupted instances anyway, this makes sure and stops the cleanup
+	// tracking it
+	if instance.InstanceID != nil {
+		if err := instance.Terminate(); err != nil {
+			Log.Errorf("%s", err)
+		}
+	}
+
+	// the interrupted instance is still paid for
+	if cost, err := instance.Cost(); err == nil {
+		instance.mu.Lock()
+		instance.previousCost = cost
+		instance.mu.Unlock()
+	}
+
+	instance.Interruptions++
+	instance.Interrupted = false
+	instance.TimedOut = false
+	*instance.ExitCode = -1
+
+	instance.mu.Lock()
+	instance.Reservation = nil
+	instance.InstanceID = nil
+	instance.PrivateIPAddress = nil
+	instance.PublicIPAddress = nil
+	instance.SelectedInstanceType = nil
+	instance.Lifecycle = nil
+	instance.SpotPrice = nil
+	instance.hourlyPrice = nil
+	instance.LaunchTime = nil
+	instance.TerminationTime = nil
+	instance.mu.Unlock()
+
+	// The new instance has its own host keys
+	if instance.hostKeys != nil {
+		instance.hostKeys = &hostKeyVerifier{strict: instance.hostKeys.strict}
+		sshConfig := *instance.sshConfig
+		sshConfig.HostKeyCallback = instance.hostKeys.callback
+		instance.sshConfig = &sshConfig
+	}
+
+	return instance.Start()
+}
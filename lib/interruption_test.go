@@ -0,0 +1,111 @@
+package ec2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestParseSpotInstanceAction(t *testing.T) {
+	action, err := parseSpotInstanceAction([]byte(`{"action": "terminate", "time": "2020-03-01T12:02:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action == nil || action.Action != "terminate" || !action.Time.Equal(time.Date(2020, 3, 1, 12, 2, 0, 0, time.UTC)) {
+		t.Errorf("unexpected action %v", action)
+	}
+
+	for _, output := range []string{"", "\n", "{}"} {
+		if action, err := parseSpotInstanceAction([]byte(output)); err != nil || action != nil {
+			t.Errorf("%q: got %v, %v, want no action", output, action, err)
+		}
+	}
+
+	if _, err := parseSpotInstanceAction([]byte("<html>")); err == nil {
+		t.Error("expected an error for malformed output")
+	}
+}
+
+func TestSpotInterruption(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, nil)
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := instance.spotInterruption(); err != nil {
+		t.Fatalf("got %s for a running instance", err)
+	}
+
+	f.Interrupt(*instance.InstanceID)
+	if _, ok := instance.spotInterruption().(*InterruptedError); !ok {
+		t.Error("expected an InterruptedError once the instance is reclaimed")
+	}
+}
+
+func TestInvokeSSMCommandInterrupted(t *testing.T) {
+	ssmPollInterval = 0
+
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "make test"
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	client.SSM.(*fake.SSM).OnlineInstances[*instance.InstanceID] = true
+	f.Interrupt(*instance.InstanceID)
+
+	if _, ok := instance.InvokeCommand().(*InterruptedError); !ok {
+		t.Fatal("expected an InterruptedError")
+	}
+	if !instance.Interrupted {
+		t.Error("instance should be marked interrupted")
+	}
+
+	var buf bytes.Buffer
+	Summary(&buf, []*Instance{instance})
+	if !strings.Contains(buf.String(), "interrupted") {
+		t.Errorf("summary should report the interruption:\n%s", buf.String())
+	}
+}
+
+func TestRelaunch(t *testing.T) {
+	client, f := newTestClient()
+	cleanup := NewCleanup()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Cleanup = cleanup
+		opts.MaxInterruptionRetries = 1
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	interruptedID := *instance.InstanceID
+	f.Interrupt(interruptedID)
+	instance.interrupted(instance.spotInterruption())
+
+	if err := instance.Relaunch(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *instance.InstanceID == interruptedID {
+		t.Error("relaunch should start a new instance")
+	}
+	if instance.Interrupted || instance.Interruptions != 1 {
+		t.Errorf("got interrupted %t after %d interruptions, want false after 1", instance.Interrupted, instance.Interruptions)
+	}
+	if len(f.LaunchTemplates) != 1 || len(f.FleetRequests) != 2 {
+		t.Errorf("got %d launch templates and %d fleet requests, want the launch template reused", len(f.LaunchTemplates), len(f.FleetRequests))
+	}
+
+	if err := cleanup.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != "shutting-down" {
+		t.Errorf("got relaunched instance state %s, want shutting-down", state)
+	}
+}
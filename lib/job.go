@@ -0,0 +1,217 @@
+package ec2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JobVersion is the job definition schema version read by this release
+const JobVersion = 1
+
+// Job is a job definition file. Every option sets the InstanceOptions field of the same name
+// and is overridden by its flag when that flag is set.
+type Job struct {
+	Version int        `yaml:"version"`
+	Options JobOptions `yaml:",inline"`
+}
+
+// JobOptions are the InstanceOptions that can be set in a job definition. The flag tag names
+// the command line flag overriding each option.
+type JobOptions struct {
+	AMI                    *string        `yaml:"ami,omitempty" flag:"ami"`
+	AMIID                  *string        `yaml:"ami-id,omitempty" flag:"ami-id"`
+	AMIFilter              []string       `yaml:"ami-filters,omitempty" flag:"ami-filter"`
+	Subnet                 *string        `yaml:"subnet,omitempty" flag:"subnet"`
+	SubnetID               *string        `yaml:"subnet-id,omitempty" flag:"subnet-id"`
+	SubnetFilter           []string       `yaml:"subnet-filters,omitempty" flag:"subnet-filter"`
+	SecurityGroups         []string       `yaml:"security-groups,omitempty" flag:"security-group"`
+	SecurityGroupIDs       []string       `yaml:"security-group-ids,omitempty"`
+	SecurityGroupFilters   []string       `yaml:"security-group-filters,omitempty" flag:"security-group-filter"`
+	IamInstanceProfile     *string        `yaml:"instance-profile,omitempty" flag:"instance-profile"`
+	Count                  *int           `yaml:"count,omitempty" flag:"count"`
+	SSHKey                 *string        `yaml:"ssh-key,omitempty" flag:"ssh-key"`
+	SSHPort                *int           `yaml:"ssh-port,omitempty" flag:"ssh-port"`
+	User                   *string        `yaml:"user,omitempty" flag:"user"`
+	IdentityFile           *string        `yaml:"identity-file,omitempty" flag:"identify-file"`
+	Tags                   []string       `yaml:"tags,omitempty" flag:"tag"`
+	InstanceTypes          []string       `yaml:"instance-types,omitempty" flag:"instance-type"`
+	BidPrice               *float64       `yaml:"bid-price,omitempty" flag:"bid-price"`
+	BidPrices              []string       `yaml:"instance-bid-prices,omitempty" flag:"instance-bid-price"`
+	UserDataFile           *string        `yaml:"user-data,omitempty" flag:"user-data"`
+	EntrypointFile         *string        `yaml:"entrypoint,omitempty" flag:"entrypoint"`
+	WaitOnCloudInit        *bool          `yaml:"wait-on-cloud-init,omitempty" flag:"no-wait-cloud-init"`
+	Attach                 *bool          `yaml:"attach,omitempty" flag:"attach"`
+	NoTermination          *bool          `yaml:"no-terminate,omitempty" flag:"no-terminate"`
+	Command                *string        `yaml:"command,omitempty"`
+	EnvVars                []string       `yaml:"environment,omitempty" flag:"environment"`
+	CreateFleetRetries     *int64         `yaml:"max-fleet-retries,omitempty" flag:"max-fleet-retries"`
+	LaunchTemplateName     *string        `yaml:"launch-template-name,omitempty" flag:"launch-template-name"`
+	BlockDurationInMinutes *int64         `yaml:"block-duration-minutes,omitempty" flag:"block-duration-minutes"`
+	CapacityStrategy       *string        `yaml:"capacity-strategy,omitempty" flag:"capacity-strategy"`
+	MaxSpotRetries         *int64         `yaml:"max-spot-retries,omitempty" flag:"max-spot-retries"`
+	NoColor                *bool          `yaml:"no-color,omitempty" flag:"no-color"`
+	Uploads                []string       `yaml:"uploads,omitempty" flag:"upload"`
+	Downloads              []string       `yaml:"downloads,omitempty" flag:"download"`
+	ConnectVia             *string        `yaml:"connect-via,omitempty" flag:"connect-via"`
+	SSMLogGroup            *string        `yaml:"ssm-log-group,omitempty" flag:"ssm-log-group"`
+	JumpHosts              []string       `yaml:"jump-hosts,omitempty" flag:"jump-host"`
+	JumpIdentityFile       *string        `yaml:"jump-identity-file,omitempty" flag:"jump-identity-file"`
+	StrictHostKeyChecking  *bool          `yaml:"strict-host-key-checking,omitempty" flag:"strict-host-key-checking"`
+	EFS                    []string       `yaml:"efs,omitempty" flag:"efs"`
+	Timeout                *time.Duration `yaml:"timeout,omitempty" flag:"timeout"`
+	MaxInterruptionRetries *int           `yaml:"max-interruption-retries,omitempty" flag:"max-interruption-retries"`
+	Detach                 *bool          `yaml:"detach,omitempty" flag:"detach"`
+	MaxCost                *float64       `yaml:"max-cost,omitempty" flag:"max-cost"`
+}
+
+// JobError lists every problem found in a job definition, each prefixed with its line
+type JobError struct {
+	File   string
+	Errors []string
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("invalid job definition %s:\n  %s", e.File, strings.Join(e.Errors, "\n  "))
+}
+
+// LoadJob reads a YAML or JSON job definition
+func LoadJob(filename string) (*Job, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read job definition %s: %s", filename, err)
+	}
+
+	job, errs := parseJob(data)
+	if len(errs) > 0 {
+		return nil, &JobError{File: filename, Errors: errs}
+	}
+	return job, nil
+}
+
+// parseJob decodes a job definition, returning every schema error found
+func parseJob(data []byte) (*Job, []string) {
+	var job Job
+	mapping, errs := decodeYAML(data, &job)
+	if mapping == nil {
+		return nil, errs
+	}
+
+	errs = append(errs, validateVersion(mapping)...)
+	errs = append(errs, validateOptions(mapping)...)
+
+	return &job, errs
+}
+
+// decodeYAML strictly decodes a YAML or JSON mapping into v. It returns the mapping node, or
+// nil when the document is not a mapping, and every error found.
+func decodeYAML(data []byte, v interface{}) (*yaml.Node, []string) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, []string{"line 1: expected a mapping of options"}
+	}
+
+	var errs []string
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && err != io.EOF {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			errs = append(errs, typeErr.Errors...)
+		} else {
+			errs = append(errs, strings.TrimPrefix(err.Error(), "yaml: "))
+		}
+	}
+
+	return root.Content[0], errs
+}
+
+// validateVersion checks the mapping declares the current schema version
+func validateVersion(mapping *yaml.Node) []string {
+	version := jobValue(mapping, "version")
+	switch {
+	case version == nil:
+		return []string{fmt.Sprintf("line %d: version is required. The current version is %d", mapping.Line, JobVersion)}
+	case version.Value != fmt.Sprint(JobVersion):
+		return []string{fmt.Sprintf("line %d: unsupported version %s. The current version is %d", version.Line, version.Value, JobVersion)}
+	}
+	return nil
+}
+
+// validateOptions checks option values that the decoder can't
+func validateOptions(mapping *yaml.Node) []string {
+	var errs []string
+
+	validators := []struct {
+		key      string
+		validate func(string) error
+	}{
+		{"capacity-strategy", ValidateCapacityStrategy},
+		{"connect-via", ValidateConnectVia},
+	}
+	for _, validator := range validators {
+		if value := jobValue(mapping, validator.key); value != nil && value.Kind == yaml.ScalarNode {
+			if err := validator.validate(value.Value); err != nil {
+				errs = append(errs, fmt.Sprintf("line %d: %s", value.Line, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// jobValue returns the value of a key in a mapping, or nil when it's not set
+func jobValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Apply sets each option defined in the job on opts unless changed reports its flag was set
+func (options JobOptions) Apply(opts *InstanceOptions, changed func(flag string) bool) {
+	values := reflect.ValueOf(options)
+	target := reflect.ValueOf(opts).Elem()
+
+	for i := 0; i < values.NumField(); i++ {
+		field := values.Type().Field(i)
+		value := values.Field(i)
+		if value.IsNil() {
+			continue
+		}
+
+		if flag := field.Tag.Get("flag"); flag != "" && changed(flag) {
+			continue
+		}
+
+		if value.Kind() == reflect.Ptr {
+			value = value.Elem()
+		}
+		target.FieldByName(field.Name).Set(value)
+	}
+}
+
+// merge returns the options with any option they don't define taken from base
+func (options JobOptions) merge(base JobOptions) JobOptions {
+	merged := reflect.ValueOf(&base).Elem()
+	values := reflect.ValueOf(options)
+
+	for i := 0; i < values.NumField(); i++ {
+		if !values.Field(i).IsNil() {
+			merged.Field(i).Set(values.Field(i))
+		}
+	}
+
+	return base
+}
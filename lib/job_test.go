@@ -0,0 +1,122 @@
+package ec2
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJob(t *testing.T) {
+	job, errs := parseJob([]byte(`version: 1
+ami-filters:
+  - owner-alias=amazon
+  - name=amzn2-ami-hvm*x86_64-ebs
+subnet-filters: [tag:Environment=qa, tag:Type=private]
+instance-types: [t2.micro]
+count: 2
+tags:
+  - Name=Hello World
+environment:
+  - ENVIRONMENT=qa
+uploads:
+  - ./src:/opt/src
+command: echo "Hello world"
+`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if !equalStrings(job.Options.AMIFilter, []string{"owner-alias=amazon", "name=amzn2-ami-hvm*x86_64-ebs"}) {
+		t.Errorf("got ami filters %v", job.Options.AMIFilter)
+	}
+	if *job.Options.Count != 2 {
+		t.Errorf("got count %d, want 2", *job.Options.Count)
+	}
+	if *job.Options.Command != `echo "Hello world"` {
+		t.Errorf("got command %s", *job.Options.Command)
+	}
+}
+
+func TestParseJobJSON(t *testing.T) {
+	job, errs := parseJob([]byte(`{"version": 1, "ami-id": "ami-12345678", "instance-types": ["t3.large"]}`))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if *job.Options.AMIID != "ami-12345678" || !equalStrings(job.Options.InstanceTypes, []string{"t3.large"}) {
+		t.Errorf("got %+v", job.Options)
+	}
+}
+
+func TestParseJobErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "missing version", data: "ami: foo\n", want: []string{"line 1: version is required"}},
+		{name: "unsupported version", data: "version: 2\n", want: []string{"line 1: unsupported version 2"}},
+		{name: "unknown field", data: "version: 1\ncount: 1\namis: foo\n", want: []string{"line 3: field amis not found"}},
+		{name: "wrong type", data: "version: 1\ncount: many\n", want: []string{"line 2: cannot unmarshal"}},
+		{name: "unknown value", data: "version: 1\n\nconnect-via: carrier-pigeon\n", want: []string{"line 3: unknown connection mode carrier-pigeon"}},
+		{name: "several errors", data: "version: 1\ncount: many\ncapacity-strategy: cheap\n", want: []string{"line 2: cannot unmarshal", "line 3: unknown capacity strategy cheap"}},
+		{name: "not a mapping", data: "- ami: foo\n", want: []string{"line 1: expected a mapping of options"}},
+		{name: "malformed", data: "version: 1\nami: [\n", want: []string{"line 2: did not find expected node content"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := parseJob([]byte(tt.data))
+			if len(errs) != len(tt.want) {
+				t.Fatalf("got errors %q, want %d", errs, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(errs[i], want) {
+					t.Errorf("got error %q, want it to contain %q", errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestJobApply(t *testing.T) {
+	job, errs := parseJob([]byte("version: 1\nami: from-file\nsubnet: from-file\ncount: 3\ncommand: from-file\n"))
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	opts := InstanceOptions{AMI: "from-flag", Subnet: "default", Count: 1, User: "ec2-user"}
+	job.Options.Apply(&opts, func(flag string) bool {
+		return flag == "ami"
+	})
+
+	if opts.AMI != "from-flag" {
+		t.Errorf("flag should override the file, got ami %s", opts.AMI)
+	}
+	if opts.Subnet != "from-file" || opts.Count != 3 || opts.Command != "from-file" {
+		t.Errorf("file should override defaults, got %+v", opts)
+	}
+	if opts.User != "ec2-user" {
+		t.Errorf("options missing from the file should be kept, got user %s", opts.User)
+	}
+}
+
+func TestJobOptionsMatchInstanceOptions(t *testing.T) {
+	options := reflect.TypeOf(JobOptions{})
+	target := reflect.TypeOf(InstanceOptions{})
+
+	for i := 0; i < options.NumField(); i++ {
+		field := options.Field(i)
+		targetField, ok := target.FieldByName(field.Name)
+		if !ok {
+			t.Errorf("InstanceOptions has no field %s", field.Name)
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType != targetField.Type {
+			t.Errorf("%s is a %s in the job and a %s in InstanceOptions", field.Name, fieldType, targetField.Type)
+		}
+	}
+}
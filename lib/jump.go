@@ -0,0 +1,153 @@
+package ec2
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// JumpHost is a bastion SSH connections are tunneled through
+type JumpHost struct {
+	User string
+	Host string
+	Port int
+}
+
+// Address returns the host:port of the jump host
+func (jump JumpHost) Address() string {
+	return net.JoinHostPort(jump.Host, strconv.Itoa(jump.Port))
+}
+
+func (jump JumpHost) String() string {
+	return fmt.Sprintf("%s@%s", jump.User, jump.Address())
+}
+
+// parseJumpHosts parses [user@]host[:port] specs. The user defaults to the local user and the
+// port to 22.
+func parseJumpHosts(specs []string) ([]JumpHost, error) {
+	var jumps []JumpHost
+	for _, spec := range specs {
+		jump := JumpHost{Host: spec, Port: 22}
+
+		if i := strings.LastIndex(jump.Host, "@"); i >= 0 {
+			jump.User, jump.Host = jump.Host[:i], jump.Host[i+1:]
+		}
+
+		if host, port, err := net.SplitHostPort(jump.Host); err == nil {
+			jump.Host = host
+			jump.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("unable to derive jump host port from: %s", spec)
+			}
+		}
+
+		if jump.Host == "" {
+			return nil, fmt.Errorf("unable to derive jump host from: %s", spec)
+		}
+
+		if jump.User == "" {
+			current, err := user.Current()
+			if err != nil {
+				return nil, fmt.Errorf("unable to determine the user for jump host %s: %s", spec, err)
+			}
+			jump.User = current.Username
+		}
+
+		jumps = append(jumps, jump)
+	}
+	return jumps, nil
+}
+
+// jumpAuth returns the authentication used for jump hosts: the given identity file and the
+// SSH agent, or the instance's own authentication when it's empty
+func jumpAuth(identityFile string, instanceAuth []ssh.AuthMethod) ([]ssh.AuthMethod, error) {
+	if identityFile == "" {
+		return instanceAuth, nil
+	}
+
+	signer, err := readIdentityFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ssh.AuthMethod{publicKeyAuth([]ssh.Signer{signer})}, nil
+}
+
+// tunnelConn is a connection tunneled through jump hosts. Closing it closes every jump host
+// connection too.
+type tunnelConn struct {
+	net.Conn
+	jumps []*ssh.Client
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	closeJumps(c.jumps)
+	return err
+}
+
+// closeJumps closes jump host connections, last hop first
+func closeJumps(jumps []*ssh.Client) {
+	for i := len(jumps) - 1; i >= 0; i-- {
+		jumps[i].Close()
+	}
+}
+
+// dialTCP opens a TCP connection to addr, tunneled through each jump host in turn
+func (instance *Instance) dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	if len(instance.JumpHosts) == 0 {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+
+	var jumps []*ssh.Client
+	for _, jump := range instance.JumpHosts {
+		config := &ssh.ClientConfig{
+			User:            jump.User,
+			Auth:            instance.jumpAuth,
+			HostKeyCallback: instance.jumpHostKeyCallback,
+			Timeout:         timeout,
+		}
+
+		var client *ssh.Client
+		var err error
+		if len(jumps) == 0 {
+			client, err = ssh.Dial("tcp", jump.Address(), config)
+		} else {
+			client, err = dialThrough(jumps[len(jumps)-1], jump.Address(), config)
+		}
+		if err != nil {
+			closeJumps(jumps)
+			return nil, fmt.Errorf("unable to connect to jump host %s: %s", jump, err)
+		}
+		jumps = append(jumps, client)
+	}
+
+	conn, err := jumps[len(jumps)-1].Dial("tcp", addr)
+	if err != nil {
+		closeJumps(jumps)
+		return nil, err
+	}
+
+	return &tunnelConn{Conn: conn, jumps: jumps}, nil
+}
+
+// dialThrough opens an SSH connection to addr tunneled through an existing connection
+func dialThrough(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
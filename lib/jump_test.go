@@ -0,0 +1,183 @@
+package ec2
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os/user"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec    string
+		want    JumpHost
+		wantErr bool
+	}{
+		{spec: "ec2-user@bastion.example.com", want: JumpHost{User: "ec2-user", Host: "bastion.example.com", Port: 22}},
+		{spec: "ops@10.1.0.5:2222", want: JumpHost{User: "ops", Host: "10.1.0.5", Port: 2222}},
+		{spec: "bastion", want: JumpHost{User: current.Username, Host: "bastion", Port: 22}},
+		{spec: "ops@[2001:db8::1]:22", want: JumpHost{User: "ops", Host: "2001:db8::1", Port: 22}},
+		{spec: "ops@", wantErr: true},
+		{spec: "ops@bastion:ssh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseJumpHosts([]string{tt.spec})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got[0] != tt.want {
+				t.Errorf("got %+v, want %+v", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestDialTCPThroughJumpHosts(t *testing.T) {
+	// an echo server standing in for the instance's SSH port
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	instance := &Instance{
+		JumpHosts:           []JumpHost{startJumpHost(t), startJumpHost(t)},
+		jumpAuth:            []ssh.AuthMethod{ssh.Password("secret")},
+		jumpHostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	conn, err := instance.dialTCP(target.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q through the tunnel, want ping", buf)
+	}
+}
+
+// startJumpHost starts an SSH server on localhost that only forwards TCP connections
+func startJumpHost(t *testing.T) JumpHost {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "jump" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveJumpConn(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return JumpHost{User: "jump", Host: addr.IP.String(), Port: addr.Port}
+}
+
+func serveJumpConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only port forwarding is supported")
+			continue
+		}
+
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		upstream, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			io.Copy(channel, upstream)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(upstream, channel)
+			upstream.Close()
+		}()
+	}
+}
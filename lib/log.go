@@ -0,0 +1,125 @@
+package ec2
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log levels, from the most to the least verbose
+const (
+	// LevelDebug messages detail every attempt and step
+	LevelDebug Level = iota
+	// LevelInfo messages report progress
+	LevelInfo
+	// LevelWarn messages report something unexpected the run recovered from
+	LevelWarn
+	// LevelError messages report failures
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+// Log receives the tool's own messages, keeping stdout for the command's output
+var Log = NewLogger(os.Stderr, LevelInfo)
+
+// Logger writes messages at or above its level, one complete line at a time so messages from
+// several instances never interleave
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	// Timestamps prefixes each line with the time and level, as suited to log files
+	Timestamps bool
+	// Events receives messages as log events instead, for logs sharing a stream with
+	// lifecycle events
+	Events *Events
+}
+
+// NewLogger returns a Logger writing messages at or above level to w
+func NewLogger(w io.Writer, level Level) *Logger {
+	return &Logger{out: w, level: level}
+}
+
+// Debugf logs a debug message
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs an informational message
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a warning
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs an error
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Enabled reports whether messages at level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Writer returns a writer for output at level, such as tables, which discards everything
+// when the level is not enabled. With Events set only complete lines are written.
+func (l *Logger) Writer(level Level) io.Writer {
+	if !l.Enabled(level) {
+		return ioutil.Discard
+	}
+	// tables are written a cell at a time, so lines are buffered to emit one event per row
+	if l.Events != nil {
+		return newPrefixWriter(&eventWriter{events: l.Events, event: Event{Type: EventLog, Level: strings.ToLower(level.String())}}, "", nil)
+	}
+	return &lockedWriter{l}
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	if l.Events != nil {
+		l.Events.Emit(Event{Type: EventLog, Level: strings.ToLower(level.String()), Message: message})
+		return
+	}
+	if l.Timestamps {
+		message = fmt.Sprintf("%s %-5s %s", time.Now().Format(time.RFC3339), level, message)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, message)
+}
+
+type lockedWriter struct {
+	l *Logger
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	defer w.l.mu.Unlock()
+	return w.l.out.Write(p)
+}
@@ -0,0 +1,67 @@
+package ec2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelWarn)
+
+	l.Debugf("debug")
+	l.Infof("info")
+	l.Warnf("warn %d", 1)
+	l.Errorf("error\n")
+	fmt.Fprint(l.Writer(LevelInfo), "table")
+	fmt.Fprint(l.Writer(LevelError), "report\n")
+
+	if got, want := buf.String(), "warn 1\nerror\nreport\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLoggerTimestamps(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelDebug)
+	l.Timestamps = true
+
+	l.Debugf("waiting")
+
+	fields := strings.Fields(buf.String())
+	if len(fields) != 3 || fields[1] != "DEBUG" || fields[2] != "waiting" {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+}
+
+func TestLoggerWriterEmitsRowsAsEvents(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelInfo)
+	l.Events = NewEvents(&buf)
+
+	tw := tabwriter.NewWriter(l.Writer(LevelInfo), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tTYPE\tEXIT CODE")
+	fmt.Fprintln(tw, "i-00000000000000001\tt2.micro\t0")
+	tw.Flush()
+
+	var messages []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var event Event
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != EventLog || event.Level != "info" {
+			t.Errorf("unexpected event %+v", event)
+		}
+		messages = append(messages, event.Message)
+	}
+
+	if len(messages) != 2 || !strings.HasPrefix(messages[0], "INSTANCE") || !strings.HasPrefix(messages[1], "i-00000000000000001") {
+		t.Errorf("got messages %q, want one per row", messages)
+	}
+}
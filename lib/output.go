@@ -0,0 +1,79 @@
+package ec2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// outputMu serializes lines written by every instance so they don't interleave
+var outputMu sync.Mutex
+
+// prefixWriter buffers output and writes it line by line to w, prefixing each line
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+// newPrefixWriter returns a prefixWriter. If color is a hex color the prefix is rendered in
+// that color.
+func newPrefixWriter(w io.Writer, prefix string, color *string) *prefixWriter {
+	if color != nil {
+		prefix = colorize(prefix, *color)
+	}
+	return &prefixWriter{w: w, prefix: prefix}
+}
+
+// Write buffers p and writes every complete line
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf.Write(p)
+	for {
+		i := bytes.IndexByte(pw.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		if err := pw.writeLine(pw.buf.Next(i + 1)); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any remaining partial line
+func (pw *prefixWriter) Flush() error {
+	if pw.buf.Len() == 0 {
+		return nil
+	}
+	line := append(pw.buf.Next(pw.buf.Len()), '\n')
+	return pw.writeLine(line)
+}
+
+func (pw *prefixWriter) writeLine(line []byte) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := pw.w.Write(append([]byte(pw.prefix), line...))
+	return err
+}
+
+// colorize wraps s in the ANSI escape codes for a hex color such as #1c417f
+func colorize(s, hex string) string {
+	if len(hex) != 7 || hex[0] != '#' {
+		return s
+	}
+	rgb, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return s
+	}
+	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm%s\x1b[0m", rgb>>16&0xff, rgb>>8&0xff, rgb&0xff, s)
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,39 @@
+package ec2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw := newPrefixWriter(&buf, "[1 i-0123] ", nil)
+
+	pw.Write([]byte("hello "))
+	if buf.Len() != 0 {
+		t.Fatalf("partial lines should be buffered, got %q", buf.String())
+	}
+
+	pw.Write([]byte("world\nsecond line\nthird"))
+	if err := pw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[1 i-0123] hello world\n[1 i-0123] second line\n[1 i-0123] third\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixWriterColor(t *testing.T) {
+	var buf bytes.Buffer
+	color := "#1c417f"
+	pw := newPrefixWriter(&buf, "[2] ", &color)
+
+	pw.Write([]byte("line\n"))
+
+	want := "\x1b[38;2;28;65;127m[2] \x1b[0mline\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
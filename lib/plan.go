@@ -0,0 +1,258 @@
+package ec2
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// PermissionCheck is the outcome of a dry run of an EC2 operation a run needs
+type PermissionCheck struct {
+	Operation string
+	Allowed   bool
+	// Err explains why the operation is not allowed
+	Err error
+}
+
+// Plan is everything a run would launch an instance with, resolved against AWS without
+// creating anything
+type Plan struct {
+	Index            int
+	AMIID            string
+	AMIName          string
+	AMICreationDate  string
+	SubnetID         string
+	AvailabilityZone string
+	CidrBlock        string
+	// SecurityGroups are formatted as name (id)
+	SecurityGroups   []string
+	KeyName          string
+	CapacityStrategy string
+	InstanceTypes    []string
+	// SpotPrices is the current spot price of each instance type in the subnet's zone
+	SpotPrices map[string]float64
+	// OnDemandPrices are the on-demand prices of the instance types whose price is known
+	OnDemandPrices map[string]float64
+	// BidPrices are the bids of the instance types that have one
+	BidPrices map[string]float64
+	// BidPriceErr is set when the spot price of every instance type exceeds its bid
+	BidPriceErr *BidPriceError
+	Checks      []PermissionCheck
+}
+
+// Plan resolves what the instance would be launched with and dry runs the requests that
+// would launch it to verify the caller is allowed to make them
+func (instance *Instance) Plan() (*Plan, error) {
+	plan := &Plan{
+		Index:            instance.Index,
+		AMIID:            aws.StringValue(instance.AMIID),
+		SubnetID:         aws.StringValue(instance.SubnetID),
+		KeyName:          stringPointerValueOrNil(instance.KeyName, "ephemeral key pair"),
+		CapacityStrategy: *instance.CapacityStrategy,
+		InstanceTypes:    *instance.InstanceTypes,
+		OnDemandPrices:   make(map[string]float64),
+		BidPrices:        make(map[string]float64),
+		BidPriceErr:      instance.bidPriceErr,
+	}
+	for _, instanceType := range plan.InstanceTypes {
+		if bid := instance.bidPrice(instanceType); bid > 0 {
+			plan.BidPrices[instanceType] = bid
+		}
+	}
+
+	images, err := instance.Client.EC2.DescribeImages(&ec2.DescribeImagesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("image-id"), Values: []*string{instance.AMIID}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe AMI %s: %s", plan.AMIID, err)
+	}
+	if len(images.Images) == 0 {
+		return nil, fmt.Errorf("AMI %s does not exist", plan.AMIID)
+	}
+	plan.AMIName = aws.StringValue(images.Images[0].Name)
+	plan.AMICreationDate = aws.StringValue(images.Images[0].CreationDate)
+
+	subnets, err := instance.Client.EC2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{instance.SubnetID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe subnet %s: %s", plan.SubnetID, err)
+	}
+	if len(subnets.Subnets) == 0 {
+		return nil, fmt.Errorf("Subnet %s does not exist", plan.SubnetID)
+	}
+	plan.AvailabilityZone = aws.StringValue(subnets.Subnets[0].AvailabilityZone)
+	plan.CidrBlock = aws.StringValue(subnets.Subnets[0].CidrBlock)
+
+	// Without security groups the instance gets the VPC's default group. Describing no IDs
+	// would describe every group instead.
+	if len(instance.SecurityGroupIDs) > 0 {
+		groups, err := instance.Client.EC2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupIds: instance.SecurityGroupIDs,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to describe security groups: %s", err)
+		}
+		for _, group := range groups.SecurityGroups {
+			plan.SecurityGroups = append(plan.SecurityGroups, fmt.Sprintf("%s (%s)", aws.StringValue(group.GroupName), aws.StringValue(group.GroupId)))
+		}
+	}
+
+	if plan.CapacityStrategy != CapacityStrategyOnDemandOnly {
+		plan.SpotPrices, err = spotPrices(instance.Client, plan.AvailabilityZone, plan.InstanceTypes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// On-demand instances may be launched by every strategy but spot-only
+	if plan.CapacityStrategy != CapacityStrategySpotOnly {
+		for _, instanceType := range plan.InstanceTypes {
+			price, err := instance.Client.Prices.OnDemand(instanceType)
+			if err != nil {
+				Log.Debugf("%s", err)
+				continue
+			}
+			plan.OnDemandPrices[instanceType] = price
+		}
+	}
+
+	plan.Checks = instance.checkPermissions()
+
+	return plan, nil
+}
+
+// checkPermissions dry runs the requests made to launch the instance. Instant fleets launch
+// instances with the caller's RunInstances permission so that is checked as well. The launch
+// template is never created so EC2 answers an authorized fleet request by saying it does not
+// exist.
+func (instance *Instance) checkPermissions() []PermissionCheck {
+	capacityType := instance.initialCapacityType()
+
+	launchTemplate := instance.createLaunchTemplateInput(capacityType)
+	launchTemplate.DryRun = aws.Bool(true)
+	_, launchTemplateErr := instance.Client.EC2.CreateLaunchTemplate(launchTemplate)
+
+	fleet := instance.createFleetInput(capacityType, "1")
+	fleet.DryRun = aws.Bool(true)
+	_, fleetErr := instance.Client.EC2.CreateFleet(fleet)
+	fleetCheck := dryRunCheck("CreateFleet", fleetErr)
+	if aerr, ok := fleetErr.(awserr.Error); ok && aerr.Code() == "InvalidLaunchTemplateName.NotFoundException" {
+		fleetCheck = PermissionCheck{Operation: "CreateFleet", Allowed: true}
+	}
+
+	data := instance.launchTemplateData(capacityType)
+	runInstances := &ec2.RunInstancesInput{
+		DryRun:           aws.Bool(true),
+		ImageId:          data.ImageId,
+		InstanceType:     aws.String((*instance.InstanceTypes)[0]),
+		KeyName:          data.KeyName,
+		MinCount:         aws.Int64(1),
+		MaxCount:         aws.Int64(1),
+		SubnetId:         instance.SubnetID,
+		SecurityGroupIds: instance.SecurityGroupIDs,
+	}
+	if instance.IamInstanceProfile != nil {
+		runInstances.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{Name: instance.IamInstanceProfile}
+	}
+	if data.InstanceMarketOptions != nil {
+		runInstances.InstanceMarketOptions = &ec2.InstanceMarketOptionsRequest{MarketType: aws.String("spot")}
+	}
+	_, runInstancesErr := instance.Client.EC2.RunInstances(runInstances)
+
+	return []PermissionCheck{
+		dryRunCheck("CreateLaunchTemplate", launchTemplateErr),
+		fleetCheck,
+		dryRunCheck("RunInstances", runInstancesErr),
+	}
+}
+
+// dryRunCheck interprets the error EC2 answers a dry run with
+func dryRunCheck(operation string, err error) PermissionCheck {
+	check := PermissionCheck{Operation: operation}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "DryRunOperation" {
+		check.Allowed = true
+		return check
+	}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "UnauthorizedOperation" {
+		check.Err = fmt.Errorf("not authorized: %s", aerr.Message())
+		return check
+	}
+	if err == nil {
+		err = fmt.Errorf("%s did not fail its dry run", operation)
+	}
+	check.Err = err
+	return check
+}
+
+// Launchable reports whether instances would be launched at the bids
+func (plan *Plan) Launchable() bool {
+	return plan.BidPriceErr == nil || plan.CapacityStrategy == CapacityStrategySpotThenOnDemand
+}
+
+// Allowed reports whether every permission check passed
+func (plan *Plan) Allowed() bool {
+	for _, check := range plan.Checks {
+		if !check.Allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// Write prints the plan
+func (plan *Plan) Write(w io.Writer) error {
+	var types []string
+	for _, instanceType := range plan.InstanceTypes {
+		var details []string
+		if price, ok := plan.SpotPrices[instanceType]; ok {
+			details = append(details, fmt.Sprintf("$%g/hour spot", price))
+		}
+		if price, ok := plan.OnDemandPrices[instanceType]; ok {
+			details = append(details, fmt.Sprintf("$%g/hour on-demand", price))
+		}
+		if bid, ok := plan.BidPrices[instanceType]; ok {
+			details = append(details, fmt.Sprintf("bid $%g", bid))
+		}
+		if len(details) > 0 {
+			instanceType = fmt.Sprintf("%s (%s)", instanceType, strings.Join(details, ", "))
+		}
+		types = append(types, instanceType)
+	}
+
+	groups := append([]string{}, plan.SecurityGroups...)
+	sort.Strings(groups)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Instance %d\n", plan.Index)
+	fmt.Fprintf(tw, "  AMI:\t%s %s (created %s)\n", plan.AMIID, plan.AMIName, orDash(plan.AMICreationDate))
+	fmt.Fprintf(tw, "  Subnet:\t%s %s %s\n", plan.SubnetID, plan.AvailabilityZone, plan.CidrBlock)
+	if len(groups) == 0 {
+		groups = []string{"VPC default"}
+	}
+	fmt.Fprintf(tw, "  Security groups:\t%s\n", strings.Join(groups, ", "))
+	fmt.Fprintf(tw, "  Key pair:\t%s\n", plan.KeyName)
+	fmt.Fprintf(tw, "  Capacity strategy:\t%s\n", plan.CapacityStrategy)
+	fmt.Fprintf(tw, "  Instance types:\t%s\n", strings.Join(types, ", "))
+	if plan.BidPriceErr != nil {
+		outcome := "no instance would be launched"
+		if plan.CapacityStrategy == CapacityStrategySpotThenOnDemand {
+			outcome = "on-demand instances would be launched instead"
+		}
+		fmt.Fprintf(tw, "  Bids:\t%s, %s\n", plan.BidPriceErr, outcome)
+	}
+	for _, check := range plan.Checks {
+		result := "allowed"
+		if !check.Allowed {
+			result = check.Err.Error()
+		}
+		fmt.Fprintf(tw, "  %s:\t%s\n", check.Operation, result)
+	}
+	return tw.Flush()
+}
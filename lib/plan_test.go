@@ -0,0 +1,178 @@
+package ec2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestPlanCreatesNothing(t *testing.T) {
+	client, f := newTestClient()
+	cleanup := NewCleanup()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+		opts.Cleanup = cleanup
+	})
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.KeyPairs) != 0 || len(f.LaunchTemplates) != 0 || len(f.Instances) != 0 {
+		t.Errorf("dry run created %d key pairs, %d launch templates and %d instances", len(f.KeyPairs), len(f.LaunchTemplates), len(f.Instances))
+	}
+	if len(cleanup.resources) != 0 {
+		t.Errorf("dry run registered %d resources for cleanup", len(cleanup.resources))
+	}
+
+	if plan.AMIID != "ami-new" || plan.AMIName != "amzn2-ami-hvm-2.0.20200101-x86_64-ebs" || plan.AMICreationDate != "2020-01-01T00:00:00.000Z" {
+		t.Errorf("unexpected AMI in plan %+v", plan)
+	}
+	if plan.SubnetID != "subnet-private" || plan.AvailabilityZone != "us-east-1b" || plan.CidrBlock != "10.0.1.0/24" {
+		t.Errorf("unexpected subnet in plan %+v", plan)
+	}
+	if !equalStrings(plan.SecurityGroups, []string{"qa_private (sg-private)"}) {
+		t.Errorf("got security groups %v", plan.SecurityGroups)
+	}
+	if plan.SpotPrices["t2.small"] != 0.0035 {
+		t.Errorf("got spot prices %v, want 0.0035", plan.SpotPrices)
+	}
+	if !plan.Allowed() {
+		t.Errorf("expected every check to be allowed, got %+v", plan.Checks)
+	}
+
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "t2.micro ($0.0035/hour spot)") {
+		t.Errorf("plan is missing spot prices:\n%s", buf.String())
+	}
+}
+
+func TestPlanReportsBidPriceExceeded(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+		opts.BidPrice = 0.001
+	})
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.BidPriceErr == nil || plan.Launchable() {
+		t.Fatalf("expected the plan to report the bid is too low, got %+v", plan)
+	}
+
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "no instance would be launched") {
+		t.Errorf("plan is missing the bid price error:\n%s", buf.String())
+	}
+}
+
+func TestPlanOnDemandPrices(t *testing.T) {
+	client, _ := newTestClient()
+	api := fake.NewPricing()
+	api.Prices["t2.micro"] = "0.0116"
+	client.Prices = NewPrices(api, "us-east-1", "")
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+		opts.CapacityStrategy = CapacityStrategyOnDemandOnly
+	})
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.SpotPrices) != 0 || plan.OnDemandPrices["t2.micro"] != 0.0116 {
+		t.Errorf("got spot prices %v and on-demand prices %v, want only the on-demand price of t2.micro", plan.SpotPrices, plan.OnDemandPrices)
+	}
+
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "t2.micro ($0.0116/hour on-demand)") {
+		t.Errorf("plan is missing on-demand prices:\n%s", buf.String())
+	}
+}
+
+func TestPlanWithoutSecurityGroups(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+		opts.SecurityGroups = nil
+	})
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.SecurityGroups) != 0 {
+		t.Errorf("got security groups %v, want the VPC default", plan.SecurityGroups)
+	}
+
+	var buf bytes.Buffer
+	if err := plan.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "VPC default") {
+		t.Errorf("plan is missing the default security group:\n%s", buf.String())
+	}
+}
+
+func TestPlanReportsDeniedOperations(t *testing.T) {
+	client, f := newTestClient()
+	f.Unauthorized = []string{"CreateFleet"}
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+	})
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Allowed() {
+		t.Fatal("expected the plan not to be allowed")
+	}
+	for _, check := range plan.Checks {
+		if check.Allowed == (check.Operation == "CreateFleet") {
+			t.Errorf("unexpected check %+v", check)
+		}
+	}
+}
+
+func TestPlanAllowsFleetWithoutLaunchTemplate(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.DryRun = true
+	})
+
+	// EC2 answers the dry run as it would for any fleet whose template does not exist
+	fleet := instance.createFleetInput(instance.initialCapacityType(), "1")
+	fleet.DryRun = aws.Bool(true)
+	_, err := client.EC2.CreateFleet(fleet)
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "InvalidLaunchTemplateName.NotFoundException" {
+		t.Fatalf("got %v, want a missing launch template", err)
+	}
+
+	plan, err := instance.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range plan.Checks {
+		if check.Operation == "CreateFleet" && !check.Allowed {
+			t.Errorf("expected CreateFleet to be allowed, got %s", check.Err)
+		}
+	}
+}
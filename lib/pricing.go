@@ -0,0 +1,196 @@
+package ec2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/aws/aws-sdk-go/service/pricing/pricingiface"
+)
+
+// priceCacheTTL is how long a cached on-demand price is used before it is looked up again
+var priceCacheTTL = 7 * 24 * time.Hour
+
+// Prices looks up the on-demand prices of instance types in a region with the AWS Price List
+// API. Prices are cached in a file so they are still known when the API can't be reached.
+//
+// A nil Prices knows no prices.
+type Prices struct {
+	mu        sync.Mutex
+	api       pricingiface.PricingAPI
+	region    string
+	cacheFile string
+}
+
+// cachedPrice is an on-demand price in the cache file
+type cachedPrice struct {
+	Price   float64   `json:"price"`
+	Updated time.Time `json:"updated"`
+}
+
+// priceCache holds the cached prices by region and instance type
+type priceCache map[string]map[string]cachedPrice
+
+// NewPrices returns Prices for region. No cache is kept when cacheFile is empty.
+func NewPrices(api pricingiface.PricingAPI, region, cacheFile string) *Prices {
+	return &Prices{api: api, region: region, cacheFile: cacheFile}
+}
+
+// DefaultPriceCacheFile returns $XDG_CACHE_HOME/ec2-runner/prices.json, or
+// ~/.cache/ec2-runner/prices.json when XDG_CACHE_HOME is not set
+func DefaultPriceCacheFile() (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("Unable to find the cache directory: %s", err)
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "ec2-runner", "prices.json"), nil
+}
+
+// OnDemand returns the hourly on-demand price in USD of a Linux instance type. A stale cached
+// price is used when the Price List API fails.
+func (p *Prices) OnDemand(instanceType string) (float64, error) {
+	if p == nil {
+		return 0, fmt.Errorf("no on-demand price for %s", instanceType)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cache := p.readCache()
+	cached, ok := cache[p.region][instanceType]
+	if ok && time.Since(cached.Updated) < priceCacheTTL {
+		return cached.Price, nil
+	}
+
+	price, err := p.lookup(instanceType)
+	if err != nil {
+		if ok {
+			Log.Debugf("Using the on-demand price of %s cached %s: %s", instanceType, cached.Updated.Format(time.RFC3339), err)
+			return cached.Price, nil
+		}
+		return 0, err
+	}
+
+	if cache[p.region] == nil {
+		cache[p.region] = make(map[string]cachedPrice)
+	}
+	cache[p.region][instanceType] = cachedPrice{Price: price, Updated: time.Now()}
+	if err := p.writeCache(cache); err != nil {
+		Log.Warnf("%s", err)
+	}
+	return price, nil
+}
+
+// lookup asks the Price List API for the price of a shared tenancy Linux instance
+func (p *Prices) lookup(instanceType string) (float64, error) {
+	filters := [][2]string{
+		{"instanceType", instanceType},
+		{"regionCode", p.region},
+		{"operatingSystem", "Linux"},
+		{"tenancy", "Shared"},
+		{"preInstalledSw", "NA"},
+		{"capacitystatus", "Used"},
+		{"licenseModel", "No License required"},
+	}
+	input := &pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		MaxResults:  aws.Int64(1),
+	}
+	for _, filter := range filters {
+		input.Filters = append(input.Filters, &pricing.Filter{
+			Type:  aws.String(pricing.FilterTypeTermMatch),
+			Field: aws.String(filter[0]),
+			Value: aws.String(filter[1]),
+		})
+	}
+
+	output, err := p.api.GetProducts(input)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to look up the on-demand price of %s: %s", instanceType, err)
+	}
+	if len(output.PriceList) == 0 {
+		return 0, fmt.Errorf("no on-demand price for %s in %s", instanceType, p.region)
+	}
+	return parseOnDemandPrice(output.PriceList[0])
+}
+
+// priceListItem is the part of a Price List API product holding its on-demand price
+type priceListItem struct {
+	Terms struct {
+		OnDemand map[string]struct {
+			PriceDimensions map[string]struct {
+				PricePerUnit map[string]string `json:"pricePerUnit"`
+			} `json:"priceDimensions"`
+		} `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// parseOnDemandPrice returns the USD price of the product's on-demand term
+func parseOnDemandPrice(product aws.JSONValue) (float64, error) {
+	data, err := json.Marshal(product)
+	if err != nil {
+		return 0, err
+	}
+
+	var item priceListItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return 0, fmt.Errorf("Unable to parse price list: %s", err)
+	}
+
+	for _, term := range item.Terms.OnDemand {
+		for _, dimension := range term.PriceDimensions {
+			if usd, ok := dimension.PricePerUnit["USD"]; ok {
+				return strconv.ParseFloat(usd, 64)
+			}
+		}
+	}
+	return 0, fmt.Errorf("price list has no on-demand price in USD")
+}
+
+// readCache returns the cached prices, or none when the cache can't be read
+func (p *Prices) readCache() priceCache {
+	cache := priceCache{}
+	if p.cacheFile == "" {
+		return cache
+	}
+
+	data, err := ioutil.ReadFile(p.cacheFile)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		Log.Debugf("Ignoring unreadable price cache %s: %s", p.cacheFile, err)
+		return priceCache{}
+	}
+	return cache
+}
+
+func (p *Prices) writeCache(cache priceCache) error {
+	if p.cacheFile == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.cacheFile), 0755); err != nil {
+		return fmt.Errorf("Unable to create price cache directory: %s", err)
+	}
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.cacheFile, data, 0644); err != nil {
+		return fmt.Errorf("Unable to write price cache %s: %s", p.cacheFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package ec2
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestOnDemandPriceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec2-runner-prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "ec2-runner", "prices.json")
+
+	api := fake.NewPricing()
+	api.Prices["t3.micro"] = "0.0104"
+
+	price, err := NewPrices(api, "us-east-1", cacheFile).OnDemand("t3.micro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price != 0.0104 {
+		t.Errorf("got %f, want 0.0104", price)
+	}
+
+	// a fresh cached price is used without asking the API
+	price, err = NewPrices(api, "us-east-1", cacheFile).OnDemand("t3.micro")
+	if err != nil || price != 0.0104 || api.Requests != 1 {
+		t.Errorf("got %f, %v after %d requests, want the cached price after 1", price, err, api.Requests)
+	}
+
+	// a stale cached price is used when the API can't be reached
+	defer func(ttl time.Duration) { priceCacheTTL = ttl }(priceCacheTTL)
+	priceCacheTTL = 0
+	api.Offline = true
+	price, err = NewPrices(api, "us-east-1", cacheFile).OnDemand("t3.micro")
+	if err != nil || price != 0.0104 || api.Requests != 2 {
+		t.Errorf("got %f, %v after %d requests, want the stale price after 2", price, err, api.Requests)
+	}
+
+	// prices are cached by region
+	if _, err := NewPrices(api, "eu-west-1", cacheFile).OnDemand("t3.micro"); err == nil {
+		t.Error("expected an error without a price for the region")
+	}
+}
+
+func TestOnDemandPriceUnknown(t *testing.T) {
+	if _, err := NewPrices(fake.NewPricing(), "us-east-1", "").OnDemand("t3.micro"); err == nil {
+		t.Error("expected an error for an instance type without a price")
+	}
+
+	var prices *Prices
+	if _, err := prices.OnDemand("t3.micro"); err == nil {
+		t.Error("expected an error without prices")
+	}
+}
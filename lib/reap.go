@@ -0,0 +1,190 @@
+package ec2
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/packer/common/random"
+)
+
+// Tags added to every resource a run creates so resources left behind by runs that died can
+// be found and reaped
+const (
+	// TagRunID identifies the run that created the resource
+	TagRunID = "ec2-runner:run-id"
+	// TagExpires is the RFC 3339 time after which the resource may be reaped
+	TagExpires = "ec2-runner:expires"
+)
+
+// DefaultRunLifetime is how long after a run starts its resources expire, in addition to the
+// timeout
+const DefaultRunLifetime = 24 * time.Hour
+
+// Types of resource reaped
+const (
+	// ResourceInstance is an EC2 instance, reaped by terminating it
+	ResourceInstance = "instance"
+	// ResourceKeyPair is an ephemeral key pair
+	ResourceKeyPair = "key-pair"
+	// ResourceLaunchTemplate is the launch template of a fleet
+	ResourceLaunchTemplate = "launch-template"
+)
+
+// newRunID returns a random ID for a run
+func newRunID() string {
+	return random.AlphaNumLower(12)
+}
+
+// runExpiry returns when the resources of a run starting now expire
+func runExpiry(now time.Time, timeout time.Duration) time.Time {
+	return now.Add(DefaultRunLifetime + timeout).UTC().Truncate(time.Second)
+}
+
+// runTags returns the tags identifying a run's resources. Resources without an expiry are
+// never reaped.
+func runTags(runID string, expires *time.Time) []*ec2.Tag {
+	if runID == "" {
+		return nil
+	}
+
+	tags := []*ec2.Tag{{Key: aws.String(TagRunID), Value: aws.String(runID)}}
+	if expires != nil {
+		tags = append(tags, &ec2.Tag{Key: aws.String(TagExpires), Value: aws.String(expires.Format(time.RFC3339))})
+	}
+	return tags
+}
+
+// ExpiredResource is a resource created by a run that is past its expiry
+type ExpiredResource struct {
+	Type    string
+	ID      string
+	RunID   string
+	Expires time.Time
+}
+
+func (resource ExpiredResource) String() string {
+	return fmt.Sprintf("%s %s of run %s", resource.Type, resource.ID, resource.RunID)
+}
+
+// ExpiredResources returns the instances, key pairs and launch templates created by runs whose
+// expiry is before now
+func (client *Client) ExpiredResources(now time.Time) ([]ExpiredResource, error) {
+	var resources []ExpiredResource
+	tagged := []*ec2.Filter{{Name: aws.String("tag-key"), Values: []*string{aws.String(TagExpires)}}}
+
+	err := client.EC2.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: append(tagged, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		}),
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				if resource, ok := expiredResource(ResourceInstance, aws.StringValue(instance.InstanceId), instance.Tags, now); ok {
+					resources = append(resources, resource)
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe instances: %s", err)
+	}
+
+	err = client.EC2.DescribeLaunchTemplatesPages(&ec2.DescribeLaunchTemplatesInput{
+		Filters: tagged,
+	}, func(page *ec2.DescribeLaunchTemplatesOutput, lastPage bool) bool {
+		for _, template := range page.LaunchTemplates {
+			if resource, ok := expiredResource(ResourceLaunchTemplate, aws.StringValue(template.LaunchTemplateName), template.Tags, now); ok {
+				resources = append(resources, resource)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe launch templates: %s", err)
+	}
+
+	keyPairs, err := client.EC2.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+		Filters: tagged,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe key pairs: %s", err)
+	}
+	for _, keyPair := range keyPairs.KeyPairs {
+		if resource, ok := expiredResource(ResourceKeyPair, aws.StringValue(keyPair.KeyName), keyPair.Tags, now); ok {
+			resources = append(resources, resource)
+		}
+	}
+
+	return resources, nil
+}
+
+// expiredResource reports whether the resource's expiry tag is before now
+func expiredResource(resourceType, id string, tags []*ec2.Tag, now time.Time) (ExpiredResource, bool) {
+	resource := ExpiredResource{Type: resourceType, ID: id}
+
+	var expires string
+	for _, tag := range tags {
+		switch aws.StringValue(tag.Key) {
+		case TagRunID:
+			resource.RunID = aws.StringValue(tag.Value)
+		case TagExpires:
+			expires = aws.StringValue(tag.Value)
+		}
+	}
+
+	// a malformed expiry is left alone rather than risk deleting something in use
+	t, err := time.Parse(time.RFC3339, expires)
+	if err != nil || !t.Before(now) {
+		return resource, false
+	}
+	resource.Expires = t
+
+	return resource, true
+}
+
+// WithoutDetachedRuns drops the resources of runs whose detached state is saved in dir, as
+// their commands may still be running
+func WithoutDetachedRuns(resources []ExpiredResource, dir string) []ExpiredResource {
+	var kept []ExpiredResource
+	for _, resource := range resources {
+		if resource.RunID != "" {
+			if _, err := os.Stat(runStatePath(dir, resource.RunID)); err == nil {
+				Log.Infof("Skipping %s, the run is detached", resource)
+				continue
+			}
+		}
+		kept = append(kept, resource)
+	}
+	return kept
+}
+
+// Reap terminates or deletes an expired resource
+func (client *Client) Reap(resource ExpiredResource) error {
+	var err error
+	switch resource.Type {
+	case ResourceInstance:
+		_, err = client.EC2.TerminateInstances(&ec2.TerminateInstancesInput{
+			InstanceIds: []*string{aws.String(resource.ID)},
+		})
+	case ResourceLaunchTemplate:
+		_, err = client.EC2.DeleteLaunchTemplate(&ec2.DeleteLaunchTemplateInput{
+			LaunchTemplateName: aws.String(resource.ID),
+		})
+	case ResourceKeyPair:
+		_, err = client.EC2.DeleteKeyPair(&ec2.DeleteKeyPairInput{
+			KeyName: aws.String(resource.ID),
+		})
+	default:
+		return fmt.Errorf("unknown resource type %s", resource.Type)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Unable to reap %s: %s", resource, err)
+	}
+	return nil
+}
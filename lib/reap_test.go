@@ -0,0 +1,145 @@
+package ec2
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReapExpiredResources(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, nil)
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := client.ExpiredResources(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 0 {
+		t.Fatalf("nothing should have expired yet, got %v", resources)
+	}
+
+	resources, err = client.ExpiredResources(time.Now().Add(DefaultRunLifetime + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, resource := range resources {
+		if resource.RunID != *instance.RunID {
+			t.Errorf("got run %s for %s, want %s", resource.RunID, resource, *instance.RunID)
+		}
+		got = append(got, resource.Type+" "+resource.ID)
+		if err := client.Reap(resource); err != nil {
+			t.Error(err)
+		}
+	}
+
+	want := []string{
+		"instance " + *instance.InstanceID,
+		"launch-template " + *instance.LaunchTemplateName,
+		"key-pair " + *instance.KeyName,
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("got expired resources %v, want %v", got, want)
+	}
+
+	if state := *f.Instances[*instance.InstanceID].State.Name; state != ec2.InstanceStateNameShuttingDown {
+		t.Errorf("got instance state %s, want %s", state, ec2.InstanceStateNameShuttingDown)
+	}
+	if _, ok := f.LaunchTemplates[*instance.LaunchTemplateName]; ok {
+		t.Error("launch template was not deleted")
+	}
+	if _, ok := f.KeyPairs[*instance.KeyName]; ok {
+		t.Error("key pair was not deleted")
+	}
+}
+
+func TestReapKeepsInstancesWithoutTermination(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.NoTermination = true
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := client.ExpiredResources(time.Now().Add(DefaultRunLifetime + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range resources {
+		if resource.Type == ResourceInstance {
+			t.Errorf("instances kept with no-terminate should not expire, got %s", resource)
+		}
+	}
+}
+
+func TestReapKeepsDetachedRuns(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Detach = true
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	resources, err := client.ExpiredResources(time.Now().Add(DefaultRunLifetime + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range resources {
+		if resource.Type == ResourceInstance {
+			t.Errorf("instances running detached commands should not expire, got %s", resource)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ec2-runner-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := &RunState{RunID: "detached"}
+	if err := state.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := WithoutDetachedRuns([]ExpiredResource{
+		{Type: ResourceInstance, ID: "i-detached", RunID: "detached"},
+		{Type: ResourceInstance, ID: "i-dead", RunID: "dead"},
+	}, dir)
+	if len(kept) != 1 || kept[0].ID != "i-dead" {
+		t.Errorf("got %v, want only the resources of runs without a detached state", kept)
+	}
+}
+
+func TestExpiredResource(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expires string
+		want    bool
+	}{
+		{expires: "2020-03-01T11:59:59Z", want: true},
+		{expires: "2020-03-01T12:00:01Z", want: false},
+		{expires: "tomorrow", want: false},
+		{expires: "", want: false},
+	}
+
+	for _, tt := range tests {
+		tags := []*ec2.Tag{{Key: aws.String(TagRunID), Value: aws.String("abc")}}
+		if tt.expires != "" {
+			tags = append(tags, &ec2.Tag{Key: aws.String(TagExpires), Value: aws.String(tt.expires)})
+		}
+
+		if _, got := expiredResource(ResourceInstance, "i-1", tags, now); got != tt.want {
+			t.Errorf("expires %q: got expired %t, want %t", tt.expires, got, tt.want)
+		}
+	}
+}
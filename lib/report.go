@@ -0,0 +1,265 @@
+package ec2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Exit policies determine the process exit code when running several instances
+const (
+	// ExitPolicyFirst exits with the first instance's exit code
+	ExitPolicyFirst = "first"
+	// ExitPolicyAnyFail exits with the first non-zero exit code if any instance failed
+	ExitPolicyAnyFail = "any-fail"
+	// ExitPolicyAllFail exits with the first instance's exit code only if every instance failed
+	ExitPolicyAllFail = "all-fail"
+	// ExitPolicyMax exits with the highest exit code of all instances
+	ExitPolicyMax = "max"
+)
+
+// ValidateExitPolicy returns an error for unknown exit policies
+func ValidateExitPolicy(policy string) error {
+	switch policy {
+	case ExitPolicyFirst, ExitPolicyAnyFail, ExitPolicyAllFail, ExitPolicyMax:
+		return nil
+	}
+	return fmt.Errorf("unknown exit policy %s", policy)
+}
+
+// ExitCode computes the exit code for a run from every instance's exit code using the given
+// policy. Instances that never completed their command count as failed with exit code 255.
+func ExitCode(policy string, instances []*Instance) (int, error) {
+	if err := ValidateExitPolicy(policy); err != nil {
+		return 1, err
+	}
+
+	if len(instances) == 0 {
+		return 0, nil
+	}
+
+	var codes []int
+	for _, instance := range instances {
+		code := 255
+		if instance.ExitCode != nil && *instance.ExitCode >= 0 {
+			code = *instance.ExitCode
+		}
+		codes = append(codes, code)
+	}
+
+	switch policy {
+	case ExitPolicyAnyFail:
+		for _, code := range codes {
+			if code != 0 {
+				return code, nil
+			}
+		}
+		return 0, nil
+	case ExitPolicyAllFail:
+		for _, code := range codes {
+			if code == 0 {
+				return 0, nil
+			}
+		}
+		return codes[0], nil
+	case ExitPolicyMax:
+		max := codes[0]
+		for _, code := range codes {
+			if code > max {
+				max = code
+			}
+		}
+		return max, nil
+	}
+
+	return codes[0], nil
+}
+
+// Summary writes a table describing how each instance ran and an estimate of what it cost.
+// The total cost of the run follows when there are several instances.
+func Summary(w io.Writer, instances []*Instance) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tTYPE\tLIFECYCLE\tMAX PRICE\tDURATION\tEST. COST\tEXIT CODE")
+
+	var total float64
+	totalKnown := true
+	for _, instance := range instances {
+		exitCode := "-"
+		if instance.ExitCode != nil && *instance.ExitCode >= 0 {
+			exitCode = fmt.Sprintf("%d", *instance.ExitCode)
+		}
+		if instance.Interrupted {
+			exitCode = "interrupted"
+		}
+		if instance.OverBudget {
+			exitCode = "over-budget"
+		}
+
+		cost := "-"
+		if instance.launched() {
+			value, err := instance.Cost()
+			if err != nil {
+				Log.Debugf("%s", err)
+				totalKnown = false
+			} else {
+				cost = formatCost(value)
+				total += value
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			stringPointerValueOrNil(instance.InstanceID, "-"),
+			stringPointerValueOrNil(instance.SelectedInstanceType, "-"),
+			stringPointerValueOrNil(instance.Lifecycle, "-"),
+			stringPointerValueOrNil(instance.SpotPrice, "-"),
+			instance.durationString(),
+			cost,
+			exitCode,
+		)
+	}
+
+	if len(instances) > 1 {
+		cost := "-"
+		if totalKnown {
+			cost = formatCost(total)
+		}
+		fmt.Fprintf(tw, "TOTAL\t\t\t\t\t%s\t\n", cost)
+	}
+	return tw.Flush()
+}
+
+// HourlyPrice returns what the instance costs an hour in USD: the spot price when it launched,
+// falling back to its max price, or the on-demand price of its instance type. Spot prices
+// change while instances run so the cost of spot instances is an estimate.
+func (instance *Instance) HourlyPrice() (float64, error) {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	return instance.price()
+}
+
+// price returns what the instance costs an hour. instance.mu must be held, so the on-demand
+// price must have been resolved with resolveOnDemandPrice.
+func (instance *Instance) price() (float64, error) {
+	if instance.hourlyPrice != nil {
+		return *instance.hourlyPrice, nil
+	}
+	if instance.SelectedInstanceType == nil {
+		return 0, errors.New("instance was not launched")
+	}
+	if !instance.isSpot() || instance.SpotPrice == nil {
+		return 0, fmt.Errorf("the on-demand price of %s is unknown", *instance.SelectedInstanceType)
+	}
+
+	price, err := strconv.ParseFloat(*instance.SpotPrice, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	instance.hourlyPrice = &price
+	return price, nil
+}
+
+// resolveOnDemandPrice records the on-demand price of an instance that isn't charged a spot
+// price. The Price List API is called without holding instance.mu, which the budget watcher
+// and summary contend on.
+func (instance *Instance) resolveOnDemandPrice() {
+	instance.mu.Lock()
+	known := instance.hourlyPrice != nil || instance.SelectedInstanceType == nil || (instance.isSpot() && instance.SpotPrice != nil)
+	instanceType := aws.StringValue(instance.SelectedInstanceType)
+	instance.mu.Unlock()
+	if known {
+		return
+	}
+
+	price, err := instance.Client.Prices.OnDemand(instanceType)
+	if err != nil {
+		Log.Debugf("%s", err)
+		return
+	}
+
+	instance.mu.Lock()
+	instance.hourlyPrice = &price
+	instance.mu.Unlock()
+}
+
+// minimumBilledDuration is the least EC2 bills an instance for. Beyond it Linux instances are
+// billed by the second.
+const minimumBilledDuration = time.Minute
+
+// Cost returns what the instance has cost in USD so far, or cost in total once terminated,
+// including any instances it replaced after spot interruptions
+func (instance *Instance) Cost() (float64, error) {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	return instance.cost()
+}
+
+// cost returns what the instance has cost. instance.mu must be held.
+func (instance *Instance) cost() (float64, error) {
+	if instance.LaunchTime == nil {
+		return instance.previousCost, nil
+	}
+
+	price, err := instance.price()
+	if err != nil {
+		return 0, err
+	}
+
+	duration := instance.duration()
+	if duration < minimumBilledDuration {
+		duration = minimumBilledDuration
+	}
+	return instance.previousCost + price*duration.Hours(), nil
+}
+
+// launched reports whether the run launched an instance, even one since replaced
+func (instance *Instance) launched() bool {
+	return instance.LaunchTime != nil || instance.Interruptions > 0
+}
+
+func formatCost(cost float64) string {
+	return fmt.Sprintf("$%.4f", cost)
+}
+
+// Duration returns how long the instance has been running, or ran for if it has been
+// terminated
+func (instance *Instance) Duration() time.Duration {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	return instance.duration()
+}
+
+// duration returns how long the instance has run. instance.mu must be held.
+func (instance *Instance) duration() time.Duration {
+	if instance.LaunchTime == nil {
+		return 0
+	}
+
+	end := time.Now()
+	if instance.TerminationTime != nil {
+		end = *instance.TerminationTime
+	}
+
+	return end.Sub(*instance.LaunchTime)
+}
+
+func (instance *Instance) durationString() string {
+	if instance.LaunchTime == nil {
+		return "-"
+	}
+	return instance.Duration().Round(time.Second).String()
+}
+
+// terminated records when the instance was terminated
+func (instance *Instance) terminated() {
+	instance.mu.Lock()
+	defer instance.mu.Unlock()
+	if instance.TerminationTime == nil {
+		instance.TerminationTime = aws.Time(time.Now())
+	}
+}
@@ -0,0 +1,194 @@
+package ec2
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		codes  []int
+		want   int
+	}{
+		{name: "first succeeded", policy: ExitPolicyFirst, codes: []int{0, 2, 3}, want: 0},
+		{name: "first failed", policy: ExitPolicyFirst, codes: []int{4, 0}, want: 4},
+		{name: "any-fail all succeeded", policy: ExitPolicyAnyFail, codes: []int{0, 0, 0}, want: 0},
+		{name: "any-fail one failed", policy: ExitPolicyAnyFail, codes: []int{0, 0, 3}, want: 3},
+		{name: "all-fail one succeeded", policy: ExitPolicyAllFail, codes: []int{1, 0, 3}, want: 0},
+		{name: "all-fail all failed", policy: ExitPolicyAllFail, codes: []int{2, 1, 3}, want: 2},
+		{name: "max", policy: ExitPolicyMax, codes: []int{1, 7, 3}, want: 7},
+		{name: "never completed", policy: ExitPolicyAnyFail, codes: []int{0, -1}, want: 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var instances []*Instance
+			for _, code := range tt.codes {
+				instances = append(instances, &Instance{ExitCode: aws.Int(code)})
+			}
+
+			got, err := ExitCode(tt.policy, instances)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitCodeUnknownPolicy(t *testing.T) {
+	if _, err := ExitCode("most", []*Instance{{ExitCode: aws.Int(0)}}); err == nil {
+		t.Fatal("expected an error for an unknown exit policy")
+	}
+}
+
+func TestSummary(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, nil)
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	*instance.ExitCode = 3
+
+	pending := &Instance{ExitCode: aws.Int(-1)}
+
+	var buf bytes.Buffer
+	if err := Summary(&buf, []*Instance{instance, pending}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want a header, a line per instance and the total:\n%s", len(lines), buf.String())
+	}
+
+	fields := strings.Fields(lines[1])
+	if want := []string{*instance.InstanceID, "t2.micro", "spot", "0.003500"}; !equalStrings(fields[:4], want) {
+		t.Errorf("got %v, want %v", fields[:4], want)
+	}
+	if fields[len(fields)-1] != "3" {
+		t.Errorf("got exit code %s, want 3", fields[len(fields)-1])
+	}
+	// a minute is billed at least
+	if fields[len(fields)-2] != "$0.0001" {
+		t.Errorf("got cost %s, want $0.0001", fields[len(fields)-2])
+	}
+
+	if fields := strings.Fields(lines[2]); !equalStrings(fields, []string{"-", "-", "-", "-", "-", "-", "-"}) {
+		t.Errorf("got %v for an instance that never launched", fields)
+	}
+	if fields := strings.Fields(lines[3]); !equalStrings(fields, []string{"TOTAL", "$0.0001"}) {
+		t.Errorf("got total %v, want $0.0001", fields)
+	}
+}
+
+func TestCost(t *testing.T) {
+	launched := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		duration time.Duration
+		want     float64
+	}{
+		{name: "an hour", duration: time.Hour, want: 0.5},
+		{name: "by the second", duration: 90 * time.Minute, want: 0.75},
+		{name: "a minute at least", duration: time.Second, want: 0.5 / 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &Instance{
+				SelectedInstanceType: aws.String("t2.micro"),
+				Lifecycle:            aws.String("spot"),
+				SpotPrice:            aws.String("0.5"),
+				LaunchTime:           aws.Time(launched),
+				TerminationTime:      aws.Time(launched.Add(tt.duration)),
+			}
+			got, err := instance.Cost()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostOnDemand(t *testing.T) {
+	client, _ := newTestClient()
+	pricing := fake.NewPricing()
+	pricing.Prices["t2.micro"] = "0.0116"
+	client.Prices = NewPrices(pricing, "us-east-1", "")
+
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.CapacityStrategy = CapacityStrategyOnDemandOnly
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	instance.TerminationTime = aws.Time(instance.LaunchTime.Add(2 * time.Hour))
+
+	got, err := instance.Cost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(got-0.0232) > 1e-9 {
+		t.Errorf("got %f, want 0.0232", got)
+	}
+}
+
+func TestOnDemandPriceResolvedAtLaunch(t *testing.T) {
+	client, _ := newTestClient()
+	pricing := fake.NewPricing()
+	pricing.Prices["t2.micro"] = "0.0116"
+	client.Prices = NewPrices(pricing, "us-east-1", "")
+
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.CapacityStrategy = CapacityStrategyOnDemandOnly
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Price List API is never called while the instance is locked
+	client.Prices = nil
+	got, err := instance.HourlyPrice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0.0116 {
+		t.Errorf("got hourly price %f, want 0.0116", got)
+	}
+}
+
+func TestHourlyPriceIsSpotMarketPrice(t *testing.T) {
+	client, f := newTestClient()
+	f.CurrentSpotPrices["t2.micro"] = "0.0021"
+
+	instance := newTestInstance(t, client, nil)
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the request's max price is not what the instance is charged
+	if *instance.SpotPrice != "0.003500" {
+		t.Fatalf("got max price %s, want 0.003500", *instance.SpotPrice)
+	}
+	got, err := instance.HourlyPrice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0.0021 {
+		t.Errorf("got hourly price %f, want the market price 0.0021", got)
+	}
+}
@@ -0,0 +1,278 @@
+package ec2
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Tags describing the run on every instance it launches
+const (
+	// TagCommand is the command the instance runs
+	TagCommand = "ec2-runner:command"
+	// TagUser is the local user who started the run
+	TagUser = "ec2-runner:user"
+	// TagHost is the host the run was started from
+	TagHost = "ec2-runner:host"
+)
+
+// maxTagValueLength is the longest value EC2 accepts for a tag
+const maxTagValueLength = 256
+
+// RunInfo describes an instance launched by a run
+type RunInfo struct {
+	RunID            string            `json:"run-id"`
+	InstanceID       string            `json:"instance-id"`
+	State            string            `json:"state"`
+	InstanceType     string            `json:"instance-type"`
+	Lifecycle        string            `json:"lifecycle"`
+	SpotPrice        string            `json:"spot-price,omitempty"`
+	Command          string            `json:"command,omitempty"`
+	User             string            `json:"user,omitempty"`
+	Host             string            `json:"host,omitempty"`
+	LaunchTime       time.Time         `json:"launch-time"`
+	Uptime           string            `json:"uptime"`
+	Expires          *time.Time        `json:"expires,omitempty"`
+	AMIID            string            `json:"ami-id,omitempty"`
+	SubnetID         string            `json:"subnet-id,omitempty"`
+	AvailabilityZone string            `json:"availability-zone,omitempty"`
+	SecurityGroupIDs []string          `json:"security-group-ids,omitempty"`
+	KeyName          string            `json:"key-name,omitempty"`
+	PrivateIPAddress string            `json:"private-ip,omitempty"`
+	PublicIPAddress  string            `json:"public-ip,omitempty"`
+	StateReason      string            `json:"state-reason,omitempty"`
+	Tags             map[string]string `json:"tags"`
+}
+
+// ownerTags returns the tags describing who started the run and what it runs
+func (instance *Instance) ownerTags() []*ec2.Tag {
+	if instance.RunID == nil {
+		return nil
+	}
+
+	command := stringPointerValueOrNil(instance.Command, "")
+	if command == "" && instance.EntrypointFile != nil {
+		command = filepath.Base(*instance.EntrypointFile)
+	}
+
+	var tags []*ec2.Tag
+	for _, tag := range []struct{ key, value string }{
+		{TagCommand, command},
+		{TagUser, localUser()},
+		{TagHost, localHost()},
+	} {
+		if tag.value == "" {
+			continue
+		}
+		tags = append(tags, &ec2.Tag{Key: aws.String(tag.key), Value: aws.String(truncate(tag.value, maxTagValueLength))})
+	}
+	return tags
+}
+
+// localUser returns the name of the user running this process
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// localHost returns the name of the host running this process
+func localHost() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+// Runs returns the instances launched by runs, oldest first. Terminated instances are only
+// included when all is set.
+func (client *Client) Runs(all bool, now time.Time) ([]*RunInfo, error) {
+	filters := []*ec2.Filter{{Name: aws.String("tag-key"), Values: []*string{aws.String(TagRunID)}}}
+	if !all {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"}),
+		})
+	}
+	return client.describeRuns(filters, now)
+}
+
+// InspectRun returns every instance of the run with the given run ID, or the instance with the
+// given instance ID
+func (client *Client) InspectRun(id string, now time.Time) ([]*RunInfo, error) {
+	runs, err := client.describeRuns([]*ec2.Filter{{Name: aws.String("tag:" + TagRunID), Values: []*string{aws.String(id)}}}, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		runs, err = client.describeRuns([]*ec2.Filter{
+			{Name: aws.String("instance-id"), Values: []*string{aws.String(id)}},
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(TagRunID)}},
+		}, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("no run or instance %s", id)
+	}
+	return runs, nil
+}
+
+func (client *Client) describeRuns(filters []*ec2.Filter, now time.Time) ([]*RunInfo, error) {
+	runs := []*RunInfo{}
+	spotRuns := make(map[string]*RunInfo)
+
+	err := client.EC2.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: filters,
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				run := newRunInfo(instance, now)
+				runs = append(runs, run)
+				if run.Lifecycle == "spot" {
+					spotRuns[run.InstanceID] = run
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to describe instances: %s", err)
+	}
+
+	if len(spotRuns) > 0 {
+		var ids []*string
+		for id := range spotRuns {
+			ids = append(ids, aws.String(id))
+		}
+		descSpot, err := client.EC2.DescribeSpotInstanceRequests(&ec2.DescribeSpotInstanceRequestsInput{
+			Filters: []*ec2.Filter{{Name: aws.String("instance-id"), Values: ids}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to describe spot instance requests: %s", err)
+		}
+		for _, sp := range descSpot.SpotInstanceRequests {
+			if run, ok := spotRuns[aws.StringValue(sp.InstanceId)]; ok {
+				if sp.ActualBlockHourlyPrice != nil {
+					run.SpotPrice = aws.StringValue(sp.ActualBlockHourlyPrice)
+				} else {
+					run.SpotPrice = aws.StringValue(sp.SpotPrice)
+				}
+			}
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].LaunchTime.Equal(runs[j].LaunchTime) {
+			return runs[i].InstanceID < runs[j].InstanceID
+		}
+		return runs[i].LaunchTime.Before(runs[j].LaunchTime)
+	})
+
+	return runs, nil
+}
+
+// newRunInfo describes an instance from its tags and attributes
+func newRunInfo(instance *ec2.Instance, now time.Time) *RunInfo {
+	run := &RunInfo{
+		InstanceID:       aws.StringValue(instance.InstanceId),
+		InstanceType:     aws.StringValue(instance.InstanceType),
+		Lifecycle:        "on-demand",
+		AMIID:            aws.StringValue(instance.ImageId),
+		SubnetID:         aws.StringValue(instance.SubnetId),
+		KeyName:          aws.StringValue(instance.KeyName),
+		PrivateIPAddress: aws.StringValue(instance.PrivateIpAddress),
+		PublicIPAddress:  aws.StringValue(instance.PublicIpAddress),
+		Tags:             make(map[string]string),
+	}
+
+	if instance.InstanceLifecycle != nil {
+		run.Lifecycle = aws.StringValue(instance.InstanceLifecycle)
+	}
+	if instance.State != nil {
+		run.State = aws.StringValue(instance.State.Name)
+	}
+	if instance.StateReason != nil {
+		run.StateReason = aws.StringValue(instance.StateReason.Message)
+	}
+	if instance.Placement != nil {
+		run.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	for _, group := range instance.SecurityGroups {
+		run.SecurityGroupIDs = append(run.SecurityGroupIDs, aws.StringValue(group.GroupId))
+	}
+
+	if instance.LaunchTime != nil {
+		run.LaunchTime = *instance.LaunchTime
+		if run.State != ec2.InstanceStateNameTerminated {
+			run.Uptime = now.Sub(run.LaunchTime).Round(time.Second).String()
+		}
+	}
+
+	for _, tag := range instance.Tags {
+		key, value := aws.StringValue(tag.Key), aws.StringValue(tag.Value)
+		run.Tags[key] = value
+
+		switch key {
+		case TagRunID:
+			run.RunID = value
+		case TagCommand:
+			run.Command = value
+		case TagUser:
+			run.User = value
+		case TagHost:
+			run.Host = value
+		case TagExpires:
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				run.Expires = &t
+			}
+		}
+	}
+
+	return run
+}
+
+// RunsTable writes a table of runs
+func RunsTable(w io.Writer, runs []*RunInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN ID\tINSTANCE\tSTATE\tTYPE\tLIFECYCLE\tSPOT PRICE\tUPTIME\tUSER\tHOST\tCOMMAND")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			run.RunID,
+			run.InstanceID,
+			run.State,
+			run.InstanceType,
+			run.Lifecycle,
+			orDash(run.SpotPrice),
+			orDash(run.Uptime),
+			orDash(run.User),
+			orDash(run.Host),
+			orDash(truncate(run.Command, 40)),
+		)
+	}
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// truncate shortens s to n characters, counted in runes as EC2 counts tag values
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
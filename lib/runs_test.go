@@ -0,0 +1,127 @@
+package ec2
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestRuns(t *testing.T) {
+	client, f := newTestClient()
+
+	spot := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Command = "make test"
+	})
+	onDemand := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.CapacityStrategy = CapacityStrategyOnDemandOnly
+		opts.Command = "make build"
+	})
+	terminated := newTestInstance(t, client, nil)
+	for _, instance := range []*Instance{spot, onDemand, terminated} {
+		if err := instance.StartInstance(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := terminated.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := client.Runs(false, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("got %d runs, want 2", len(runs))
+	}
+
+	byInstance := make(map[string]*RunInfo)
+	for _, run := range runs {
+		byInstance[run.InstanceID] = run
+	}
+
+	run := byInstance[*spot.InstanceID]
+	if run.RunID != *spot.RunID || run.Command != "make test" || run.User != localUser() || run.Host != localHost() {
+		t.Errorf("unexpected run %+v", run)
+	}
+	if run.Lifecycle != "spot" || run.SpotPrice != f.SpotPrice || run.Expires == nil {
+		t.Errorf("unexpected spot run %+v", run)
+	}
+
+	run = byInstance[*onDemand.InstanceID]
+	if run.Lifecycle != "on-demand" || run.SpotPrice != "" || run.Command != "make build" {
+		t.Errorf("unexpected on-demand run %+v", run)
+	}
+
+	var table bytes.Buffer
+	if err := RunsTable(&table, runs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"RUN ID", *spot.RunID, *onDemand.InstanceID, "make build"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("table should contain %q:\n%s", want, table.String())
+		}
+	}
+}
+
+func TestInspectRun(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, nil)
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{*instance.RunID, *instance.InstanceID} {
+		runs, err := client.InspectRun(id, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != 1 || runs[0].InstanceID != *instance.InstanceID {
+			t.Errorf("inspecting %s: got %+v", id, runs)
+		}
+		if runs[0].Tags[TagRunID] != *instance.RunID {
+			t.Errorf("inspecting %s: got tags %v", id, runs[0].Tags)
+		}
+	}
+
+	if _, err := client.InspectRun("unknown", time.Now()); err == nil {
+		t.Error("expected an error inspecting an unknown run")
+	}
+}
+
+func TestOwnerTagsTruncateCommand(t *testing.T) {
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Command = strings.Repeat("x", 300)
+	})
+
+	for _, tag := range instance.ownerTags() {
+		if *tag.Key == TagCommand && len(*tag.Value) != maxTagValueLength {
+			t.Errorf("got command tag of length %d, want %d", len(*tag.Value), maxTagValueLength)
+		}
+	}
+}
+
+func TestTruncateKeepsRunesWhole(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{s: "echo héllo", n: 10, want: "echo héllo"},
+		{s: "echo héllo wörld", n: 9, want: "echo h..."},
+		{s: "echo ✓✓✓✓✓✓", n: 8, want: "echo ..."},
+		{s: "日本語のコマンド", n: 6, want: "日本語..."},
+	}
+
+	for _, tt := range tests {
+		got := truncate(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) split a character: %q", tt.s, tt.n, got)
+		}
+	}
+}
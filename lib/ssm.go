@@ -0,0 +1,217 @@
+package ec2
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// ssmPollInterval is how often SSM is polled for agent registration and command status
+var ssmPollInterval = 5 * time.Second
+
+// CloudWatch Logs delivers a command's output with a delay, so once the command finishes its
+// log streams are read every ssmLogDrainInterval until ssmLogDrainRounds reads in a row bring
+// nothing new
+var (
+	ssmLogDrainInterval = 2 * time.Second
+	ssmLogDrainRounds   = 3
+)
+
+// ssmExecutionTimeout is the longest a command run through SSM may take without a timeout,
+// in seconds
+const ssmExecutionTimeout = "172800"
+
+// WaitForSSM waits until the instance's SSM agent has registered with Systems Manager
+func (instance *Instance) WaitForSSM() error {
+	const retries = 60
+	for attempts := 1; attempts <= retries; attempts++ {
+		if err := instance.stopped(); err != nil {
+			return err
+		}
+		Log.Debugf("Waiting for SSM agent on %s (attempt %d/%d)", *instance.InstanceID, attempts, retries)
+
+		result, err := instance.Client.SSM.DescribeInstanceInformation(&ssm.DescribeInstanceInformationInput{
+			Filters: []*ssm.InstanceInformationStringFilter{
+				{
+					Key:    aws.String("InstanceIds"),
+					Values: []*string{instance.InstanceID},
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to describe SSM instance information: %s", err)
+		}
+
+		for _, info := range result.InstanceInformationList {
+			if aws.StringValue(info.PingStatus) == ssm.PingStatusOnline {
+				Log.Infof("SSM agent on %s is ready", *instance.InstanceID)
+				return nil
+			}
+		}
+
+		Log.Debugf("SSM agent on %s not yet online", *instance.InstanceID)
+		time.Sleep(ssmPollInterval)
+	}
+
+	return fmt.Errorf("SSM agent on %s never came online. Does the instance profile allow Systems Manager?", *instance.InstanceID)
+}
+
+// invokeSSMCommand runs the command through SSM Run Command as the configured user. Output is
+// streamed from CloudWatch Logs when a log group is set, otherwise it is written once the
+// command completes.
+func (instance *Instance) invokeSSMCommand() error {
+	var entrypointPath *string
+
+	// SSM runs commands as root so file systems are mounted directly
+	var setup []string
+	for _, mount := range instance.EFSMounts {
+		setup = append(setup, mount.mountCommand())
+	}
+
+	// There is no file transfer over SSM so the entrypoint is embedded in the script
+	if instance.EntrypointFile != nil {
+		data, err := ioutil.ReadFile(*instance.EntrypointFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read entrypoint %s: %s", *instance.EntrypointFile, err)
+		}
+		entrypointPath = aws.String("/tmp/" + filepath.Base(*instance.EntrypointFile))
+		setup = append(setup,
+			fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString(data), shellQuote(*entrypointPath)),
+			fmt.Sprintf("chmod 0755 %s", shellQuote(*entrypointPath)),
+			fmt.Sprintf("chown %s %s", shellQuote(*instance.User), shellQuote(*entrypointPath)),
+		)
+	}
+
+	command := instance.buildCommand(entrypointPath)
+	Log.Infof("Executing command: \n%s", command)
+	instance.emit(Event{Type: EventCommandStarted, Command: command})
+
+	// SSM runs commands as root, switch to the configured user
+	script := append(setup, fmt.Sprintf("sudo -H -u %s bash -l -c %s", shellQuote(*instance.User), shellQuote(command)))
+
+	executionTimeout := ssmExecutionTimeout
+	if *instance.Timeout > 0 {
+		executionTimeout = fmt.Sprint(int(math.Ceil(instance.Timeout.Seconds())))
+	}
+
+	input := &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []*string{instance.InstanceID},
+		Parameters: map[string][]*string{
+			"commands":         aws.StringSlice(script),
+			"executionTimeout": {aws.String(executionTimeout)},
+		},
+		Comment: aws.String("ec2-runner"),
+	}
+	if instance.SSMLogGroup != nil && *instance.SSMLogGroup != "" {
+		input.CloudWatchOutputConfig = &ssm.CloudWatchOutputConfig{
+			CloudWatchLogGroupName:  instance.SSMLogGroup,
+			CloudWatchOutputEnabled: aws.Bool(true),
+		}
+	}
+
+	sent, err := instance.Client.SSM.SendCommand(input)
+	if err != nil {
+		return fmt.Errorf("Unable to send SSM command: %s", err)
+	}
+
+	stdout, stderr := instance.outputWriters()
+	defer stdout.Flush()
+	defer stderr.Flush()
+
+	var streams []*ssmLogStream
+	if input.CloudWatchOutputConfig != nil {
+		streams = newSSMLogStreams(instance.Client.Logs, *instance.SSMLogGroup, *sent.Command.CommandId, *instance.InstanceID, stdout, stderr)
+	}
+	copyStreams := func() int {
+		var copied int
+		for _, stream := range streams {
+			n, err := stream.copy()
+			if err != nil {
+				Log.Warnf("%s", err)
+			}
+			copied += n
+		}
+		return copied
+	}
+	drainStreams := func() {
+		for quiet := 0; quiet < ssmLogDrainRounds; {
+			time.Sleep(ssmLogDrainInterval)
+			if copyStreams() > 0 {
+				quiet = 0
+			} else {
+				quiet++
+			}
+		}
+	}
+
+	var invoked bool
+	for {
+		time.Sleep(ssmPollInterval)
+
+		// the cleanup terminates the instance, which ends the command
+		if err := instance.stopped(); err != nil {
+			return err
+		}
+
+		invocation, err := instance.Client.SSM.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  sent.Command.CommandId,
+			InstanceId: instance.InstanceID,
+		})
+		// the invocation does not exist for a moment after the command is sent
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ssm.ErrCodeInvocationDoesNotExist && !invoked {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to get SSM command invocation: %s", err)
+		}
+		invoked = true
+
+		// The invocation stays in progress when the instance is reclaimed
+		if interruption := instance.spotInterruption(); interruption != nil {
+			return instance.interrupted(interruption)
+		}
+
+		copyStreams()
+
+		switch aws.StringValue(invocation.Status) {
+		case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed, ssm.CommandInvocationStatusCancelling:
+			continue
+		}
+
+		if streams != nil {
+			drainStreams()
+		} else {
+			stdout.Write([]byte(aws.StringValue(invocation.StandardOutputContent)))
+			stderr.Write([]byte(aws.StringValue(invocation.StandardErrorContent)))
+			instance.warnSSMTruncation(aws.StringValue(invocation.StandardOutputContent), aws.StringValue(invocation.StandardErrorContent))
+		}
+
+		*instance.ExitCode = int(aws.Int64Value(invocation.ResponseCode))
+
+		// SSM kills commands that run past the execution timeout
+		if aws.StringValue(invocation.Status) == ssm.CommandInvocationStatusTimedOut {
+			instance.TimedOut = true
+			*instance.ExitCode = TimeoutExitCode
+			return fmt.Errorf("timed out after %s", *instance.Timeout)
+		}
+
+		switch aws.StringValue(invocation.Status) {
+		case ssm.CommandInvocationStatusSuccess, ssm.CommandInvocationStatusFailed:
+			if *instance.ExitCode < 0 {
+				return errors.New("SSM command did not report an exit code")
+			}
+			return nil
+		}
+
+		return fmt.Errorf("SSM command %s: %s", aws.StringValue(invocation.Status), aws.StringValue(invocation.StatusDetails))
+	}
+}
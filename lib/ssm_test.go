@@ -0,0 +1,181 @@
+package ec2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+func TestInvokeSSMCommand(t *testing.T) {
+	ssmPollInterval = 0
+
+	entrypoint, err := ioutil.TempFile("", "entrypoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(entrypoint.Name())
+	entrypoint.WriteString("#!/bin/sh\necho hello\n")
+	entrypoint.Close()
+
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.EntrypointFile = entrypoint.Name()
+		opts.Command = "echo world"
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	ssmFake.ResponseCode = 3
+
+	if err := instance.WaitForConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.InvokeCommand(); err != nil {
+		t.Fatal(err)
+	}
+
+	if *instance.ExitCode != 3 {
+		t.Errorf("got exit code %d, want 3", *instance.ExitCode)
+	}
+
+	if len(ssmFake.Commands) != 1 {
+		t.Fatalf("got %d commands, want 1", len(ssmFake.Commands))
+	}
+	script := strings.Join(aws.StringValueSlice(ssmFake.Commands[0].Parameters["commands"]), "\n")
+	for _, want := range []string{"base64 -d > ", "sudo -H -u 'ec2-user'", "echo world"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+}
+
+func TestStartInstancePublicIP(t *testing.T) {
+	client, f := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaPublicIP
+	})
+
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !aws.BoolValue(f.LaunchTemplates[*instance.LaunchTemplateName][0].NetworkInterfaces[0].AssociatePublicIpAddress) {
+		t.Error("launch template should associate a public IP address")
+	}
+	if instance.host() != aws.StringValue(instance.PublicIPAddress) || instance.host() == "" {
+		t.Errorf("got host %s, want the public IP address %s", instance.host(), aws.StringValue(instance.PublicIPAddress))
+	}
+}
+
+// captureStdout returns what fn writes to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- data
+	}()
+
+	fn()
+	w.Close()
+	return string(<-output)
+}
+
+func TestInvokeSSMCommandStreamsLogGroup(t *testing.T) {
+	ssmPollInterval = 0
+	ssmLogDrainInterval = 0
+
+	client, _ := newTestClient()
+	logs := fake.NewLogs()
+	client.Logs = logs
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.SSMLogGroup = "/ec2-runner"
+		opts.Command = "seq 5"
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	// the truncated output is ignored in favour of the log stream
+	ssmFake.Stdout = "1\n"
+	ssmFake.Missing = 1
+
+	// the last line reaches the log stream after the command finished
+	stream := fmt.Sprintf("%036d/%s/aws-runShellScript/stdout", 1, *instance.InstanceID)
+	logs.Append("/ec2-runner", stream, "1\n2", "3\n")
+	logs.Delayed["/ec2-runner:"+stream] = []string{"4\n5\n"}
+
+	var err error
+	output := captureStdout(t, func() {
+		err = instance.InvokeCommand()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output != "1\n2\n3\n4\n5\n" {
+		t.Errorf("got output %q, want the whole log stream", output)
+	}
+	config := ssmFake.Commands[0].CloudWatchOutputConfig
+	if config == nil || aws.StringValue(config.CloudWatchLogGroupName) != "/ec2-runner" {
+		t.Errorf("command was not sent with the log group: %+v", config)
+	}
+}
+
+func TestInvokeSSMCommandWarnsOfTruncation(t *testing.T) {
+	ssmPollInterval = 0
+
+	var buf bytes.Buffer
+	defer func(l *Logger) { Log = l }(Log)
+	Log = NewLogger(&buf, LevelWarn)
+
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "cat big.log"
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	ssmFake.Stdout = strings.Repeat("x", ssmMaxStdout)
+
+	captureStdout(t, func() {
+		if err := instance.InvokeCommand(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if !strings.Contains(buf.String(), "cut off") {
+		t.Errorf("expected a truncation warning, got %q", buf.String())
+	}
+}
+
+func TestSSMLogGroupRequiresSSM(t *testing.T) {
+	client, _ := newTestClient()
+	opts := testInstanceOptions(client)
+	opts.SSMLogGroup = "/ec2-runner"
+	if _, err := opts.Instances(); err == nil {
+		t.Error("expected an error for a log group without ssm")
+	}
+}
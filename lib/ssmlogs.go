@@ -0,0 +1,79 @@
+package ec2
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// SSM cuts the output returned by GetCommandInvocation off at these lengths
+const (
+	ssmMaxStdout = 24000
+	ssmMaxStderr = 8000
+)
+
+// ssmLogStream follows the CloudWatch Logs stream SSM writes a command's stdout or stderr to
+type ssmLogStream struct {
+	logs   cloudwatchlogsiface.CloudWatchLogsAPI
+	group  string
+	stream string
+	token  *string
+	w      io.Writer
+}
+
+// newSSMLogStreams returns the streams of the command's stdout and stderr on the instance
+func newSSMLogStreams(logs cloudwatchlogsiface.CloudWatchLogsAPI, group, commandID, instanceID string, stdout, stderr io.Writer) []*ssmLogStream {
+	prefix := fmt.Sprintf("%s/%s/aws-runShellScript/", commandID, instanceID)
+	return []*ssmLogStream{
+		{logs: logs, group: group, stream: prefix + "stdout", w: stdout},
+		{logs: logs, group: group, stream: prefix + "stderr", w: stderr},
+	}
+}
+
+// copy writes the events logged since the last call and returns how many there were. The
+// stream does not exist until the command first writes to it.
+func (s *ssmLogStream) copy() (int, error) {
+	var copied int
+	for {
+		output, err := s.logs.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
+			LogGroupName:  aws.String(s.group),
+			LogStreamName: aws.String(s.stream),
+			NextToken:     s.token,
+			StartFromHead: aws.Bool(true),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+			return copied, nil
+		}
+		if err != nil {
+			return copied, fmt.Errorf("Unable to get SSM command output from %s: %s", s.stream, err)
+		}
+
+		for _, event := range output.Events {
+			message := aws.StringValue(event.Message)
+			if !strings.HasSuffix(message, "\n") {
+				message += "\n"
+			}
+			io.WriteString(s.w, message)
+		}
+		copied += len(output.Events)
+
+		// the same token is returned once there is nothing more to read
+		done := aws.StringValue(output.NextForwardToken) == aws.StringValue(s.token)
+		s.token = output.NextForwardToken
+		if done || len(output.Events) == 0 {
+			return copied, nil
+		}
+	}
+}
+
+// warnSSMTruncation logs a warning when SSM cut the command's output off
+func (instance *Instance) warnSSMTruncation(stdout, stderr string) {
+	if len(stdout) >= ssmMaxStdout || len(stderr) >= ssmMaxStderr {
+		Log.Warnf("SSM only returns the first %d characters of stdout and %d of stderr so the output of %s was cut off. Set --ssm-log-group to stream the full output through CloudWatch Logs", ssmMaxStdout, ssmMaxStderr, *instance.InstanceID)
+	}
+}
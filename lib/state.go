@@ -0,0 +1,232 @@
+package ec2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"golang.org/x/crypto/ssh"
+)
+
+// RunState records what is needed to reconnect to a detached run
+type RunState struct {
+	RunID            string         `json:"run-id"`
+	InstanceID       string         `json:"instance-id"`
+	InstanceType     string         `json:"instance-type,omitempty"`
+	Lifecycle        string         `json:"lifecycle,omitempty"`
+	SpotPrice        string         `json:"spot-price,omitempty"`
+	PrivateIPAddress string         `json:"private-ip,omitempty"`
+	PublicIPAddress  string         `json:"public-ip,omitempty"`
+	ConnectVia       string         `json:"connect-via"`
+	SSHPort          int            `json:"ssh-port"`
+	User             string         `json:"user"`
+	JumpHosts        []JumpHost     `json:"jump-hosts,omitempty"`
+	JumpIdentityFile string         `json:"jump-identity-file,omitempty"`
+	IdentityFile     string         `json:"identity-file,omitempty"`
+	PrivateKey       string         `json:"private-key,omitempty"`
+	HostKey          string         `json:"host-key"`
+	RemoteDir        string         `json:"remote-dir"`
+	Downloads        []FileTransfer `json:"downloads,omitempty"`
+	NoTermination    bool           `json:"no-terminate,omitempty"`
+	Command          string         `json:"command"`
+	LaunchTime       time.Time      `json:"launch-time"`
+	Timeout          time.Duration  `json:"timeout,omitempty"`
+}
+
+// DefaultStateDir returns $XDG_STATE_HOME/ec2-runner/runs, or ~/.local/state/ec2-runner/runs
+// when XDG_STATE_HOME is not set
+func DefaultStateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("Unable to find the state directory: %s", err)
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "ec2-runner", "runs"), nil
+}
+
+// RunState returns the state of a detached run. Relative download paths are made absolute so
+// the run can be reattached from anywhere.
+func (instance *Instance) RunState() (*RunState, error) {
+	state := &RunState{
+		RunID:            stringPointerValueOrNil(instance.RunID, ""),
+		InstanceID:       *instance.InstanceID,
+		InstanceType:     stringPointerValueOrNil(instance.SelectedInstanceType, ""),
+		Lifecycle:        stringPointerValueOrNil(instance.Lifecycle, ""),
+		SpotPrice:        stringPointerValueOrNil(instance.SpotPrice, ""),
+		PrivateIPAddress: stringPointerValueOrNil(instance.PrivateIPAddress, ""),
+		PublicIPAddress:  stringPointerValueOrNil(instance.PublicIPAddress, ""),
+		ConnectVia:       *instance.ConnectVia,
+		SSHPort:          *instance.SSHPort,
+		User:             *instance.User,
+		JumpHosts:        instance.JumpHosts,
+		JumpIdentityFile: instance.jumpIdentityFile,
+		IdentityFile:     instance.identityFile,
+		PrivateKey:       string(instance.privateKey),
+		RemoteDir:        remoteRunDir(stringPointerValueOrNil(instance.RunID, "")),
+		NoTermination:    *instance.NoTermination,
+		Command:          stringPointerValueOrNil(instance.Command, ""),
+	}
+
+	if instance.Timeout != nil {
+		state.Timeout = *instance.Timeout
+	}
+
+	if instance.LaunchTime != nil {
+		state.LaunchTime = *instance.LaunchTime
+	}
+
+	if instance.hostKeys != nil && instance.hostKeys.pinned != nil {
+		state.HostKey = string(ssh.MarshalAuthorizedKey(instance.hostKeys.pinned))
+	}
+
+	for _, download := range instance.Downloads {
+		local, err := filepath.Abs(download.Local)
+		if err != nil {
+			return nil, err
+		}
+		state.Downloads = append(state.Downloads, FileTransfer{Local: local, Remote: download.Remote})
+	}
+
+	return state, nil
+}
+
+// Save writes the state to dir. The file is only readable by the current user as it may hold
+// the run's private key.
+func (state *RunState) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Unable to create state directory %s: %s", dir, err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := runStatePath(dir, state.RunID)
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		return fmt.Errorf("Unable to write run state %s: %s", filename, err)
+	}
+	return nil
+}
+
+// Remove deletes the state from dir
+func (state *RunState) Remove(dir string) error {
+	err := os.Remove(runStatePath(dir, state.RunID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove run state: %s", err)
+	}
+	return nil
+}
+
+// LoadRunState reads the state of a detached run from dir
+func LoadRunState(dir, runID string) (*RunState, error) {
+	data, err := ioutil.ReadFile(runStatePath(dir, runID))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no detached run %s", runID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read run state: %s", err)
+	}
+
+	var state RunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Unable to parse state of run %s: %s", runID, err)
+	}
+	return &state, nil
+}
+
+func runStatePath(dir, runID string) string {
+	return filepath.Join(dir, runID+".json")
+}
+
+// Instance returns the instance running the detached command, ready to reconnect to. Its host
+// key must match the one recorded when the run was detached.
+func (state *RunState) Instance(client *Client) (*Instance, error) {
+	var signers []ssh.Signer
+	switch {
+	case state.PrivateKey != "":
+		signer, err := ssh.ParsePrivateKey([]byte(state.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the private key of run %s: %s", state.RunID, err)
+		}
+		signers = append(signers, signer)
+	case state.IdentityFile != "":
+		signer, err := readIdentityFile(state.IdentityFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	auth := publicKeyAuth(signers)
+	jumpAuth, err := jumpAuth(state.JumpIdentityFile, []ssh.AuthMethod{auth})
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeys := &hostKeyVerifier{strict: true}
+	if state.HostKey != "" {
+		hostKeys.pinned, _, _, _, err = ssh.ParseAuthorizedKey([]byte(state.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the host key of run %s: %s", state.RunID, err)
+		}
+	}
+
+	var jumpHostKeys ssh.HostKeyCallback
+	if len(state.JumpHosts) > 0 {
+		jumpHostKeys, err = jumpHostKeyCallback(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instance := &Instance{
+		Client:              client,
+		InstanceID:          aws.String(state.InstanceID),
+		ConnectVia:          aws.String(state.ConnectVia),
+		SSHPort:             aws.Int(state.SSHPort),
+		User:                aws.String(state.User),
+		JumpHosts:           state.JumpHosts,
+		jumpAuth:            jumpAuth,
+		jumpHostKeyCallback: jumpHostKeys,
+		hostKeys:            hostKeys,
+		sshConfig: &ssh.ClientConfig{
+			User:            state.User,
+			Auth:            []ssh.AuthMethod{auth},
+			HostKeyCallback: hostKeys.callback,
+		},
+		RunID:         aws.String(state.RunID),
+		Command:       aws.String(state.Command),
+		Downloads:     state.Downloads,
+		NoTermination: aws.Bool(state.NoTermination),
+		ExitCode:      aws.Int(-1),
+		NoColor:       aws.Bool(false),
+		Detached:      true,
+		LaunchTime:    aws.Time(state.LaunchTime),
+		Timeout:       &state.Timeout,
+	}
+	if state.InstanceType != "" {
+		instance.SelectedInstanceType = aws.String(state.InstanceType)
+	}
+	if state.Lifecycle != "" {
+		instance.Lifecycle = aws.String(state.Lifecycle)
+	}
+	if state.SpotPrice != "" {
+		instance.SpotPrice = aws.String(state.SpotPrice)
+	}
+	if state.PrivateIPAddress != "" {
+		instance.PrivateIPAddress = aws.String(state.PrivateIPAddress)
+	}
+	if state.PublicIPAddress != "" {
+		instance.PublicIPAddress = aws.String(state.PublicIPAddress)
+	}
+
+	return instance, nil
+}
@@ -0,0 +1,134 @@
+package ec2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// TimeoutExitCode is the exit code recorded for commands that ran past the timeout
+const TimeoutExitCode = 124
+
+// safeguardGrace is added to the timeout for the instance's own shutdown to allow for
+// booting, connecting and transferring files before the command starts
+const safeguardGrace = 10 * time.Minute
+
+// safeguardMinutes returns how many minutes after boot the instance shuts itself down
+func safeguardMinutes(timeout time.Duration) int {
+	return int(math.Ceil((timeout + safeguardGrace).Minutes()))
+}
+
+// safeguardUserData returns user-data that schedules a shutdown once the timeout and a grace
+// period have passed, followed by the given user-data. The instance terminates on shutdown so
+// it is cleaned up even if this process dies. Both are combined in a MIME multi-part archive
+// understood by cloud-init.
+func safeguardUserData(userData []byte, timeout time.Duration) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\nMIME-Version: 1.0\r\n\r\n", w.Boundary())
+
+	safeguard := fmt.Sprintf("#!/bin/sh\nnohup shutdown -h +%d >/dev/null 2>&1 &\n", safeguardMinutes(timeout))
+	if err := writeUserDataPart(w, "text/x-shellscript", "ec2-runner-timeout.sh", []byte(safeguard)); err != nil {
+		return nil, err
+	}
+
+	if len(userData) > 0 {
+		if bytes.HasPrefix(userData, []byte("Content-Type:")) {
+			if err := copyMIMEUserData(w, userData); err != nil {
+				return nil, err
+			}
+		} else if err := writeUserDataPart(w, userDataContentType(userData), "user-data", userData); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeUserDataPart(w *multipart.Writer, contentType, filename string, data []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {fmt.Sprintf("%s; charset=\"us-ascii\"", contentType)},
+		"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", filename)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(data)
+	return err
+}
+
+// copyMIMEUserData adds user-data that is already a MIME document to the archive. The parts
+// of a multi-part archive are copied with their headers, while a single document becomes a
+// part with the document's headers.
+func copyMIMEUserData(w *multipart.Writer, userData []byte) error {
+	message, err := mail.ReadMessage(bytes.NewReader(userData))
+	if err != nil {
+		return fmt.Errorf("Unable to parse MIME user-data: %s", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("Unable to parse the content type of MIME user-data: %s", err)
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return copyUserDataPart(w, textproto.MIMEHeader(message.Header), message.Body)
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		// raw parts keep their Content-Transfer-Encoding for cloud-init to decode
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to parse MIME user-data: %s", err)
+		}
+		if err := copyUserDataPart(w, part.Header, part); err != nil {
+			return err
+		}
+	}
+}
+
+func copyUserDataPart(w *multipart.Writer, header textproto.MIMEHeader, body io.Reader) error {
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, body)
+	return err
+}
+
+// userDataContentType returns the cloud-init content type for user-data from its first line
+func userDataContentType(userData []byte) string {
+	types := []struct {
+		prefix      string
+		contentType string
+	}{
+		{"#cloud-config", "text/cloud-config"},
+		{"#cloud-boothook", "text/cloud-boothook"},
+		{"#include", "text/x-include-url"},
+		{"#upstart-job", "text/upstart-job"},
+		{"#part-handler", "text/part-handler"},
+		{"#!", "text/x-shellscript"},
+	}
+
+	for _, t := range types {
+		if strings.HasPrefix(string(userData), t.prefix) {
+			return t.contentType
+		}
+	}
+	return "text/x-shellscript"
+}
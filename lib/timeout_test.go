@@ -0,0 +1,177 @@
+package ec2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/justmiles/ec2-runner/lib/fake"
+)
+
+// readUserDataParts returns the content type and body of each part of a MIME archive
+func readUserDataParts(t *testing.T, data []byte) (contentTypes, bodies []string) {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentTypes = append(contentTypes, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	return contentTypes, bodies
+}
+
+func TestSafeguardUserData(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData string
+		want     string
+	}{
+		{name: "shell script", userData: "#!/bin/bash\nyum install -y jq\n", want: "text/x-shellscript"},
+		{name: "cloud config", userData: "#cloud-config\npackages: [jq]\n", want: "text/cloud-config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := safeguardUserData([]byte(tt.userData), 50*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contentTypes, bodies := readUserDataParts(t, data)
+			if len(bodies) != 2 {
+				t.Fatalf("got %d parts, want 2", len(bodies))
+			}
+			if !strings.Contains(bodies[0], "shutdown -h +60") {
+				t.Errorf("safeguard should shut down 60 minutes after boot:\n%s", bodies[0])
+			}
+			if !strings.HasPrefix(contentTypes[1], tt.want) {
+				t.Errorf("got content type %s, want %s", contentTypes[1], tt.want)
+			}
+			if bodies[1] != tt.userData {
+				t.Errorf("got user-data %q, want %q", bodies[1], tt.userData)
+			}
+		})
+	}
+}
+
+func TestSafeguardMIMEUserData(t *testing.T) {
+	tests := []struct {
+		name         string
+		userData     string
+		contentTypes []string
+		bodies       []string
+	}{
+		{
+			name: "multi-part archive",
+			userData: "Content-Type: multipart/mixed; boundary=\"inner\"\r\nMIME-Version: 1.0\r\n\r\n" +
+				"--inner\r\nContent-Type: text/cloud-config\r\n\r\npackages: [jq]\r\n" +
+				"--inner\r\nContent-Type: text/x-shellscript\r\n\r\n#!/bin/sh\necho hi\r\n" +
+				"--inner--\r\n",
+			contentTypes: []string{"text/cloud-config", "text/x-shellscript"},
+			bodies:       []string{"packages: [jq]", "#!/bin/sh\necho hi"},
+		},
+		{
+			name:         "single document",
+			userData:     "Content-Type: text/cloud-config\r\nMIME-Version: 1.0\r\n\r\npackages: [jq]\n",
+			contentTypes: []string{"text/cloud-config"},
+			bodies:       []string{"packages: [jq]\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := safeguardUserData([]byte(tt.userData), 50*time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contentTypes, bodies := readUserDataParts(t, data)
+			if !strings.HasPrefix(contentTypes[0], "text/x-shellscript") || !strings.Contains(bodies[0], "shutdown -h +60") {
+				t.Errorf("first part should be the safeguard, got %s:\n%s", contentTypes[0], bodies[0])
+			}
+			if !equalStrings(contentTypes[1:], tt.contentTypes) {
+				t.Errorf("got content types %v, want %v", contentTypes[1:], tt.contentTypes)
+			}
+			if !equalStrings(bodies[1:], tt.bodies) {
+				t.Errorf("got bodies %q, want %q", bodies[1:], tt.bodies)
+			}
+		})
+	}
+}
+
+func TestInstancesAddTimeoutSafeguard(t *testing.T) {
+	client, _ := newTestClient()
+
+	instance := newTestInstance(t, client, nil)
+	if instance.UserData != nil {
+		t.Error("instances without a timeout should have no user-data")
+	}
+
+	instance = newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.Timeout = 90 * time.Second
+	})
+	if instance.UserData == nil {
+		t.Fatal("instances with a timeout should have user-data")
+	}
+	data, err := base64.StdEncoding.DecodeString(*instance.UserData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, bodies := readUserDataParts(t, data); len(bodies) != 1 || !strings.Contains(bodies[0], "shutdown -h +12") {
+		t.Errorf("unexpected user-data %s", data)
+	}
+}
+
+func TestInvokeSSMCommandTimeout(t *testing.T) {
+	ssmPollInterval = 0
+
+	client, _ := newTestClient()
+	instance := newTestInstance(t, client, func(opts *InstanceOptions) {
+		opts.ConnectVia = ConnectViaSSM
+		opts.Command = "sleep infinity"
+		opts.Timeout = 5 * time.Minute
+	})
+	if err := instance.StartInstance(); err != nil {
+		t.Fatal(err)
+	}
+
+	ssmFake := client.SSM.(*fake.SSM)
+	ssmFake.OnlineInstances[*instance.InstanceID] = true
+	ssmFake.Status = ssm.CommandInvocationStatusTimedOut
+
+	if err := instance.InvokeCommand(); err == nil {
+		t.Fatal("expected the command to time out")
+	}
+	if !instance.TimedOut || *instance.ExitCode != TimeoutExitCode {
+		t.Errorf("got timed out %t with exit code %d, want true with %d", instance.TimedOut, *instance.ExitCode, TimeoutExitCode)
+	}
+	if timeout := *ssmFake.Commands[0].Parameters["executionTimeout"][0]; timeout != "300" {
+		t.Errorf("got execution timeout %s, want 300", timeout)
+	}
+}
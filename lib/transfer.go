@@ -0,0 +1,343 @@
+package ec2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// scpTimeout bounds how long a single file may take to copy
+const scpTimeout = 30 * time.Minute
+
+// FileTransfer is a local path and the remote path it is copied to or from
+type FileTransfer struct {
+	Local  string
+	Remote string
+}
+
+// parseTransfers parses 'local:remote' pairs, or 'remote:local' pairs when localFirst is
+// false. The colon closest to the remote path separates the two so local Windows paths such
+// as C:\data are supported.
+func parseTransfers(specs []string, localFirst bool) ([]FileTransfer, error) {
+	var transfers []FileTransfer
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if !localFirst {
+			i = strings.Index(spec, ":")
+		}
+		if i < 1 || i == len(spec)-1 {
+			return nil, fmt.Errorf("unable to derive local and remote paths from: %s", spec)
+		}
+
+		transfer := FileTransfer{Local: spec[:i], Remote: spec[i+1:]}
+		if !localFirst {
+			transfer = FileTransfer{Local: spec[i+1:], Remote: spec[:i]}
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, nil
+}
+
+// Upload copies each local file or directory to the instance. Directories are copied
+// recursively and file modes are preserved. A remote path ending in / receives the local
+// file or directory by name.
+func (instance *Instance) Upload(client *ssh.Client, transfers []FileTransfer) error {
+	for _, transfer := range transfers {
+		info, err := os.Stat(transfer.Local)
+		if err != nil {
+			return fmt.Errorf("Unable to upload %s: %s", transfer.Local, err)
+		}
+
+		remote := transfer.Remote
+		if strings.HasSuffix(remote, "/") {
+			remote = path.Join(remote, filepath.Base(transfer.Local))
+		}
+
+		Log.Infof("Uploading %s to %s", transfer.Local, remote)
+
+		if !info.IsDir() {
+			if err := runRemote(client, fmt.Sprintf("mkdir -p %s", shellQuote(path.Dir(remote)))); err != nil {
+				return fmt.Errorf("Unable to create remote directory for %s: %s", remote, err)
+			}
+			if err := copyFile(client, transfer.Local, remote, info.Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Collect the directory tree so it can be created in a single command before copying
+		var mkdirs []string
+		var files []FileTransfer
+		var modes []os.FileMode
+		err = filepath.Walk(transfer.Local, func(localPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(transfer.Local, localPath)
+			if err != nil {
+				return err
+			}
+			remotePath := path.Join(remote, filepath.ToSlash(rel))
+
+			switch {
+			case info.IsDir():
+				mkdirs = append(mkdirs, fmt.Sprintf("mkdir -p %s && chmod %04o %s", shellQuote(remotePath), info.Mode().Perm(), shellQuote(remotePath)))
+			case info.Mode().IsRegular():
+				files = append(files, FileTransfer{Local: localPath, Remote: remotePath})
+				modes = append(modes, info.Mode())
+			default:
+				Log.Warnf("Skipping %s. Only regular files and directories are uploaded", localPath)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to read directory %s: %s", transfer.Local, err)
+		}
+
+		if err := runRemote(client, strings.Join(mkdirs, " && ")); err != nil {
+			return fmt.Errorf("Unable to create remote directories for %s: %s", remote, err)
+		}
+
+		for i, file := range files {
+			if err := copyFile(client, file.Local, file.Remote, modes[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Download copies files matching each remote path or glob from the instance into the local
+// directory. Directories are copied recursively.
+func (instance *Instance) Download(client *ssh.Client, transfers []FileTransfer) error {
+	var errs []string
+	for _, transfer := range transfers {
+		local := instance.downloadDir(transfer.Local)
+
+		Log.Infof("Downloading %s to %s", transfer.Remote, local)
+
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return fmt.Errorf("Unable to create local directory %s: %s", local, err)
+		}
+
+		if err := receiveFiles(client, transfer.Remote, local); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", transfer.Remote, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error downloading files: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// downloadDir returns where the instance downloads into local. Several instances download to
+// the same place so each gets a directory named after its ID.
+func (instance *Instance) downloadDir(local string) string {
+	if instance.Count > 1 && instance.InstanceID != nil {
+		return filepath.Join(local, *instance.InstanceID)
+	}
+	return local
+}
+
+// receiveFiles runs scp in source mode on the instance and writes everything it sends into
+// the local directory. The remote pattern is left unquoted so the remote shell expands globs.
+func receiveFiles(client *ssh.Client, remotePattern, localDir string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("unable to launch SSH session: %s", err)
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.Start("scp -rf " + remotePattern); err != nil {
+		return err
+	}
+
+	sinkErr := scpSink(bufio.NewReader(stdout), stdin, localDir)
+	stdin.Close()
+	waitErr := session.Wait()
+
+	if sinkErr != nil {
+		return sinkErr
+	}
+	return waitErr
+}
+
+// scpSink implements the receiving side of the scp protocol, writing files and directories
+// beneath dir
+func scpSink(r *bufio.Reader, w io.Writer, dir string) error {
+	ack := func() error {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+
+	if err := ack(); err != nil {
+		return err
+	}
+
+	var warnings []string
+	dirs := []string{dir}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unexpected scp response: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("unexpected empty scp response")
+		}
+		current := dirs[len(dirs)-1]
+
+		switch line[0] {
+		case 1:
+			// warning such as a pattern that matched nothing; scp carries on
+			warnings = append(warnings, line[1:])
+			continue
+		case 2:
+			return fmt.Errorf("%s", line[1:])
+		case 'T':
+			// modification times are not preserved
+		case 'E':
+			if len(dirs) == 1 {
+				return fmt.Errorf("unexpected scp response: %q", line)
+			}
+			dirs = dirs[:len(dirs)-1]
+		case 'C', 'D':
+			// Cmmmm <size> <name> or Dmmmm 0 <name>. Names may contain spaces
+			fields := strings.SplitN(line[1:], " ", 3)
+			if len(fields) != 3 {
+				return fmt.Errorf("unexpected scp response: %q", line)
+			}
+			mode, err := strconv.ParseUint(fields[0], 8, 32)
+			if err != nil {
+				return fmt.Errorf("unexpected scp response %q: %s", line, err)
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected scp response %q: %s", line, err)
+			}
+			name := fields[2]
+			if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+				return fmt.Errorf("refusing to write unsafe file name %q", name)
+			}
+			target := filepath.Join(current, name)
+
+			if line[0] == 'D' {
+				if err := os.MkdirAll(target, os.FileMode(mode)|0700); err != nil {
+					return err
+				}
+				dirs = append(dirs, target)
+				break
+			}
+
+			if err := ack(); err != nil {
+				return err
+			}
+			if err := receiveFile(r, target, os.FileMode(mode), size); err != nil {
+				return err
+			}
+			// scp follows the contents with a status byte
+			if status, err := r.ReadByte(); err != nil || status != 0 {
+				return fmt.Errorf("error receiving %s", target)
+			}
+		default:
+			return fmt.Errorf("unexpected scp response: %q", line)
+		}
+
+		if err := ack(); err != nil {
+			return err
+		}
+	}
+
+	if len(warnings) > 0 {
+		return fmt.Errorf("%s", strings.Join(warnings, "; "))
+	}
+	return nil
+}
+
+// receiveFile writes size bytes from r to path
+func receiveFile(r io.Reader, path string, mode os.FileMode, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(f, r, size); err != nil {
+		return fmt.Errorf("error receiving %s: %s", path, err)
+	}
+	return f.Chmod(mode)
+}
+
+// copyFile copies a local file to remotePath over SCP using the given connection
+func copyFile(client *ssh.Client, localPath, remotePath string, mode os.FileMode) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("Could not open local file %s", err.Error())
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Could not stat local file %s", err.Error())
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("unable to launch SSH session: %s", err)
+	}
+	defer session.Close()
+
+	scpClient := scp.NewClientWithTimeout("", nil, scpTimeout)
+	scpClient.Session = session
+	scpClient.Conn = client.Conn
+
+	err = scpClient.Copy(f, remotePath, fmt.Sprintf("%04o", mode.Perm()), info.Size())
+	if err != nil {
+		return fmt.Errorf("Error while copying %s to %s: %s", localPath, remotePath, err.Error())
+	}
+
+	return nil
+}
+
+// runRemote runs a command on the instance, discarding its output
+func runRemote(client *ssh.Client, command string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("unable to launch SSH session: %s", err)
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
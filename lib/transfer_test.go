@@ -0,0 +1,152 @@
+package ec2
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestParseTransfers(t *testing.T) {
+	tests := []struct {
+		spec       string
+		localFirst bool
+		want       FileTransfer
+		wantErr    bool
+	}{
+		{spec: "./project:/home/ec2-user/project", localFirst: true, want: FileTransfer{Local: "./project", Remote: "/home/ec2-user/project"}},
+		{spec: "config.yaml:etc/", localFirst: true, want: FileTransfer{Local: "config.yaml", Remote: "etc/"}},
+		{spec: `C:\data:/tmp/data`, localFirst: true, want: FileTransfer{Local: `C:\data`, Remote: "/tmp/data"}},
+		{spec: "/var/output/*.csv:results", want: FileTransfer{Local: "results", Remote: "/var/output/*.csv"}},
+		{spec: `/var/output:C:\results`, want: FileTransfer{Local: `C:\results`, Remote: "/var/output"}},
+		{spec: "project", localFirst: true, wantErr: true},
+		{spec: ":/tmp", localFirst: true, wantErr: true},
+		{spec: "project:", localFirst: true, wantErr: true},
+		{spec: "/var/output:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseTransfers([]string{tt.spec}, tt.localFirst)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got[0] != tt.want {
+				t.Errorf("got %+v, want %+v", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestScpSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ec2-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// what `scp -rf output report.csv` sends for a directory containing one file, followed by
+	// a top level file with a space in its name
+	stream := "D0755 0 output\n" +
+		"C0644 5 a.txt\n" + "hello" + "\x00" +
+		"E\n" +
+		"C0600 3 my report.csv\n" + "1,2" + "\x00"
+
+	var acks bytes.Buffer
+	if err := scpSink(bufio.NewReader(strings.NewReader(stream)), &acks, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "output", "a.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("got %q (%v), want hello", data, err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "my report.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestScpSinkErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing file": "\x01scp: /tmp/missing: No such file or directory\n",
+		"fatal error":  "\x02scp: protocol error\n",
+		"unsafe name":  "C0644 5 ../evil\nhello\x00",
+		"unbalanced":   "E\n",
+		"truncated":    "C0644 5 a.txt\nhel",
+	}
+
+	for name, stream := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "ec2-runner")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var acks bytes.Buffer
+			if err := scpSink(bufio.NewReader(strings.NewReader(stream)), &acks, dir); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/tmp/data":   "'/tmp/data'",
+		"with space":  "'with space'",
+		"it's":        `'it'\''s'`,
+		"$(rm -rf /)": "'$(rm -rf /)'",
+		"":            "''",
+	}
+
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestDownloadDirSeparatesInstancesWithoutColor(t *testing.T) {
+	client, _ := newTestClient()
+	opts := testInstanceOptions(client)
+	opts.Count = 2
+	opts.NoColor = true
+
+	instances, err := opts.Instances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := make(map[string]bool)
+	for i, instance := range instances {
+		instance.InstanceID = aws.String(fmt.Sprintf("i-%d", i))
+		dirs[instance.downloadDir("results")] = true
+	}
+	if len(dirs) != 2 {
+		t.Errorf("got download directories %v, want one per instance", dirs)
+	}
+
+	single := newTestInstance(t, client, nil)
+	single.InstanceID = aws.String("i-single")
+	if got := single.downloadDir("results"); got != "results" {
+		t.Errorf("got %s for a single instance, want results", got)
+	}
+}
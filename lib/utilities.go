@@ -5,7 +5,9 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
 )
 
 // Hash returns a random hash n characters long
@@ -23,24 +25,38 @@ func Hash(n int) string {
 	return string(b)
 }
 
-// Generate a New SSH key in AWS based on instance options returns pointers to the key name and identity
-func newKeyPair(logKey bool) (sshKeyName, sshKeyIdentity *string, err error) {
+// Generate a new ed25519 SSH key locally and import its public key into AWS so the private key
+// never leaves this machine. The key pair is given the tags. Returns the key name, a signer
+// for the private key and the private key in the OpenSSH format
+func newKeyPair(client *Client, logKey bool, tags []*ec2.Tag) (sshKeyName *string, signer ssh.Signer, privateKey []byte, err error) {
 	name := "ec2-cli#" + Hash(10)
 
-	input := &ec2.CreateKeyPairInput{
-		KeyName: &name,
+	signer, privateKey, err = newED25519Key()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to generate SSH key %s: %s", name, err)
+	}
+
+	input := &ec2.ImportKeyPairInput{
+		KeyName:           &name,
+		PublicKeyMaterial: ssh.MarshalAuthorizedKey(signer.PublicKey()),
+	}
+	if len(tags) > 0 {
+		input.TagSpecifications = []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeKeyPair), Tags: tags},
+		}
 	}
 
-	result, err := ec2Svc.CreateKeyPair(input)
+	_, err = client.EC2.ImportKeyPair(input)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to create AWS Key Pair %s: %s", name, err)
+		return nil, nil, nil, fmt.Errorf("Unable to import AWS Key Pair %s: %s", name, err)
 	}
 
+	// the key is needed to connect to instances left running later
 	if logKey {
-		fmt.Println(*result.KeyMaterial)
+		Log.Warnf("Private key for key pair %s:\n%s", name, privateKey)
 	}
 
-	return &name, result.KeyMaterial, nil
+	return &name, signer, privateKey, nil
 
 }
 